@@ -0,0 +1,112 @@
+// This file contains the addr2sym subcommand, which maps crash addresses of a converted module back to symbols.
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/OpenOrbis/create-fself/pkg/fself"
+	"github.com/OpenOrbis/create-fself/pkg/oelf"
+)
+
+// addr2symMain is the entry point of `create-fself addr2sym <eboot|sprx|debug-file> <addr...>`. Addresses are
+// module-relative offsets, unless -base is given, in which case they're runtime addresses.
+func addr2symMain(args []string) {
+	flagSet := flag.NewFlagSet("addr2sym", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: create-fself addr2sym <eboot|sprx|debug-file> <addr...> [flags]\n")
+		flagSet.PrintDefaults()
+	}
+
+	baseAddress := flagSet.String("base", "0", "runtime base address of the module, subtracted from each address")
+	inputElfPath := flagSet.String("elf", "", "original unstripped input ELF, for symbols and DWARF line info")
+	debugDir := flagSet.String("debug-dir", "", "directory to look up <digest>.debug files written by -debug-out")
+
+	positionalArgs := parseInterspersed(flagSet, args)
+
+	if len(positionalArgs) < 2 {
+		flagSet.Usage()
+		os.Exit(-1)
+	}
+
+	base, err := strconv.ParseUint(*baseAddress, 0, 64)
+	checkSubcommand("addr2sym", err)
+
+	moduleElf, digest, err := openModule(positionalArgs[0])
+	checkSubcommand("addr2sym", err)
+
+	var debugElfs []*elf.File
+
+	if *inputElfPath != "" {
+		inputElf, err := elf.Open(*inputElfPath)
+		checkSubcommand("addr2sym", err)
+
+		debugElfs = append(debugElfs, inputElf)
+	}
+
+	// Debug ELFs are keyed by the fself digest
+	if *debugDir != "" && digest != "" {
+		debugElfPath := filepath.Join(*debugDir, digest+".debug")
+
+		if debugElf, err := elf.Open(debugElfPath); err == nil {
+			debugElfs = append(debugElfs, debugElf)
+		} else {
+			fmt.Printf("Warning: no debug ELF found for digest %s (%s)\n", digest, err.Error())
+		}
+	}
+
+	symbolicator, err := oelf.NewSymbolicator(moduleElf, debugElfs...)
+	checkSubcommand("addr2sym", err)
+
+	for _, addressArg := range positionalArgs[1:] {
+		address, err := strconv.ParseUint(addressArg, 0, 64)
+		checkSubcommand("addr2sym", err)
+
+		if address < base {
+			errorExit("Address 0x%X is below the base address 0x%X\n", address, base)
+		}
+
+		fmt.Println(symbolicator.Symbolicate(address - base))
+	}
+}
+
+// openModule opens the given eboot, sprx, or ELF for symbolication. If it's an fself, the embedded ELF is unpacked
+// and its digest is returned as a hex string. Returns the module ELF, or an error if the file couldn't be parsed.
+func openModule(modulePath string) (*elf.File, string, error) {
+	moduleData, digest, err := readModule(modulePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	moduleElf, err := elf.NewFile(bytes.NewReader(moduleData))
+	return moduleElf, digest, err
+}
+
+// readModule reads the given eboot, sprx, or ELF. If it's an fself, the embedded ELF is unpacked and its digest is
+// returned as a hex string. Returns the ELF data, or an error if the file couldn't be read or unpacked.
+func readModule(modulePath string) ([]byte, string, error) {
+	moduleData, err := ioutil.ReadFile(modulePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(moduleData) < 4 || binary.LittleEndian.Uint32(moduleData) != fself.SELF_MAGIC_SELF {
+		return moduleData, "", nil
+	}
+
+	unpacked, err := fself.UnpackFSELFFromData(moduleData)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return unpacked.ElfData, hex.EncodeToString(unpacked.Digest[:]), nil
+}
@@ -0,0 +1,49 @@
+// This file contains the lint subcommand, which checks the segment layout of a converted module without building
+// anything.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/OpenOrbis/create-fself/pkg/oelf"
+)
+
+// lintMain is the entry point of `create-fself lint <oelf|eboot|sprx>`. The program headers are checked against the
+// section headers, which an fself only has if it was built with -keep-sections.
+func lintMain(args []string) {
+	flagSet := flag.NewFlagSet("lint", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: create-fself lint <oelf|eboot|sprx>\n")
+		flagSet.PrintDefaults()
+	}
+
+	positionalArgs := parseInterspersed(flagSet, args)
+
+	if len(positionalArgs) != 1 {
+		flagSet.Usage()
+		os.Exit(-1)
+	}
+
+	moduleData, _, err := readModule(positionalArgs[0])
+	checkSubcommand("lint", err)
+
+	lint, err := oelf.LintELF(moduleData)
+	checkSubcommand("lint", err)
+
+	for _, warning := range lint.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+
+	for _, problem := range lint.Errors {
+		fmt.Printf("Error: %s\n", problem)
+	}
+
+	if len(lint.Errors) > 0 {
+		errorExit("lint: found %d problem(s)\n", len(lint.Errors))
+	}
+
+	fmt.Printf("%s: no problems found\n", positionalArgs[0])
+}
@@ -4,21 +4,36 @@
 package main
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"strings"
+	"path/filepath"
 
 	"github.com/OpenOrbis/create-fself/pkg/fself"
 	"github.com/OpenOrbis/create-fself/pkg/oelf"
 )
 
+// _tempFilePaths holds the temporary files that have to be removed before exiting, including on errors.
+var _tempFilePaths []string
+
 // errorExit function will print the given formatted error to stdout and exit immediately after.
 func errorExit(format string, params ...interface{}) {
 	fmt.Printf(format, params...)
+	removeTempFiles()
 	os.Exit(-1)
 }
 
+// removeTempFiles removes the temporary files in _tempFilePaths. Files that are already gone are ignored.
+func removeTempFiles() {
+	for _, tempFilePath := range _tempFilePaths {
+		_ = os.Remove(tempFilePath)
+	}
+
+	_tempFilePaths = nil
+}
+
 // check will check the error given by argument. If it's not nil, it will print the error to the console and the program
 // will exit.
 func check(err error) {
@@ -27,12 +42,83 @@ func check(err error) {
 	}
 }
 
-func main() {
-	// Get the SDK path in the environment variables. If it's not set, we need to state so and bail because we *need* it
-	sdkPath := os.Getenv("OO_PS4_TOOLCHAIN")
+// checkSubcommand is the same as check, but for subcommands that don't build an FSELF. The error is prefixed with the
+// subcommand name instead.
+func checkSubcommand(name string, err error) {
+	if err != nil {
+		errorExit("%s: %s\n", name, err.Error())
+	}
+}
 
-	if sdkPath == "" {
-		errorExit("The 'OO_PS4_TOOLCHAIN' environment variable is not set. It must be set to the root directory of the toolchain.\n")
+// validateParameters checks the SELF meta-data parameters against each other. If they don't agree, the program will
+// exit unless force is set, in which case a warning is printed instead.
+func validateParameters(isLib bool, isFixedAddress bool, programType fself.ProgramType, paid int64, authInfo string, force bool) {
+	if err := fself.ValidateParameters(isLib, isFixedAddress, programType, paid, authInfo); err != nil {
+		if !force {
+			errorExit("Invalid SELF parameters: %s (use -force to build anyway)\n", err.Error())
+		}
+
+		fmt.Printf("Warning: invalid SELF parameters: %s\n", err.Error())
+	}
+}
+
+// openStubCache opens the stub cache in the given directory, clearing it first if clear is set. The cache only speeds up
+// conversions, so if it can't be opened a warning is printed and nil is returned instead. Returns nil if disabled is set.
+func openStubCache(dir string, disabled bool, clear bool) *oelf.StubCache {
+	if disabled && !clear {
+		return nil
+	}
+
+	stubCache, err := oelf.OpenStubCache(dir)
+	if err != nil {
+		fmt.Printf("Warning: couldn't open the stub cache: %s\n", err.Error())
+		return nil
+	}
+
+	if clear {
+		if err := stubCache.Clear(); err != nil {
+			fmt.Printf("Warning: couldn't clear the stub cache: %s\n", err.Error())
+		}
+	}
+
+	if disabled {
+		return nil
+	}
+
+	return stubCache
+}
+
+// getDebugELFPath takes the given -debug-out path and fself digest, and decides where the debug ELF is written. If the
+// path is a directory (or ends with a path separator), the debug ELF is written to `<digest>.debug` in it, which is
+// where addr2sym -debug-dir looks for it. The directory is created if needed. Returns the debug ELF path, or an error if
+// the directory couldn't be created.
+func getDebugELFPath(debugOutPath string, digest [0x20]byte) (string, error) {
+	fileInfo, err := os.Stat(debugOutPath)
+
+	if (err == nil && fileInfo.IsDir()) || os.IsPathSeparator(debugOutPath[len(debugOutPath)-1]) {
+		if err := os.MkdirAll(debugOutPath, 0755); err != nil {
+			return "", err
+		}
+
+		return filepath.Join(debugOutPath, hex.EncodeToString(digest[:])+".debug"), nil
+	}
+
+	return debugOutPath, nil
+}
+
+// _subcommands maps subcommand names to their entry points. Without a subcommand, an ELF is converted.
+var _subcommands = map[string]func(args []string){
+	"rewrap":   rewrapMain,
+	"addr2sym": addr2symMain,
+	"lint":     lintMain,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := _subcommands[os.Args[1]]; ok {
+			subcommand(os.Args[2:])
+			return
+		}
 	}
 
 	// Required flags
@@ -41,17 +127,31 @@ func main() {
 	// Semi-optional flags (one must be specified)
 	outEbootPath := flag.String("eboot", "", "eboot.bin output path")
 	outLibPath := flag.String("lib", "", "library output path")
+	outPayloadPath := flag.String("payload", "", "payload output path, for loading by an exploit or ELF loader instead of the system loader")
 
 	// Optional flags
-	outputFilePath := flag.String("out", "", "output OELF path")
+	outputFilePath := flag.String("out", "", "also write the intermediate OELF to this path, for debugging")
 	sdkVer := flag.Int("sdkver", 0x1000051, "SDK version integer")
-	pType := flag.String("ptype", "", "program type {fake, npdrm_exec, npdrm_dynlib, system_exec, system_dynlib, host_kernel, secure_module, secure_kernel}")
+	pType := flag.String("ptype", "", "program type {"+fself.ProgramTypeNames()+"}")
 	authInfo := flag.String("authinfo", "", "authentication info")
 	paid := flag.Int64("paid", 0x3800000000000011, "program authentication ID")
 	appVer := flag.Int64("appversion", 0, "application version")
 	fwVer := flag.Int64("fwversion", 0, "firmware version")
 	libName := flag.String("libname", "", "library name (ignored in create-eboot)")
 	libPath := flag.String("library-path", "", "additional directories to search for .so files")
+	stubCacheDir := flag.String("stub-cache", "", "directory to cache parsed .so files in (default is in the user cache directory)")
+	noStubCache := flag.Bool("no-stub-cache", false, "parse .so files on each run instead of caching them")
+	clearStubCache := flag.Bool("clear-stub-cache", false, "clear the .so cache before building")
+	linkManifestPath := flag.String("link-manifest", "", "link manifest path, ie. to mark imported modules as optional")
+	exportsPath := flag.String("exports", "", "export list or version script, with glob patterns for the symbols a library exports")
+	debugOutPath := flag.String("debug-out", "", "debug ELF output path (symbols and DWARF, keyed to the fself digest), or a directory to write <digest>.debug to")
+	keepSections := flag.Bool("keep-sections", false, "experimental: keep section headers and non-loadable data (symbols, debug info) in an extra fself entry, using an encoding of this tool's own that the PS4 loader and other unpackers may reject")
+	layoutReport := flag.Bool("layout-report", false, "print the output segments and which segment the unwind tables are mapped by")
+	noASLR := flag.Bool("no-aslr", false, "produce a fixed-address eboot (ET_SCE_EXEC) from a position-dependent input ELF linked at its load address")
+	relayout := flag.Bool("relayout", false, "rebuild the segment layout so segments start on their own 0x4000 aligned pages (moving segments needs --emit-relocs)")
+	payloadFormat := flag.String("payload-format", "bin", "payload format {bin, elf}")
+	payloadBase := flag.String("payload-base", "0", "address the payload will be loaded at, relocations are resolved against it")
+	force := flag.Bool("force", false, "build even if -ptype, -paid, and -authinfo don't agree with each other or the output type")
 
 	flag.Parse()
 
@@ -60,13 +160,30 @@ func main() {
 		errorExit("Input file not specified, try -in=[input ELF path]\n")
 	}
 
-	// Check that at one (and only one) of -eboot or -lib is set
+	// Check that at one (and only one) of -eboot, -lib, or -payload is set
 	if *outEbootPath != "" && *outLibPath != "" {
 		errorExit("Invalid to have an output eboot path and output library path at the same time.\n")
 	}
 
-	if *outEbootPath == "" && *outLibPath == "" {
-		errorExit("Need either an output eboot path or output library path.\n")
+	if *outPayloadPath != "" && (*outEbootPath != "" || *outLibPath != "") {
+		errorExit("Invalid to have an output payload path and output eboot or library path at the same time.\n")
+	}
+
+	if *outEbootPath == "" && *outLibPath == "" && *outPayloadPath == "" {
+		errorExit("Need either an output eboot path, output library path, or output payload path.\n")
+	}
+
+	// Payloads aren't loaded by the system loader, so they don't need the toolchain or any SELF meta-data
+	if *outPayloadPath != "" {
+		createPayload(*inputFilePath, *outPayloadPath, *payloadFormat, *payloadBase)
+		return
+	}
+
+	// Get the SDK path in the environment variables. If it's not set, we need to state so and bail because we *need* it
+	sdkPath := os.Getenv("OO_PS4_TOOLCHAIN")
+
+	if sdkPath == "" {
+		errorExit("The 'OO_PS4_TOOLCHAIN' environment variable is not set. It must be set to the root directory of the toolchain.\n")
 	}
 
 	isLib := false
@@ -74,18 +191,69 @@ func main() {
 		isLib = true
 	}
 
-	// Check if outputFilePath is set, if it's not, we'll set it but clean it up later
-	isOelfTemp := false
+	// Eboots don't export symbols
+	if !isLib && *exportsPath != "" {
+		errorExit("Invalid to have an export list (-exports) for an eboot, only libraries export symbols.\n")
+	}
+
+	// Check the SELF meta-data before doing any work, unknown program types can never be forced
+	programType, err := fself.ParseProgramType(*pType)
+	check(err)
+
+	validateParameters(isLib, *noASLR, programType, *paid, *authInfo, *force)
+
+	if *keepSections {
+		fmt.Printf("Warning: -keep-sections uses an extra entry that isn't part of any documented SELF format, the PS4 loader and other unpackers may reject it\n")
+	}
+
+	var linkManifest *oelf.LinkManifest
+
+	if *linkManifestPath != "" {
+		linkManifest, err = oelf.ParseLinkManifest(*linkManifestPath)
+		check(err)
+	}
+
+	var exportList *oelf.ExportList
+
+	if *exportsPath != "" {
+		exportList, err = oelf.ParseExportList(*exportsPath)
+		check(err)
+	}
+
+	// Rebuild the segment layout from sections if asked to, and convert that instead of the input
+	inputFileName := *inputFilePath
+
+	if *relayout {
+		relayoutFile, err := ioutil.TempFile("", "create-fself-*.layout.elf")
+		check(err)
+
+		relayoutPath := relayoutFile.Name()
+		_tempFilePaths = append(_tempFilePaths, relayoutPath)
+		_ = relayoutFile.Close()
+
+		layout, err := oelf.RelayoutELF(*inputFilePath, relayoutPath)
+		check(err)
+
+		for _, warning := range layout.Warnings {
+			fmt.Printf("Warning: %s\n", warning)
+		}
 
-	if *outputFilePath == "" {
-		*outputFilePath = strings.Split(*inputFilePath, ".")[0] + ".oelf"
-		isOelfTemp = true
+		if *layoutReport {
+			fmt.Print(layout.Report())
+		}
+
+		*inputFilePath = relayoutPath
 	}
 
-	// Start generating final oelf file
-	orbisElf, err := oelf.CreateOrbisElf(isLib, *inputFilePath, *outputFilePath, *libName)
+	// Start generating final oelf, which is built over the input in memory and only written out if -out is given
+	orbisElf, err := oelf.CreateOrbisElf(isLib, *noASLR, *inputFilePath, *outputFilePath, *libName)
 	check(err)
 
+	orbisElf.FileName = inputFileName
+	orbisElf.LinkManifest = linkManifest
+	orbisElf.ExportList = exportList
+	orbisElf.StubCache = openStubCache(*stubCacheDir, *noStubCache, *clearStubCache)
+
 	// Create the .sce_dynlib_data segment onto the end of the file
 	err = orbisElf.GenerateDynlibData(sdkPath, *libPath)
 	check(err)
@@ -94,6 +262,14 @@ func main() {
 	err = orbisElf.GenerateProgramHeaders()
 	check(err)
 
+	for _, warning := range orbisElf.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+
+	if *layoutReport {
+		fmt.Print(orbisElf.LayoutReport())
+	}
+
 	// Overwrite ELF file header with PS4-ified values, as well as the SDK version in .sce_process_param/.sce_module_param
 	err = orbisElf.RewriteELFHeader()
 	check(err)
@@ -107,13 +283,9 @@ func main() {
 
 	// Overwrite .dynamic section header to point to the new dynamic table
 	err = orbisElf.RewriteDynamicSectionHeader()
-
-	// Commit
-	err = orbisElf.FinalFile.Close()
 	check(err)
 
-	// Create FSELF
-	fselfInputPath := *outputFilePath
+	// Create FSELF straight from the orbis ELF, without writing it out first
 	fselfOutputPath := ""
 
 	if *outEbootPath != "" {
@@ -122,10 +294,26 @@ func main() {
 		fselfOutputPath = *outLibPath
 	}
 
-	err = fself.CreateFSELF(isLib, fselfInputPath, fselfOutputPath, *paid, *pType, *appVer, *fwVer, *authInfo)
+	orbisElfData, orbisElfSize, err := orbisElf.Reader()
+	check(err)
+
+	digest, err := fself.CreateFSELFFromReader(isLib, orbisElfData, orbisElfSize, fselfOutputPath, *paid, programType, *appVer, *fwVer, *authInfo, *keepSections)
+	check(err)
+
+	// Write the oelf to -out if given, and close the input
+	err = orbisElf.Close()
+	check(err)
+
+	// Write the debug ELF, using the fself digest as its build ID so it can be found from the eboot/sprx later
+	if *debugOutPath != "" {
+		debugElfPath, err := getDebugELFPath(*debugOutPath, digest)
+		check(err)
 
-	// Cleanup oelf file if needed
-	if isOelfTemp {
-		_ = os.Remove(*outputFilePath)
+		err = orbisElf.WriteDebugELF(debugElfPath, digest[:])
+		check(err)
+
+		fmt.Printf("Wrote debug ELF %s (build ID %s)\n", debugElfPath, hex.EncodeToString(digest[:]))
 	}
+
+	removeTempFiles()
 }
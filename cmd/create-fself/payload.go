@@ -0,0 +1,35 @@
+// This file contains the payload output mode, which builds a flat binary or minimal ELF for an exploit or ELF loader
+// instead of an FSELF.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/OpenOrbis/create-fself/pkg/oelf"
+)
+
+// createPayload builds a payload from the given input ELF in the given format, resolving its relocations against the
+// given base address. Imports that couldn't be resolved are listed, since the loader has to resolve them instead.
+func createPayload(inputFilePath string, outputPath string, formatName string, baseAddress string) {
+	format, err := oelf.ParsePayloadFormat(formatName)
+	check(err)
+
+	base, err := strconv.ParseUint(baseAddress, 0, 64)
+	check(err)
+
+	payload, err := oelf.CreatePayload(inputFilePath, outputPath, base, format)
+	check(err)
+
+	for _, warning := range payload.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+
+	for _, symbolName := range payload.UnresolvedImports {
+		fmt.Printf("Unresolved import: %s\n", symbolName)
+	}
+
+	fmt.Printf("Wrote payload %s (base 0x%X, entry 0x%X, size 0x%X)\n", outputPath, payload.Base, payload.Entry,
+		payload.Size)
+}
@@ -0,0 +1,92 @@
+// This file contains the rewrap subcommand, which rebuilds an existing FSELF with new meta-data without needing the
+// original ELF.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/OpenOrbis/create-fself/pkg/fself"
+)
+
+// rewrapMain is the entry point of `create-fself rewrap in.bin out.bin [flags]`. It unpacks the ELF embedded in the
+// input FSELF and builds a new FSELF from it. Any meta-data that isn't overridden by flags is kept from the input.
+func rewrapMain(args []string) {
+	flagSet := flag.NewFlagSet("rewrap", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: create-fself rewrap in.bin out.bin [flags]\n")
+		flagSet.PrintDefaults()
+	}
+
+	pType := flagSet.String("ptype", "", "program type {"+fself.ProgramTypeNames()+"} (default: keep)")
+	authInfo := flagSet.String("authinfo", "", "authentication info (default: keep)")
+	paid := flagSet.Int64("paid", 0, "program authentication ID (default: keep)")
+	appVer := flagSet.Int64("appversion", 0, "application version (default: keep)")
+	fwVer := flagSet.Int64("fwversion", 0, "firmware version (default: keep)")
+	keepSections := flagSet.Bool("keep-sections", false, "experimental: keep section headers and non-loadable data in an extra entry, which the PS4 loader and other unpackers may reject (default: keep if the input has them)")
+	force := flagSet.Bool("force", false, "build even if -ptype, -paid, and -authinfo don't agree with each other or the output type")
+
+	positionalArgs := parseInterspersed(flagSet, args)
+
+	if len(positionalArgs) != 2 {
+		flagSet.Usage()
+		os.Exit(-1)
+	}
+
+	inputPath := positionalArgs[0]
+	outputPath := positionalArgs[1]
+
+	unpacked, err := fself.UnpackFSELF(inputPath)
+	check(err)
+
+	// Only override what was explicitly given on the command line
+	flagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ptype":
+			unpacked.PType, err = fself.ParseProgramType(*pType)
+			check(err)
+		case "authinfo":
+			unpacked.AuthInfo = *authInfo
+		case "paid":
+			unpacked.Paid = *paid
+		case "appversion":
+			unpacked.AppVersion = *appVer
+		case "fwversion":
+			unpacked.FwVersion = *fwVer
+		case "keep-sections":
+			unpacked.HasSections = *keepSections
+		}
+	})
+
+	if unpacked.HasSections {
+		fmt.Printf("Warning: keeping section headers in an extra entry that isn't part of any documented SELF format, the PS4 loader and other unpackers may reject it\n")
+	}
+
+	validateParameters(unpacked.IsLib, unpacked.IsFixedAddress, unpacked.PType, unpacked.Paid, unpacked.AuthInfo, *force)
+
+	// The original digest is kept, so debug files written for the input still match
+	_, err = fself.RewrapFSELF(unpacked, outputPath)
+	check(err)
+}
+
+// parseInterspersed parses the given arguments with flagSet, allowing flags to come before, between, or after the
+// positional arguments. Returns the positional arguments.
+func parseInterspersed(flagSet *flag.FlagSet, args []string) []string {
+	var positionalArgs []string
+
+	for {
+		// ExitOnError flag sets exit on their own, so the error can be ignored
+		_ = flagSet.Parse(args)
+
+		if flagSet.NArg() == 0 {
+			break
+		}
+
+		positionalArgs = append(positionalArgs, flagSet.Arg(0))
+		args = flagSet.Args()[1:]
+	}
+
+	return positionalArgs
+}
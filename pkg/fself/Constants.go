@@ -6,6 +6,15 @@ package fself
 
 const BLOCK_SIZE = 0x4000
 
+///
+// Unpacking limits
+///
+
+// MAX_UNPACKED_ELF_SIZE is the largest ELF an fself is unpacked to. The ELF's size comes from offsets in the fself,
+// which aren't bounded by the fself's own size (data that isn't loaded, such as debug info, leaves gaps in the ELF), so
+// this caps what a bad fself can allocate.
+const MAX_UNPACKED_ELF_SIZE = 0x40000000
+
 ///
 // Magic constants
 ///
@@ -43,6 +52,7 @@ const SELF_HEADER_SIZE = 0x20
 const SELF_ENTRY_SIZE = 0x50
 const SELF_ELF_HEADER_SIZE = 0x40
 const SELF_ELF_PROGHEADER_SIZE = 0x38
+const SELF_ELF_SECTIONHEADER_SIZE = 0x40
 const SELF_EXTENDED_HEADER_SIZE = 0x40
 const SELF_META_FOOTER_SIZE = 0x50
 const SELF_NPDRM_BLOCK_SIZE = 0x30
@@ -50,18 +60,39 @@ const SELF_META_BLOCK_SIZE = 0x50
 const SELF_META_DATA_BLOCK_SIZE = 0x20
 const SELF_SIGNATURE_SIZE = 0x100
 
-const SELF_PTYPE_FAKE = 0x1
-const SELF_PTYPE_NPDRM_EXEC = 0x4
-const SELF_PTYPE_NPDRM_DYNLIB = 0x5
-const SELF_PTYPE_SYSTEM_EXEC = 0x8
-const SELF_PTYPE_SYSTEM_DYNLIB = 0x9
-const SELF_PTYPE_HOST_KERNEL = 0xC
-const SELF_PTYPE_SECURE_MODULE = 0xE
-const SELF_PTYPE_SECURE_KERNEL = 0xF
+///
+// Program types
+///
+
+const SELF_PTYPE_FAKE ProgramType = 0x1
+const SELF_PTYPE_NPDRM_EXEC ProgramType = 0x4
+const SELF_PTYPE_NPDRM_DYNLIB ProgramType = 0x5
+const SELF_PTYPE_SYSTEM_EXEC ProgramType = 0x8
+const SELF_PTYPE_SYSTEM_DYNLIB ProgramType = 0x9
+const SELF_PTYPE_HOST_KERNEL ProgramType = 0xC
+const SELF_PTYPE_SECURE_MODULE ProgramType = 0xE
+const SELF_PTYPE_SECURE_KERNEL ProgramType = 0xF
+
+///
+// Program authentication ID (PAID) range
+///
+
+const SELF_PAID_MIN = 0x3000000000000000
+const SELF_PAID_MAX = 0x3FFFFFFFFFFFFFFF
+
+///
+// Authentication info
+///
+
+const SELF_AUTHINFO_PAID_SIZE = 0x8
+const SELF_AUTHINFO_MAX_SIZE = SELF_SIGNATURE_SIZE - 0x10 + SELF_AUTHINFO_PAID_SIZE
 
 ///
 // ELF values
 ///
 
+const ET_SCE_EXEC = 0xFE00
+const ET_SCE_DYNAMIC = 0xFE18
+
 const PT_SCE_DYNLIBDATA = 0x61000000 // Dynamic Linking Data
 const PT_SCE_RELRO = 0x61000010      // Read-Only Reallocation Data
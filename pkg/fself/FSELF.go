@@ -9,6 +9,7 @@ import (
 	"debug/elf"
 	"encoding/binary"
 	"encoding/hex"
+	"io"
 	"os"
 	"strconv"
 )
@@ -17,39 +18,73 @@ import (
 var _selfEntries []*SelfEntryInfo
 
 // CreateFSELF takes a given orbis ELF path, as well as various meta-data parameters, to create an fself for the final
-// eboot. Returns error if an issue was encountered in creating the fself, nil otherwise.
-func CreateFSELF(isLib bool, orbisElfPath string, outputPath string, paid int64, pType string, appVersion int64, fwVersion int64, authInfo string) error {
-	inputFileBuff := new(bytes.Buffer)
-
-	// Get the file data for getting the digest as well as other parsing
-	inputElfFile, err := os.Open(orbisElfPath)
+// eboot. Returns the sha256 digest written to the extended info header, which can be used to identify the fself. Returns
+// error if an issue was encountered in creating the fself, nil otherwise.
+func CreateFSELF(isLib bool, orbisElfPath string, outputPath string, paid int64, pType ProgramType, appVersion int64, fwVersion int64, authInfo string, keepSections bool) ([0x20]byte, error) {
+	// The orbis ELF is streamed rather than read into memory, as it can be several gigabytes
+	orbisElfFile, err := os.Open(orbisElfPath)
 	if err != nil {
-		return err
+		return [0x20]byte{}, err
 	}
 
-	_, err = inputFileBuff.ReadFrom(inputElfFile)
-	if err != nil {
-		return err
-	}
+	defer orbisElfFile.Close()
 
-	err = inputElfFile.Close()
+	orbisElfInfo, err := orbisElfFile.Stat()
 	if err != nil {
-		return err
+		return [0x20]byte{}, err
 	}
 
+	return CreateFSELFFromReader(isLib, orbisElfFile, orbisElfInfo.Size(), outputPath, paid, pType, appVersion, fwVersion, authInfo, keepSections)
+}
+
+// CreateFSELFFromData is the same as CreateFSELF, but takes the orbis ELF as an in-memory buffer rather than a path.
+func CreateFSELFFromData(isLib bool, orbisElfData []byte, outputPath string, paid int64, pType ProgramType, appVersion int64, fwVersion int64, authInfo string, keepSections bool) ([0x20]byte, error) {
+	return CreateFSELFFromReader(isLib, bytes.NewReader(orbisElfData), int64(len(orbisElfData)), outputPath, paid, pType, appVersion, fwVersion, authInfo, keepSections)
+}
+
+// CreateFSELFFromReader is the same as CreateFSELF, but reads the orbis ELF of the given size from a reader. The orbis
+// ELF is hashed incrementally, and segment data is copied straight to its offset in the fself, so only the headers
+// (and the extra data) are held in memory. If keepSections is set, the section headers and any data not covered by a
+// segment are kept in an extra data entry, otherwise the section header fields of the ELF header are cleared. Returns
+// the sha256 digest of the orbis ELF, as well as error if an issue was encountered in creating the fself, nil otherwise.
+func CreateFSELFFromReader(isLib bool, orbisElf io.ReaderAt, orbisElfSize int64, outputPath string, paid int64, pType ProgramType, appVersion int64, fwVersion int64, authInfo string, keepSections bool) ([0x20]byte, error) {
+	return createFSELF(isLib, orbisElf, orbisElfSize, outputPath, paid, pType, appVersion, fwVersion, authInfo, keepSections, nil)
+}
+
+// createFSELF is the implementation of CreateFSELFFromReader. If digest is nil, the sha256 digest of the orbis ELF is
+// calculated and written to the extended info header, otherwise the given digest is written as-is. Returns the digest
+// that was written, as well as error if an issue was encountered in creating the fself, nil otherwise.
+func createFSELF(isLib bool, orbisElf io.ReaderAt, orbisElfSize int64, outputPath string, paid int64, pType ProgramType, appVersion int64, fwVersion int64, authInfo string, keepSections bool, digest *[0x20]byte) ([0x20]byte, error) {
+	var sha256Digest [0x20]byte
+
+	// Start with a fresh entry list in case we've already built an fself in this process
+	_selfEntries = nil
+
 	// Calculate the sha256 digest so we can put it in the extended info header
-	sha256Digest := sha256.Sum256(inputFileBuff.Bytes())
+	if digest != nil {
+		sha256Digest = *digest
+	} else {
+		digestHash := sha256.New()
 
-	// Open the file as an ELF for parsing
-	inputElf, err := elf.Open(orbisElfPath)
-	if err != nil {
-		return err
+		if _, err := io.Copy(digestHash, io.NewSectionReader(orbisElf, 0, orbisElfSize)); err != nil {
+			return sha256Digest, err
+		}
+
+		copy(sha256Digest[:], digestHash.Sum(nil))
 	}
 
-	// Open the output file to write to
-	outputFself, err := os.Create(outputPath)
+	// Parse the data as an ELF
+	inputElf, err := elf.NewFile(orbisElf)
 	if err != nil {
-		return err
+		return sha256Digest, err
+	}
+
+	var extraData *SelfExtraData
+
+	if keepSections {
+		if extraData, err = createExtraData(inputElf, orbisElf, orbisElfSize); err != nil {
+			return sha256Digest, err
+		}
 	}
 
 	signature := make([]byte, SELF_SIGNATURE_SIZE)
@@ -60,7 +95,7 @@ func CreateFSELF(isLib bool, orbisElfPath string, outputPath string, paid int64,
 
 	// Get the header size
 	headerSize := SELF_HEADER_SIZE
-	headerSize += createSelfEntries(inputElf.Progs)
+	headerSize += createSelfEntries(inputElf.Progs, extraData != nil)
 	headerSize += SELF_ELF_HEADER_SIZE
 	headerSize += len(inputElf.Progs) * SELF_ELF_PROGHEADER_SIZE
 
@@ -75,7 +110,7 @@ func CreateFSELF(isLib bool, orbisElfPath string, outputPath string, paid int64,
 
 	for _, prog := range inputElf.Progs {
 		// Skip non-load and non-sce related segments
-		if prog.Type != elf.PT_LOAD && prog.Type != PT_SCE_RELRO && prog.Type != PT_SCE_DYNLIBDATA {
+		if !isSelfSegment(prog) {
 			continue
 		}
 
@@ -91,15 +126,12 @@ func CreateFSELF(isLib bool, orbisElfPath string, outputPath string, paid int64,
 		offset += _selfEntries[entryIndex].FileSize
 		offset = align(offset, 0x10)
 
-		// Write data block for the segment (segment data)
-		segmentData := make([]byte, prog.Filesz)
-
-		_, err = prog.ReadAt(segmentData, 0)
-		if err != nil {
-			return err
+		// Write data block for the segment (segment data), which is copied from the orbis ELF when it's written
+		if prog.Filesz > uint64(orbisElfSize) || prog.Off > uint64(orbisElfSize)-prog.Filesz {
+			return sha256Digest, io.ErrUnexpectedEOF
 		}
 
-		_selfEntries[entryIndex+1].Data = &segmentData
+		_selfEntries[entryIndex+1].Source = io.NewSectionReader(orbisElf, int64(prog.Off), int64(prog.Filesz))
 		_selfEntries[entryIndex+1].Offset = offset
 		_selfEntries[entryIndex+1].FileSize = prog.Filesz
 		_selfEntries[entryIndex+1].MemorySize = prog.Filesz
@@ -110,12 +142,29 @@ func CreateFSELF(isLib bool, orbisElfPath string, outputPath string, paid int64,
 		entryIndex += 2
 	}
 
+	// Write the extra data block last (non-loadable data)
+	if extraData != nil {
+		_selfEntries[entryIndex].Data = &extraData.Data
+		_selfEntries[entryIndex].Offset = offset
+		_selfEntries[entryIndex].FileSize = uint64(len(extraData.Data))
+		_selfEntries[entryIndex].MemorySize = uint64(len(extraData.Data))
+
+		offset += _selfEntries[entryIndex].FileSize
+		offset = align(offset, 0x10)
+	}
+
 	fileSize := offset
 
 	// Get the flags for the self
 	signedBlockCount := 0x2
 	flags := 0x2 | ((signedBlockCount & 0x7) << 4)
 
+	// Open the output file to write to, now that the segments are known to be in bounds
+	outputFself, err := os.Create(outputPath)
+	if err != nil {
+		return sha256Digest, err
+	}
+
 	// Write the fake self
 	finalFileSize := 0
 
@@ -131,28 +180,33 @@ func CreateFSELF(isLib bool, orbisElfPath string, outputPath string, paid int64,
 
 	finalFileSize += writeNullPadding(outputFself, finalFileSize, 0x10)
 	finalFileSize += writeSelfEntries(outputFself)
-	finalFileSize += writeELFHeaders(outputFself, inputElf, inputFileBuff)
+	finalFileSize += writeELFHeaders(outputFself, inputElf, orbisElf, extraData)
 	finalFileSize += writeNullPadding(outputFself, finalFileSize, 0x10)
 	finalFileSize += writeExtendedInfo(outputFself, pType, uint64(paid), uint64(appVersion), uint64(fwVersion), sha256Digest)
 	finalFileSize += writeNpdrmControlBlock(outputFself)
 	finalFileSize += writeMetaBlocks(outputFself)
 	finalFileSize += writeMetaFooter(outputFself, 0x10000)
 	finalFileSize += writeSignature(outputFself, signature)
-	finalFileSize += writeSegments(outputFself)
+	if _, err = writeSegments(outputFself); err != nil {
+		// Don't leave a partial fself behind
+		_ = outputFself.Close()
+		_ = os.Remove(outputPath)
+		return sha256Digest, err
+	}
 
 	err = outputFself.Close()
-	return err
+	return sha256Digest, err
 }
 
 // createSelfEntries takes a list of program headers and creates an entry list for them. Empty entries with the expected
-// properties are created and inserted into SelfEntries. The Offset, FileSize, MemorySize, and Data fields are set later.
-// Returns the number of bytes that consist of SelfEntries.
-func createSelfEntries(programHeaders []*elf.Prog) int {
+// properties are created and inserted into SelfEntries. If hasExtraData is set, an extra data entry is added last. The
+// Offset, FileSize, MemorySize, and Data fields are set later. Returns the number of bytes that consist of SelfEntries.
+func createSelfEntries(programHeaders []*elf.Prog, hasExtraData bool) int {
 	entryIndex := 0
 
 	for i, prog := range programHeaders {
 		// Skip non-load and non-sce related segments
-		if prog.Type != elf.PT_LOAD && prog.Type != PT_SCE_RELRO && prog.Type != PT_SCE_DYNLIBDATA {
+		if !isSelfSegment(prog) {
 			continue
 		}
 
@@ -190,6 +244,19 @@ func createSelfEntries(programHeaders []*elf.Prog) int {
 		entryIndex += 2
 	}
 
+	// The extra data entry isn't signed and doesn't map to a program header, its segment index is out of range. This is
+	// create-fself's own encoding rather than a documented one, so it's only written when asked for (-keep-sections).
+	if hasExtraData {
+		extraEntryProperties := setProperty(0, SELF_ENTRY_PROPERTY_BIT_SEGMENT_INDEX, 0xFFFF, uint64(len(programHeaders)))
+
+		_selfEntries = append(_selfEntries, &SelfEntryInfo{
+			Properties: extraEntryProperties,
+			Offset:     0,
+			FileSize:   0,
+			MemorySize: 0,
+		})
+	}
+
 	return len(_selfEntries) * SELF_META_DATA_BLOCK_SIZE
 }
 
@@ -260,15 +327,29 @@ func writeSelfEntries(file *os.File) int {
 }
 
 // writeELFHeaders takes a given file and input ELF as well as input ELF data, and writes them to a file. These headers
-// include the ELF file header as well as the program headers. Returns the number of bytes written.
-func writeELFHeaders(file *os.File, inputFile *elf.File, inputFileData *bytes.Buffer) int {
+// include the ELF file header as well as the program headers. If extraData is nil, the section header fields are
+// cleared since section data isn't kept. Otherwise, they're pointed at the extra data. Returns the number of bytes written.
+func writeELFHeaders(file *os.File, inputFile *elf.File, inputFileData io.ReaderAt, extraData *SelfExtraData) int {
+	elfHeaderBuff := new(bytes.Buffer)
 	elfSegmentHeaders := new(bytes.Buffer)
 
 	// Write the ELF header
-	_, _ = file.Write(inputFileData.Bytes()[0:0x40])
+	elfHeader := elf.Header64{}
+	_ = readStructFrom(inputFileData, 0, &elfHeader)
+
+	if extraData != nil {
+		elfHeader.Shoff = extraData.Offset
+	} else {
+		elfHeader.Shoff = 0
+		elfHeader.Shnum = 0
+		elfHeader.Shstrndx = 0
+	}
+
+	_ = binary.Write(elfHeaderBuff, binary.LittleEndian, elfHeader)
+	_, _ = file.Write(elfHeaderBuff.Bytes())
 
 	// Write the program headers
-	for _, prog := range inputFile.Progs {
+	for i, prog := range inputFile.Progs {
 		prog64 := elf.Prog64{
 			Type:   uint32(prog.Type),
 			Flags:  uint32(prog.Flags),
@@ -280,6 +361,13 @@ func writeELFHeaders(file *os.File, inputFile *elf.File, inputFileData *bytes.Bu
 			Align:  prog.Align,
 		}
 
+		// Non-loadable segments whose data was moved into the extra data
+		if extraData != nil {
+			if offset, ok := extraData.ProgOffsets[i]; ok {
+				prog64.Off = offset
+			}
+		}
+
 		_ = binary.Write(elfSegmentHeaders, binary.LittleEndian, prog64)
 	}
 
@@ -289,31 +377,12 @@ func writeELFHeaders(file *os.File, inputFile *elf.File, inputFileData *bytes.Bu
 
 // writeExtendedInfo takes a given file and various app parameters, and writes the SelfExtendedInfo header to it. Returns
 // the number of bytes written.
-func writeExtendedInfo(file *os.File, pType string, paid uint64, appVersion uint64, fwVersion uint64, digest [0x20]byte) int {
-	programType := uint64(SELF_PTYPE_FAKE)
+func writeExtendedInfo(file *os.File, pType ProgramType, paid uint64, appVersion uint64, fwVersion uint64, digest [0x20]byte) int {
 	extendedHeaderBuff := new(bytes.Buffer)
 
-	// Get the type from user argument
-	switch pType {
-	case "npdrm_exec":
-		programType = SELF_PTYPE_NPDRM_EXEC
-	case "npdrm_dynlib":
-		programType = SELF_PTYPE_NPDRM_DYNLIB
-	case "system_exec":
-		programType = SELF_PTYPE_SYSTEM_EXEC
-	case "system_dynlib":
-		programType = SELF_PTYPE_SYSTEM_DYNLIB
-	case "host_kernel":
-		programType = SELF_PTYPE_HOST_KERNEL
-	case "secure_module":
-		programType = SELF_PTYPE_SECURE_MODULE
-	case "secure_kernel":
-		programType = SELF_PTYPE_SECURE_KERNEL
-	}
-
 	extendedHeader := SelfExtendedInfo{
 		Paid:       paid,
-		Type:       programType,
+		Type:       uint64(pType),
 		AppVersion: appVersion,
 		FwVersion:  fwVersion,
 		Digest:     digest,
@@ -371,16 +440,31 @@ func writeSignature(file *os.File, signature []byte) int {
 }
 
 // writeSegments takes a given file and iterates the SelfEntries list to write segment data to the file using it's offset
-// value. Returns the number of bytes written.
-func writeSegments(file *os.File) int {
+// value. Segment data is streamed from the entry's source. Returns the number of bytes written, and an error if segment
+// data couldn't be copied.
+func writeSegments(file *os.File) (int, error) {
 	writtenBytes := 0
 
 	for _, entry := range _selfEntries {
-		writtenBytesEntry, _ := file.WriteAt(*entry.Data, int64(entry.Offset))
-		writtenBytes += writtenBytesEntry
+		if entry.Source == nil {
+			writtenBytesEntry, _ := file.WriteAt(*entry.Data, int64(entry.Offset))
+			writtenBytes += writtenBytesEntry
+			continue
+		}
+
+		if _, err := file.Seek(int64(entry.Offset), io.SeekStart); err != nil {
+			return writtenBytes, err
+		}
+
+		writtenBytesEntry, err := io.Copy(file, entry.Source)
+		writtenBytes += int(writtenBytesEntry)
+
+		if err != nil {
+			return writtenBytes, err
+		}
 	}
 
-	return writtenBytes
+	return writtenBytes, nil
 }
 
 // writeNullPadding is a utility function that writes null bytes to the given file to a given align. Returns the number
@@ -412,3 +496,13 @@ func setProperty(property uint64, bit uint64, mask uint64, val uint64) uint64 {
 	property |= (val & mask) << bit
 	return property
 }
+
+// getProperty takes a given property, bit shift, and mask, and returns the value stored there.
+func getProperty(property uint64, bit uint64, mask uint64) uint64 {
+	return (property >> bit) & mask
+}
+
+// hasProperty takes a given property and bit shift, and returns true if that single-bit flag is set.
+func hasProperty(property uint64, bit uint64) bool {
+	return getProperty(property, bit, 1) == 1
+}
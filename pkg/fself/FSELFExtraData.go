@@ -0,0 +1,177 @@
+package fself
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// SelfExtraData holds the non-loadable data of the orbis ELF that isn't covered by any segment entry, such as the
+// section header table, .symtab, .strtab, and debug info. It's carried by a single extra entry at the end of the entry
+// list. When the ELF is rebuilt from the fself, the extra data is placed at Offset, which is also the new section header
+// table offset.
+type SelfExtraData struct {
+	Offset      uint64
+	Data        []byte
+	ProgOffsets map[int]uint64
+}
+
+// createExtraData takes the orbis ELF and a reader for its data of the given size, and collects every section and non-loadable segment whose data
+// would otherwise be lost in the fself. The section header table goes first, followed by the data of each uncovered
+// section and segment. Offsets in the section headers (and program headers in ProgOffsets) are updated to point into
+// the extra data. Returns the extra data, or an error if the section header table couldn't be read.
+func createExtraData(inputElf *elf.File, inputFileData io.ReaderAt, inputFileSize int64) (*SelfExtraData, error) {
+	inputHdr := elf.Header64{}
+
+	if err := readStructFrom(inputFileData, 0, &inputHdr); err != nil {
+		return nil, err
+	}
+
+	if inputHdr.Shoff == 0 || inputHdr.Shnum == 0 {
+		return nil, errors.New("orbis elf has no section headers to keep")
+	}
+
+	if inputHdr.Shentsize != SELF_ELF_SECTIONHEADER_SIZE {
+		return nil, errors.New("orbis elf has an unexpected section header size")
+	}
+
+	sectionHeaders := make([]elf.Section64, inputHdr.Shnum)
+
+	if err := readStructFrom(inputFileData, int64(inputHdr.Shoff), sectionHeaders); err != nil {
+		return nil, errors.New("orbis elf section header table is truncated")
+	}
+
+	// The ELF header and program headers are carried by the self header, and segment data by the segment entries
+	headersEnd := uint64(inputHdr.Phoff) + uint64(len(inputElf.Progs)*SELF_ELF_PROGHEADER_SIZE)
+	imageEnd := headersEnd
+
+	for _, prog := range inputElf.Progs {
+		if prog.Off+prog.Filesz > imageEnd {
+			imageEnd = prog.Off + prog.Filesz
+		}
+	}
+
+	isCovered := func(offset uint64, size uint64) bool {
+		if size == 0 || offset+size <= headersEnd {
+			return true
+		}
+
+		for _, prog := range inputElf.Progs {
+			if !isSelfSegment(prog) {
+				continue
+			}
+
+			if offset >= prog.Off && offset+size <= prog.Off+prog.Filesz {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	extraData := SelfExtraData{
+		Offset:      align(imageEnd, 0x10),
+		ProgOffsets: make(map[int]uint64),
+	}
+
+	// Leave room for the section header table, the section headers are written once the offsets are known
+	extraData.Data = make([]byte, len(sectionHeaders)*SELF_ELF_SECTIONHEADER_SIZE)
+
+	type movedRange struct {
+		oldOffset uint64
+		newOffset uint64
+		size      uint64
+	}
+
+	var movedRanges []movedRange
+
+	appendData := func(offset uint64, size uint64, alignment uint64) (uint64, error) {
+		if offset+size > uint64(inputFileSize) {
+			return 0, errors.New("orbis elf section or segment data is truncated")
+		}
+
+		if alignment > 1 {
+			writePaddingBytes(&extraData.Data, uint64(len(extraData.Data)), alignment)
+		}
+
+		newOffset := extraData.Offset + uint64(len(extraData.Data))
+		dataStart := len(extraData.Data)
+		extraData.Data = append(extraData.Data, make([]byte, size)...)
+
+		if _, err := inputFileData.ReadAt(extraData.Data[dataStart:], int64(offset)); err != nil {
+			return 0, err
+		}
+		movedRanges = append(movedRanges, movedRange{offset, newOffset, size})
+
+		return newOffset, nil
+	}
+
+	for i := range sectionHeaders {
+		section := &sectionHeaders[i]
+
+		if elf.SectionType(section.Type) == elf.SHT_NULL || elf.SectionType(section.Type) == elf.SHT_NOBITS {
+			continue
+		}
+
+		if isCovered(section.Off, section.Size) {
+			continue
+		}
+
+		newOffset, err := appendData(section.Off, section.Size, section.Addralign)
+		if err != nil {
+			return nil, err
+		}
+
+		section.Off = newOffset
+	}
+
+	// Non-loadable segments that aren't covered either point into a moved section, or need their own copy
+	for i, prog := range inputElf.Progs {
+		if isSelfSegment(prog) || isCovered(prog.Off, prog.Filesz) {
+			continue
+		}
+
+		movedOffset := uint64(0)
+
+		for _, moved := range movedRanges {
+			if prog.Off >= moved.oldOffset && prog.Off+prog.Filesz <= moved.oldOffset+moved.size {
+				movedOffset = moved.newOffset + (prog.Off - moved.oldOffset)
+				break
+			}
+		}
+
+		if movedOffset == 0 {
+			newOffset, err := appendData(prog.Off, prog.Filesz, prog.Align)
+			if err != nil {
+				return nil, err
+			}
+
+			movedOffset = newOffset
+		}
+
+		extraData.ProgOffsets[i] = movedOffset
+	}
+
+	// Commit the section header table at the start of the extra data
+	sectionHeadersBuff := new(bytes.Buffer)
+
+	_ = binary.Write(sectionHeadersBuff, binary.LittleEndian, sectionHeaders)
+	copy(extraData.Data, sectionHeadersBuff.Bytes())
+
+	return &extraData, nil
+}
+
+// isSelfSegment returns true if the given program header gets a segment entry in the fself.
+func isSelfSegment(prog *elf.Prog) bool {
+	return prog.Type == elf.PT_LOAD || prog.Type == PT_SCE_RELRO || prog.Type == PT_SCE_DYNLIBDATA
+}
+
+// isExtraDataEntry returns true if the given entry properties belong to the extra data entry. The extra data entry is
+// neither signed nor has blocks, and its segment index is one past the last program header.
+func isExtraDataEntry(properties uint64, numProgs int) bool {
+	return !hasProperty(properties, SELF_ENTRY_PROPERTY_BIT_SIGNED) &&
+		!hasProperty(properties, SELF_ENTRY_PROPERTY_BIT_HASBLOCKS) &&
+		getProperty(properties, SELF_ENTRY_PROPERTY_BIT_SEGMENT_INDEX, 0xFFFF) == uint64(numProgs)
+}
@@ -0,0 +1,251 @@
+package fself
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// UnpackedFSELF contains the ELF embedded in an fself, as well as the meta-data parameters it was built with.
+type UnpackedFSELF struct {
+	ElfData        []byte
+	IsLib          bool
+	IsFixedAddress bool
+	Paid           int64
+	PType          ProgramType
+	AppVersion     int64
+	FwVersion      int64
+	AuthInfo       string
+	Digest         [0x20]byte
+
+	// HasSections is set if the fself kept its section headers in an extra data entry
+	HasSections bool
+}
+
+// UnpackFSELF takes a given fself path and rebuilds the ELF embedded in it from its ELF headers and segment data. If
+// the fself has an extra data entry, the section headers and non-loadable data are restored from it. Otherwise, the
+// section header fields of the rebuilt ELF are cleared. Returns the unpacked fself, or an error if the file isn't a
+// valid fself.
+func UnpackFSELF(fselfPath string) (*UnpackedFSELF, error) {
+	fselfData, err := ioutil.ReadFile(fselfPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return UnpackFSELFFromData(fselfData)
+}
+
+// UnpackFSELFFromData is the same as UnpackFSELF, but takes the fself as an in-memory buffer rather than a path.
+func UnpackFSELFFromData(fselfData []byte) (*UnpackedFSELF, error) {
+	fselfReader := bytes.NewReader(fselfData)
+
+	// Read the self header, the structure is packed to 0x1C bytes and padded to SELF_HEADER_SIZE
+	selfHeader := SelfHeader{}
+
+	if err := binary.Read(fselfReader, binary.LittleEndian, &selfHeader); err != nil {
+		return nil, errors.New("file is too small to be an fself")
+	}
+
+	if selfHeader.Magic != SELF_MAGIC_SELF {
+		return nil, fmt.Errorf("bad self magic 0x%X", selfHeader.Magic)
+	}
+
+	// Read the entries
+	entries := make([]SelfEntry, selfHeader.NumEntries)
+	entriesOffset := int64(SELF_HEADER_SIZE)
+
+	if err := readStructAt(fselfData, entriesOffset, entries); err != nil {
+		return nil, errors.New("self entry table is truncated")
+	}
+
+	// The ELF header and program headers follow the entries
+	elfHeaderOffset := entriesOffset + int64(len(entries)*SELF_META_DATA_BLOCK_SIZE)
+	elfHeader := elf.Header64{}
+
+	if err := readStructAt(fselfData, elfHeaderOffset, &elfHeader); err != nil {
+		return nil, errors.New("self elf header is truncated")
+	}
+
+	if !bytes.Equal(elfHeader.Ident[:4], []byte(elf.ELFMAG)) {
+		return nil, errors.New("self does not contain an elf header")
+	}
+
+	progHeaders := make([]elf.Prog64, elfHeader.Phnum)
+	progHeadersOffset := elfHeaderOffset + SELF_ELF_HEADER_SIZE
+
+	if err := readStructAt(fselfData, progHeadersOffset, progHeaders); err != nil {
+		return nil, errors.New("self program header table is truncated")
+	}
+
+	// The extended info is aligned to 0x10 after the program headers, and the signature follows the meta data
+	extendedInfoOffset := align(uint64(progHeadersOffset)+uint64(len(progHeaders)*SELF_ELF_PROGHEADER_SIZE), 0x10)
+	extendedInfo := SelfExtendedInfo{}
+
+	if err := readStructAt(fselfData, int64(extendedInfoOffset), &extendedInfo); err != nil {
+		return nil, errors.New("self extended info is truncated")
+	}
+
+	signatureOffset := int64(selfHeader.HeaderSize) + int64(len(entries)*SELF_ENTRY_SIZE) + SELF_META_FOOTER_SIZE
+	signature := make([]byte, SELF_SIGNATURE_SIZE)
+
+	if err := readStructAt(fselfData, signatureOffset, signature); err != nil {
+		return nil, errors.New("self signature is truncated")
+	}
+
+	// Rebuild the ELF image. Data entries map directly to the program header in their segment index, the extra data entry
+	// (if there is one) goes where the section header table is.
+	if elfHeader.Phoff > MAX_UNPACKED_ELF_SIZE {
+		return nil, fmt.Errorf("self program header offset 0x%X is out of range", elfHeader.Phoff)
+	}
+
+	elfSize := elfHeader.Phoff + uint64(len(progHeaders)*SELF_ELF_PROGHEADER_SIZE)
+
+	var extraEntry *SelfEntry
+
+	for i, entry := range entries {
+		if isExtraDataEntry(entry.Properties, len(progHeaders)) && elfHeader.Shoff != 0 {
+			if !isInBounds(entry.Offset, entry.FileSize, uint64(len(fselfData))) {
+				return nil, fmt.Errorf("self extra data entry at 0x%X is truncated", entry.Offset)
+			}
+
+			if elfHeader.Shoff > math.MaxUint64-entry.FileSize {
+				return nil, fmt.Errorf("self section header offset 0x%X is out of range", elfHeader.Shoff)
+			}
+
+			extraEntry = &entries[i]
+
+			if extraEnd := elfHeader.Shoff + entry.FileSize; extraEnd > elfSize {
+				elfSize = extraEnd
+			}
+
+			continue
+		}
+
+		if !hasProperty(entry.Properties, SELF_ENTRY_PROPERTY_BIT_HASBLOCKS) {
+			continue
+		}
+
+		if !isInBounds(entry.Offset, entry.FileSize, uint64(len(fselfData))) {
+			return nil, fmt.Errorf("self entry at 0x%X is truncated", entry.Offset)
+		}
+
+		segmentIndex := getProperty(entry.Properties, SELF_ENTRY_PROPERTY_BIT_SEGMENT_INDEX, 0xFFFF)
+
+		if segmentIndex >= uint64(len(progHeaders)) {
+			return nil, fmt.Errorf("self entry refers to non-existent segment %d", segmentIndex)
+		}
+
+		if progHeaders[segmentIndex].Off > math.MaxUint64-entry.FileSize {
+			return nil, fmt.Errorf("segment %d offset 0x%X is out of range", segmentIndex, progHeaders[segmentIndex].Off)
+		}
+
+		if segmentEnd := progHeaders[segmentIndex].Off + entry.FileSize; segmentEnd > elfSize {
+			elfSize = segmentEnd
+		}
+	}
+
+	if elfSize > MAX_UNPACKED_ELF_SIZE {
+		return nil, fmt.Errorf("self elf would be 0x%X bytes, at most 0x%X are supported", elfSize, MAX_UNPACKED_ELF_SIZE)
+	}
+
+	elfData := make([]byte, elfSize)
+
+	// Entries were bounds checked above
+	for _, entry := range entries {
+		if !hasProperty(entry.Properties, SELF_ENTRY_PROPERTY_BIT_HASBLOCKS) {
+			continue
+		}
+
+		segmentIndex := getProperty(entry.Properties, SELF_ENTRY_PROPERTY_BIT_SEGMENT_INDEX, 0xFFFF)
+		copy(elfData[progHeaders[segmentIndex].Off:], fselfData[entry.Offset:entry.Offset+entry.FileSize])
+	}
+
+	if extraEntry != nil {
+		copy(elfData[elfHeader.Shoff:], fselfData[extraEntry.Offset:extraEntry.Offset+extraEntry.FileSize])
+	} else {
+		// Section data isn't part of the fself, so don't point to section headers that no longer exist
+		elfHeader.Shoff = 0
+		elfHeader.Shnum = 0
+		elfHeader.Shstrndx = 0
+	}
+
+	headersBuff := new(bytes.Buffer)
+
+	_ = binary.Write(headersBuff, binary.LittleEndian, elfHeader)
+	copy(elfData[0:], headersBuff.Bytes())
+
+	headersBuff.Reset()
+
+	_ = binary.Write(headersBuff, binary.LittleEndian, progHeaders)
+	copy(elfData[elfHeader.Phoff:], headersBuff.Bytes())
+
+	return &UnpackedFSELF{
+		ElfData:        elfData,
+		IsLib:          elf.Type(elfHeader.Type) == ET_SCE_DYNAMIC,
+		IsFixedAddress: elf.Type(elfHeader.Type) == ET_SCE_EXEC,
+		Paid:           int64(extendedInfo.Paid),
+		PType:          ProgramType(extendedInfo.Type),
+		AppVersion:     int64(extendedInfo.AppVersion),
+		FwVersion:      int64(extendedInfo.FwVersion),
+		AuthInfo:       parseSignature(signature),
+		Digest:         extendedInfo.Digest,
+
+		HasSections: extraEntry != nil,
+	}, nil
+}
+
+// RewrapFSELF takes a given unpacked fself and builds a new fself from it at the given output path, using its meta-data
+// parameters. The rebuilt ELF doesn't have the original's non-loadable data, so hashing it would give a different
+// digest. The original digest is kept instead, so debug files and symbolication keyed by it still match. Returns the
+// digest, as well as error if an issue was encountered in creating the fself, nil otherwise.
+func RewrapFSELF(unpacked *UnpackedFSELF, outputPath string) ([0x20]byte, error) {
+	return createFSELF(unpacked.IsLib, bytes.NewReader(unpacked.ElfData), int64(len(unpacked.ElfData)), outputPath, unpacked.Paid, unpacked.PType, unpacked.AppVersion, unpacked.FwVersion, unpacked.AuthInfo, unpacked.HasSections, &unpacked.Digest)
+}
+
+// parseSignature takes a given signature created by createSignature and recovers the authinfo string from it. The
+// first 8 bytes of authinfo are replaced by the paid when signing, so they're recovered as zero. Returns an empty string
+// if the signature doesn't contain authinfo.
+func parseSignature(signature []byte) string {
+	authInfoSize := binary.LittleEndian.Uint64(signature[0x0:0x8])
+
+	if authInfoSize < SELF_AUTHINFO_PAID_SIZE || authInfoSize > SELF_AUTHINFO_MAX_SIZE {
+		return ""
+	}
+
+	authInfoBytes := make([]byte, SELF_AUTHINFO_PAID_SIZE, authInfoSize)
+	authInfoBytes = append(authInfoBytes, signature[0x10:0x10+authInfoSize-SELF_AUTHINFO_PAID_SIZE]...)
+
+	return hex.EncodeToString(authInfoBytes)
+}
+
+// isInBounds takes the given offset and size, and checks that the range they describe fits within limit, without
+// overflowing on malformed headers. Returns true if the range is in bounds.
+func isInBounds(offset uint64, size uint64, limit uint64) bool {
+	return size <= limit && offset <= limit-size
+}
+
+// readStructAt reads the given structure from data at the given offset. Returns an error if data is too short, nil
+// otherwise.
+func readStructAt(data []byte, offset int64, value interface{}) error {
+	if offset < 0 || offset > int64(len(data)) {
+		return errors.New("offset is out of range")
+	}
+
+	return binary.Read(bytes.NewReader(data[offset:]), binary.LittleEndian, value)
+}
+
+// readStructFrom is the same as readStructAt, but reads the structure from the given reader rather than an in-memory
+// buffer. Returns an error if the reader is too short, nil otherwise.
+func readStructFrom(reader io.ReaderAt, offset int64, value interface{}) error {
+	if offset < 0 {
+		return errors.New("offset is out of range")
+	}
+
+	return binary.Read(io.NewSectionReader(reader, offset, int64(binary.Size(value))), binary.LittleEndian, value)
+}
@@ -0,0 +1,216 @@
+package fself
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildTestOrbisELF builds an eboot-like ELF with a code segment at 0x0 (which holds the headers) and a data segment at
+// 0x4000, followed by a non-loadable .comment section, the section name table, and the section header table. Segment
+// data is filled with a pattern so misplaced data shows. Returns the ELF data.
+func buildTestOrbisELF() []byte {
+	progHeaders := []elf.Prog64{
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_X), Off: 0x0, Vaddr: 0x0, Filesz: 0x1000,
+			Memsz: 0x1000, Align: 0x4000},
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_W), Off: 0x4000, Vaddr: 0x4000, Filesz: 0x100,
+			Memsz: 0x200, Align: 0x4000},
+	}
+
+	elfData := make([]byte, 0x4100)
+
+	for i := range elfData {
+		elfData[i] = byte(i * 7)
+	}
+
+	// .comment and .shstrtab follow the data segment, then the section header table
+	comment := []byte("create-fself test\x00")
+	sectionNames := []byte("\x00.text\x00.comment\x00.shstrtab\x00")
+
+	commentOffset := uint64(len(elfData))
+	elfData = append(elfData, comment...)
+
+	sectionNamesOffset := uint64(len(elfData))
+	elfData = append(elfData, sectionNames...)
+
+	for len(elfData)%8 != 0 {
+		elfData = append(elfData, 0)
+	}
+
+	sectionHeadersOffset := uint64(len(elfData))
+
+	sectionHeaders := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Addr: 0x100,
+			Off: 0x100, Size: 0x100},
+		{Name: 7, Type: uint32(elf.SHT_PROGBITS), Off: commentOffset, Size: uint64(len(comment))},
+		{Name: 16, Type: uint32(elf.SHT_STRTAB), Off: sectionNamesOffset, Size: uint64(len(sectionNames))},
+	}
+
+	header := elf.Header64{
+		Ident:     [elf.EI_NIDENT]byte{0x7F, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), 1, 9},
+		Type:      ET_SCE_EXEC,
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   1,
+		Phoff:     0x40,
+		Shoff:     sectionHeadersOffset,
+		Ehsize:    0x40,
+		Phentsize: 0x38,
+		Phnum:     uint16(len(progHeaders)),
+		Shentsize: 0x40,
+		Shnum:     uint16(len(sectionHeaders)),
+		Shstrndx:  3,
+	}
+
+	headersBuff := new(bytes.Buffer)
+	_ = binary.Write(headersBuff, binary.LittleEndian, header)
+	_ = binary.Write(headersBuff, binary.LittleEndian, progHeaders)
+	copy(elfData, headersBuff.Bytes())
+
+	sectionHeadersBuff := new(bytes.Buffer)
+	_ = binary.Write(sectionHeadersBuff, binary.LittleEndian, sectionHeaders)
+
+	return append(elfData, sectionHeadersBuff.Bytes()...)
+}
+
+func TestUnpackFSELFRoundTrip(t *testing.T) {
+	const paid = 0x3800000000000011
+
+	elfData := buildTestOrbisELF()
+	inputElf, err := elf.NewFile(bytes.NewReader(elfData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keepSections := range []bool{false, true} {
+		fselfPath := filepath.Join(t.TempDir(), "eboot.bin")
+
+		digest, err := CreateFSELFFromData(false, elfData, fselfPath, paid, SELF_PTYPE_FAKE, 0x1000000, 0x4508101,
+			"", keepSections)
+		if err != nil {
+			t.Fatalf("keep sections %v: %s", keepSections, err.Error())
+		}
+
+		unpacked, err := UnpackFSELF(fselfPath)
+		if err != nil {
+			t.Fatalf("keep sections %v: %s", keepSections, err.Error())
+		}
+
+		if unpacked.IsLib || !unpacked.IsFixedAddress || unpacked.Paid != paid || unpacked.PType != SELF_PTYPE_FAKE ||
+			unpacked.AppVersion != 0x1000000 || unpacked.FwVersion != 0x4508101 || unpacked.AuthInfo != "" ||
+			unpacked.Digest != digest || unpacked.HasSections != keepSections {
+			t.Errorf("keep sections %v: unpacked meta-data is %+v", keepSections, *unpacked)
+		}
+
+		// Segment data is unpacked to where it was. The headers are rebuilt from the fself's copy, which points at the
+		// extra data entry's section headers if there is one, and at none otherwise.
+		headersSize := uint64(0x40 + len(inputElf.Progs)*0x38)
+
+		for _, prog := range inputElf.Progs {
+			start := prog.Off
+
+			if start < headersSize {
+				start = headersSize
+			}
+
+			if uint64(len(unpacked.ElfData)) < prog.Off+prog.Filesz ||
+				!bytes.Equal(unpacked.ElfData[start:prog.Off+prog.Filesz], elfData[start:prog.Off+prog.Filesz]) {
+				t.Errorf("keep sections %v: segment at 0x%X doesn't match the input", keepSections, prog.Off)
+			}
+		}
+
+		if !keepSections {
+			// Without the extra data entry, the ELF ends with the last segment, and nothing else is restored
+			wantElfData := make([]byte, 0x4100)
+
+			copy(wantElfData, elfData[:0x1000])
+			copy(wantElfData[0x4000:], elfData[0x4000:0x4100])
+
+			// e_shoff, e_shnum, and e_shstrndx
+			binary.LittleEndian.PutUint64(wantElfData[0x28:], 0)
+			binary.LittleEndian.PutUint16(wantElfData[0x3C:], 0)
+			binary.LittleEndian.PutUint16(wantElfData[0x3E:], 0)
+
+			if !bytes.Equal(unpacked.ElfData, wantElfData) {
+				t.Errorf("keep sections %v: unpacked elf doesn't match the input's headers and segments", keepSections)
+			}
+		}
+
+		// Section data only survives in the extra data entry
+		unpackedElf, err := elf.NewFile(bytes.NewReader(unpacked.ElfData))
+		if err != nil {
+			t.Fatalf("keep sections %v: unpacked elf doesn't parse: %s", keepSections, err.Error())
+		}
+
+		if comment := unpackedElf.Section(".comment"); keepSections {
+			if commentData, err := comment.Data(); comment == nil || err != nil ||
+				string(commentData) != "create-fself test\x00" {
+				t.Errorf("keep sections %v: .comment wasn't restored", keepSections)
+			}
+		} else if len(unpackedElf.Sections) != 0 {
+			t.Errorf("keep sections %v: unpacked elf has %d sections, want none", keepSections,
+				len(unpackedElf.Sections))
+		}
+
+		// Rewrapping and unpacking again gives back the same ELF and meta-data
+		rewrapPath := filepath.Join(t.TempDir(), "rewrap.bin")
+
+		if _, err := RewrapFSELF(unpacked, rewrapPath); err != nil {
+			t.Fatalf("keep sections %v: %s", keepSections, err.Error())
+		}
+
+		rewrapped, err := UnpackFSELF(rewrapPath)
+		if err != nil {
+			t.Fatalf("keep sections %v: %s", keepSections, err.Error())
+		}
+
+		if !reflect.DeepEqual(rewrapped, unpacked) {
+			t.Errorf("keep sections %v: rewrapped fself unpacks differently", keepSections)
+		}
+	}
+}
+
+func TestUnpackFSELFRejectsBadOffsets(t *testing.T) {
+	fselfPath := filepath.Join(t.TempDir(), "eboot.bin")
+
+	if _, err := CreateFSELFFromData(false, buildTestOrbisELF(), fselfPath, 0, SELF_PTYPE_FAKE, 0, 0, "",
+		false); err != nil {
+		t.Fatal(err)
+	}
+
+	fselfData, err := ioutil.ReadFile(fselfPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ELF header follows the entries, and the program headers follow the ELF header
+	numEntries := binary.LittleEndian.Uint16(fselfData[0x18:])
+	elfHeaderOffset := SELF_HEADER_SIZE + int(numEntries)*SELF_META_DATA_BLOCK_SIZE
+	dataSegmentOffset := elfHeaderOffset + SELF_ELF_HEADER_SIZE + SELF_ELF_PROGHEADER_SIZE + 0x8
+
+	tests := []struct {
+		name   string
+		offset int
+		value  uint64
+		err    string
+	}{
+		{"wrapping program header offset", elfHeaderOffset + 0x20, 0xFFFFFFFFFFFFFFF0, "program header offset"},
+		{"huge program header offset", elfHeaderOffset + 0x20, MAX_UNPACKED_ELF_SIZE + 1, "program header offset"},
+		{"wrapping segment offset", dataSegmentOffset, 0xFFFFFFFFFFFFFF00, "out of range"},
+		{"huge segment offset", dataSegmentOffset, 0x100000000000, "at most"},
+	}
+
+	for _, test := range tests {
+		badData := append([]byte(nil), fselfData...)
+		binary.LittleEndian.PutUint64(badData[test.offset:], test.value)
+
+		if _, err := UnpackFSELFFromData(badData); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one about %q", test.name, err, test.err)
+		}
+	}
+}
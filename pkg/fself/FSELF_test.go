@@ -0,0 +1,27 @@
+package fself
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateFSELFRejectsSegmentsPastTheEnd(t *testing.T) {
+	elfData := buildTestOrbisELF()
+
+	// Grow the data segment's p_filesz past the end of the ELF
+	dataSegmentHeader := 0x40 + 0x38
+	binary.LittleEndian.PutUint64(elfData[dataSegmentHeader+0x20:], uint64(len(elfData)))
+
+	fselfPath := filepath.Join(t.TempDir(), "eboot.bin")
+
+	if _, err := CreateFSELFFromData(false, elfData, fselfPath, 0, SELF_PTYPE_FAKE, 0, 0, "", false); err != io.ErrUnexpectedEOF {
+		t.Errorf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	if _, err := os.Stat(fselfPath); !os.IsNotExist(err) {
+		t.Errorf("a partial fself was left behind (stat error %v)", err)
+	}
+}
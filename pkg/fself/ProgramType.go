@@ -0,0 +1,142 @@
+package fself
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ProgramType is the SELF program type that gets written to the SelfExtendedInfo header.
+type ProgramType uint64
+
+// _programTypeNames maps the -ptype argument names to their program type, in the order they're listed to the user.
+var _programTypeNames = []struct {
+	name        string
+	programType ProgramType
+}{
+	{"fake", SELF_PTYPE_FAKE},
+	{"npdrm_exec", SELF_PTYPE_NPDRM_EXEC},
+	{"npdrm_dynlib", SELF_PTYPE_NPDRM_DYNLIB},
+	{"system_exec", SELF_PTYPE_SYSTEM_EXEC},
+	{"system_dynlib", SELF_PTYPE_SYSTEM_DYNLIB},
+	{"host_kernel", SELF_PTYPE_HOST_KERNEL},
+	{"secure_module", SELF_PTYPE_SECURE_MODULE},
+	{"secure_kernel", SELF_PTYPE_SECURE_KERNEL},
+}
+
+// ProgramTypeNames returns the list of accepted program type names, comma separated.
+func ProgramTypeNames() string {
+	names := make([]string, 0, len(_programTypeNames))
+
+	for _, entry := range _programTypeNames {
+		names = append(names, entry.name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// ParseProgramType takes a given program type name and returns the matching ProgramType. An empty name is treated as
+// "fake" for backwards compatibility. Returns an error if the name is unknown, nil otherwise.
+func ParseProgramType(name string) (ProgramType, error) {
+	if name == "" {
+		return SELF_PTYPE_FAKE, nil
+	}
+
+	for _, entry := range _programTypeNames {
+		if entry.name == name {
+			return entry.programType, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown program type '%s' (expected one of: %s)", name, ProgramTypeNames())
+}
+
+// String returns the -ptype name of the program type, or its hex value if it isn't a known type.
+func (programType ProgramType) String() string {
+	for _, entry := range _programTypeNames {
+		if entry.programType == programType {
+			return entry.name
+		}
+	}
+
+	return fmt.Sprintf("0x%X", uint64(programType))
+}
+
+// IsExec returns true if the program type is meant for executables (eboots).
+func (programType ProgramType) IsExec() bool {
+	return programType == SELF_PTYPE_NPDRM_EXEC || programType == SELF_PTYPE_SYSTEM_EXEC
+}
+
+// IsDynlib returns true if the program type is meant for dynamic libraries (sprx).
+func (programType ProgramType) IsDynlib() bool {
+	return programType == SELF_PTYPE_NPDRM_DYNLIB || programType == SELF_PTYPE_SYSTEM_DYNLIB || programType == SELF_PTYPE_SECURE_MODULE
+}
+
+// ValidateParameters cross-checks the given SELF meta-data parameters against each other and against the kind of
+// file being built. isFixedAddress is set for fixed-address (ET_SCE_EXEC) eboots. Callers that want to emit the FSELF
+// anyway (ie. -force) can treat the result as a warning. Returns an error describing every problem found, nil otherwise.
+func ValidateParameters(isLib bool, isFixedAddress bool, programType ProgramType, paid int64, authInfo string) error {
+	var problems []string
+
+	// Libraries are always loaded at a random base
+	if isLib && isFixedAddress {
+		problems = append(problems, "a library cannot be fixed-address")
+	}
+
+	// The program type must match the kind of file we're building. Fake SELFs are accepted for both.
+	if programType != SELF_PTYPE_FAKE {
+		if isLib && !programType.IsDynlib() {
+			problems = append(problems, fmt.Sprintf("program type '%s' cannot be used for a library, use a dynlib type", programType))
+		}
+
+		if !isLib && !programType.IsExec() {
+			problems = append(problems, fmt.Sprintf("program type '%s' cannot be used for an eboot, use an exec type", programType))
+		}
+
+		// Store applications must be ASLR (ET_SCE_EXEC_ASLR), only system executables are loaded at a fixed address
+		if !isLib && isFixedAddress && programType.IsExec() && programType != SELF_PTYPE_SYSTEM_EXEC {
+			problems = append(problems, fmt.Sprintf("program type '%s' cannot be used for a fixed-address eboot, use system_exec", programType))
+		}
+	}
+
+	// All known PS4 program authentication IDs live in the 0x3XXXXXXXXXXXXXXX range
+	if uint64(paid) < SELF_PAID_MIN || uint64(paid) > SELF_PAID_MAX {
+		problems = append(problems, fmt.Sprintf("paid 0x%X is outside of the valid range (0x%X - 0x%X)", uint64(paid), uint64(SELF_PAID_MIN), uint64(SELF_PAID_MAX)))
+	}
+
+	if authInfo != "" {
+		if err := validateAuthInfo(authInfo, paid); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// validateAuthInfo checks that the given authinfo string is valid hex, fits into the signature, and that the PAID
+// embedded in its first 8 bytes agrees with the given paid. Returns an error if a check fails, nil otherwise.
+func validateAuthInfo(authInfo string, paid int64) error {
+	authInfoBytes, err := hex.DecodeString(authInfo)
+	if err != nil {
+		return fmt.Errorf("authinfo is not a valid hex string (%s)", err.Error())
+	}
+
+	if len(authInfoBytes) < SELF_AUTHINFO_PAID_SIZE || len(authInfoBytes) > SELF_AUTHINFO_MAX_SIZE {
+		return fmt.Errorf("authinfo must be between 0x%X and 0x%X bytes, got 0x%X", SELF_AUTHINFO_PAID_SIZE, SELF_AUTHINFO_MAX_SIZE, len(authInfoBytes))
+	}
+
+	// A zero PAID in the authinfo means it's not bound to a specific program
+	authInfoPaid := binary.LittleEndian.Uint64(authInfoBytes[:SELF_AUTHINFO_PAID_SIZE])
+
+	if authInfoPaid != 0 && authInfoPaid != uint64(paid) {
+		return fmt.Errorf("authinfo is for paid 0x%X, but paid is 0x%X", authInfoPaid, uint64(paid))
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package fself
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProgramType(t *testing.T) {
+	tests := []struct {
+		name        string
+		programType ProgramType
+		isError     bool
+	}{
+		{"", SELF_PTYPE_FAKE, false},
+		{"fake", SELF_PTYPE_FAKE, false},
+		{"npdrm_exec", SELF_PTYPE_NPDRM_EXEC, false},
+		{"npdrm_dynlib", SELF_PTYPE_NPDRM_DYNLIB, false},
+		{"system_exec", SELF_PTYPE_SYSTEM_EXEC, false},
+		{"system_dynlib", SELF_PTYPE_SYSTEM_DYNLIB, false},
+		{"host_kernel", SELF_PTYPE_HOST_KERNEL, false},
+		{"secure_module", SELF_PTYPE_SECURE_MODULE, false},
+		{"secure_kernel", SELF_PTYPE_SECURE_KERNEL, false},
+		{"npdrm_exe", 0, true},
+		{"NPDRM_EXEC", 0, true},
+		{" fake", 0, true},
+	}
+
+	for _, test := range tests {
+		programType, err := ParseProgramType(test.name)
+
+		if (err != nil) != test.isError {
+			t.Errorf("ParseProgramType(%q): got error %v, want error %v", test.name, err, test.isError)
+			continue
+		}
+
+		if programType != test.programType {
+			t.Errorf("ParseProgramType(%q) = %s, want %s", test.name, programType, test.programType)
+		}
+
+		// Every known type has to round trip through its name
+		if !test.isError && test.name != "" && programType.String() != test.name {
+			t.Errorf("ProgramType(%d).String() = %q, want %q", programType, programType.String(), test.name)
+		}
+	}
+}
+
+func TestValidateParameters(t *testing.T) {
+	const paid = 0x3800000000000011
+
+	tests := []struct {
+		description    string
+		isLib          bool
+		isFixedAddress bool
+		programType    ProgramType
+		paid           int64
+		authInfo       string
+		problem        string
+	}{
+		{"fake eboot", false, false, SELF_PTYPE_FAKE, paid, "", ""},
+		{"fake library", true, false, SELF_PTYPE_FAKE, paid, "", ""},
+		{"exec eboot", false, false, SELF_PTYPE_NPDRM_EXEC, paid, "", ""},
+		{"dynlib library", true, false, SELF_PTYPE_SYSTEM_DYNLIB, paid, "", ""},
+		{"secure module library", true, false, SELF_PTYPE_SECURE_MODULE, paid, "", ""},
+		{"dynlib eboot", false, false, SELF_PTYPE_NPDRM_DYNLIB, paid, "", "cannot be used for an eboot"},
+		{"exec library", true, false, SELF_PTYPE_SYSTEM_EXEC, paid, "", "cannot be used for a library"},
+		{"kernel eboot", false, false, SELF_PTYPE_HOST_KERNEL, paid, "", "cannot be used for an eboot"},
+		{"fixed-address fake eboot", false, true, SELF_PTYPE_FAKE, paid, "", ""},
+		{"fixed-address system eboot", false, true, SELF_PTYPE_SYSTEM_EXEC, paid, "", ""},
+		{"fixed-address npdrm eboot", false, true, SELF_PTYPE_NPDRM_EXEC, paid, "", "cannot be used for a fixed-address eboot"},
+		{"fixed-address library", true, true, SELF_PTYPE_FAKE, paid, "", "a library cannot be fixed-address"},
+		{"lowest paid", false, false, SELF_PTYPE_FAKE, SELF_PAID_MIN, "", ""},
+		{"highest paid", false, false, SELF_PTYPE_FAKE, SELF_PAID_MAX, "", ""},
+		{"paid below range", false, false, SELF_PTYPE_FAKE, SELF_PAID_MIN - 1, "", "outside of the valid range"},
+		{"paid above range", false, false, SELF_PTYPE_FAKE, SELF_PAID_MAX + 1, "", "outside of the valid range"},
+		{"negative paid", false, false, SELF_PTYPE_FAKE, -1, "", "outside of the valid range"},
+		{"authinfo for paid", false, false, SELF_PTYPE_FAKE, paid, "1100000000000038", ""},
+		{"authinfo without paid", false, false, SELF_PTYPE_FAKE, paid, "0000000000000000" + strings.Repeat("00", 8), ""},
+		{"authinfo for other paid", false, false, SELF_PTYPE_FAKE, paid, "1200000000000038", "authinfo is for paid"},
+		{"authinfo not hex", false, false, SELF_PTYPE_FAKE, paid, "zz00000000000038", "not a valid hex string"},
+		{"authinfo too short", false, false, SELF_PTYPE_FAKE, paid, "11000000000000", "authinfo must be between"},
+		{"longest authinfo", false, false, SELF_PTYPE_FAKE, paid, "1100000000000038" + strings.Repeat("00", SELF_AUTHINFO_MAX_SIZE-SELF_AUTHINFO_PAID_SIZE), ""},
+		{"authinfo too long", false, false, SELF_PTYPE_FAKE, paid, "1100000000000038" + strings.Repeat("00", SELF_AUTHINFO_MAX_SIZE-SELF_AUTHINFO_PAID_SIZE+1), "authinfo must be between"},
+	}
+
+	for _, test := range tests {
+		err := ValidateParameters(test.isLib, test.isFixedAddress, test.programType, test.paid, test.authInfo)
+
+		if test.problem == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.description, err.Error())
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: got error %v, want an error containing %q", test.description, err, test.problem)
+		}
+	}
+}
+
+func TestValidateParametersReportsEveryProblem(t *testing.T) {
+	err := ValidateParameters(true, true, SELF_PTYPE_NPDRM_EXEC, 0, "")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, problem := range []string{"cannot be fixed-address", "cannot be used for a library", "outside of the valid range"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %q doesn't mention %q", err.Error(), problem)
+		}
+	}
+}
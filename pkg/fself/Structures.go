@@ -1,5 +1,7 @@
 package fself
 
+import "io"
+
 // SelfHeader is the SELF file header structure.
 type SelfHeader struct {
 	Magic      uint32
@@ -23,13 +25,15 @@ type SelfEntry struct {
 	MemorySize uint64
 }
 
-// SelfEntryInfo is similar to SelfEntry, however it contains a Data field to keep track of segment data.
+// SelfEntryInfo is similar to SelfEntry, however it contains a Data field to keep track of entry data. Segment data is
+// streamed from Source instead, so it's never held in memory.
 type SelfEntryInfo struct {
 	Properties uint64
 	Offset     uint64
 	FileSize   uint64
 	MemorySize uint64
 	Data       *[]byte
+	Source     *io.SectionReader
 }
 
 // SelfNpdrmControlBlock contains the structure for the NPDRM control blow, which includes the type and content ID
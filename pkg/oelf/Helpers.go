@@ -1,9 +1,12 @@
 package oelf
 
 import (
+	"bytes"
 	"debug/elf"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 )
 
 // getFileOffsetBySectionName searches the section header table of the input ELF with the given name and
@@ -19,51 +22,164 @@ func (orbisElf *OrbisElf) getFileOffsetBySectionName(name string) (int64, error)
 	return 0, errors.New("tried to access a non-existent section")
 }
 
-// getDynamicTag searches the dynamic table of the input ELF with the given tag and returns that tag's value as
-// well as error. If the tag does not exist, or if the dynamic table cannot be found, a value of 0 and an error is returned.
-// The value and nil are returned otherwise.
-func (orbisElf *OrbisElf) getDynamicTag(tag elf.DynTag) (uint64, error) {
-	// Get the dynamic table data
-	dynamicTableSegment := orbisElf.ElfToConvert.SectionByType(elf.SHT_DYNAMIC)
+// getDynamicTable returns the entries of the input ELF's dynamic table. The dynamic table is found through PT_DYNAMIC if
+// the input has no section headers (ie. it's been stripped). Returns the entries (none if there's no dynamic table), or
+// an error if the table can't be read.
+func (orbisElf *OrbisElf) getDynamicTable() ([]elf.Dyn64, error) {
+	var dynamicTableData []byte
+	var err error
 
-	if dynamicTableSegment == nil {
-		return 0, nil
+	// Get the dynamic table data
+	if dynamicTableSegment := orbisElf.ElfToConvert.SectionByType(elf.SHT_DYNAMIC); dynamicTableSegment != nil {
+		dynamicTableData, err = dynamicTableSegment.Data()
+	} else {
+		for _, progHeader := range orbisElf.ElfToConvert.Progs {
+			if progHeader.Type == elf.PT_DYNAMIC {
+				dynamicTableData, err = orbisElf.readInputData(progHeader.Vaddr, progHeader.Filesz)
+				break
+			}
+		}
 	}
 
-	dynamicTableData, err := dynamicTableSegment.Data()
-
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
+	var entries []elf.Dyn64
+
 	// We'll move dynamicTableData as a pointer each time we read an entry - thus this loop will terminate when we run
 	// out of data
-	for len(dynamicTableData) > 0 {
-		t := elf.DynTag(orbisElf.ElfToConvert.ByteOrder.Uint64(dynamicTableData[0x0:0x8]))
-		v := orbisElf.ElfToConvert.ByteOrder.Uint64(dynamicTableData[0x8:0x10])
+	for len(dynamicTableData) >= 0x10 {
+		entries = append(entries, elf.Dyn64{
+			Tag: int64(orbisElf.ElfToConvert.ByteOrder.Uint64(dynamicTableData[0x0:0x8])),
+			Val: orbisElf.ElfToConvert.ByteOrder.Uint64(dynamicTableData[0x8:0x10]),
+		})
 
 		dynamicTableData = dynamicTableData[0x10:]
+	}
+
+	return entries, nil
+}
 
-		if t == tag {
-			return v, nil
+// getDynamicTag searches the dynamic table of the input ELF with the given tag and returns that tag's value as
+// well as error. The dynamic table is found through PT_DYNAMIC if the input has no section headers (ie. it's been
+// stripped). If the tag does not exist, a value of 0 and nil are returned. If the dynamic table cannot be read, a value
+// of 0 and an error is returned. The value and nil are returned otherwise.
+func (orbisElf *OrbisElf) getDynamicTag(tag elf.DynTag) (uint64, error) {
+	entries, err := orbisElf.getDynamicTable()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		if elf.DynTag(entry.Tag) == tag {
+			return entry.Val, nil
 		}
 	}
 
 	return 0, nil
 }
 
+// getImportedLibraries returns the libraries the input ELF needs (DT_NEEDED), like ElfToConvert.ImportedLibraries. If the
+// input has no section headers, their names are read through DT_STRTAB instead. Returns the library names, or an error
+// if they can't be read.
+func (orbisElf *OrbisElf) getImportedLibraries() ([]string, error) {
+	if orbisElf.ElfToConvert.SectionByType(elf.SHT_DYNAMIC) != nil {
+		return orbisElf.ElfToConvert.ImportedLibraries()
+	}
+
+	entries, err := orbisElf.getDynamicTable()
+	if err != nil {
+		return nil, err
+	}
+
+	stringTableAddr, err := orbisElf.getDynamicTag(elf.DT_STRTAB)
+	if err != nil {
+		return nil, err
+	}
+
+	stringTableSize, err := orbisElf.getDynamicTag(elf.DT_STRSZ)
+	if err != nil {
+		return nil, err
+	}
+
+	var libraries []string
+	var stringTableData []byte
+
+	for _, entry := range entries {
+		if elf.DynTag(entry.Tag) != elf.DT_NEEDED {
+			continue
+		}
+
+		if stringTableData == nil {
+			if stringTableData, err = orbisElf.readInputData(stringTableAddr, stringTableSize); err != nil {
+				return nil, err
+			}
+		}
+
+		if entry.Val >= uint64(len(stringTableData)) {
+			return nil, fmt.Errorf("DT_NEEDED has an invalid name offset 0x%X", entry.Val)
+		}
+
+		name := stringTableData[entry.Val:]
+
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+
+		libraries = append(libraries, string(name))
+	}
+
+	return libraries, nil
+}
+
+// getRawSectionHeaders reads the section header table of the input ELF from the given file using the given ELF
+// header. Unlike ElfToConvert.Sections, this keeps the raw name offsets. Returns the section headers, or an error if the
+// table couldn't be read.
+func (orbisElf *OrbisElf) getRawSectionHeaders(inputFile io.ReaderAt, inputHdr *elf.Header64) ([]elf.Section64, error) {
+	if inputHdr.Shentsize != 0x40 {
+		return nil, errors.New("unexpected section header size")
+	}
+
+	sectionHeaders := make([]elf.Section64, inputHdr.Shnum)
+	sectionHeadersReader := io.NewSectionReader(inputFile, int64(inputHdr.Shoff), int64(inputHdr.Shnum)*0x40)
+
+	if err := binary.Read(sectionHeadersReader, orbisElf.ElfToConvert.ByteOrder, sectionHeaders); err != nil {
+		return nil, err
+	}
+
+	return sectionHeaders, nil
+}
+
+// getSymbols returns the symbols of the input ELF, like ElfToConvert.Symbols. If the input has no .symtab (ie. it's
+// been stripped), its dynamic symbols are returned instead, see getDynamicSymbols. Returns the symbols, or an error if
+// they can't be read.
+func (orbisElf *OrbisElf) getSymbols() ([]elf.Symbol, error) {
+	symbols, err := orbisElf.ElfToConvert.Symbols()
+	if err != elf.ErrNoSymbols {
+		return symbols, err
+	}
+
+	return orbisElf.getDynamicSymbols()
+}
+
 // getSymbol searches the symbol table of the input ELF with the given name and returns the corresponding elf.Symbol
-// object. If the symbol does not exist, an empty elf.Symbol object is returned.
+// object. The symbol table is indexed by name on the first call. If the symbol does not exist, an empty elf.Symbol
+// object is returned.
 func (orbisElf *OrbisElf) getSymbol(name string) elf.Symbol {
-	symbols, _ := orbisElf.ElfToConvert.Symbols()
-
-	for _, symbol := range symbols {
-		if symbol.Name == name {
-			return symbol
+	if orbisElf.symbolIndex == nil {
+		symbols, _ := orbisElf.getSymbols()
+		orbisElf.symbolIndex = make(map[string]elf.Symbol, len(symbols))
+
+		// Keep the first symbol with each name, which is the one a linear search would find
+		for _, symbol := range symbols {
+			if _, ok := orbisElf.symbolIndex[symbol.Name]; !ok {
+				orbisElf.symbolIndex[symbol.Name] = symbol
+			}
 		}
 	}
 
-	return elf.Symbol{}
+	return orbisElf.symbolIndex[name]
 }
 
 // getProgramHeader searches the program header table of the input ELF with the given type and flags, and returns
@@ -78,19 +194,137 @@ func (orbisElf *OrbisElf) getProgramHeader(headerType elf.ProgType, headerFlags
 	return nil
 }
 
-// checkIfLibraryContainsSymbol takes a given library and symbol name, and checks if the library contains that symbol. It
-// returns a boolean of whether that library contains that symbol, as well as error. If we cannot get a libraries
-// symbol list, false and an error is returned. Otherwise, the true or false and nil are returned.
-func checkIfLibraryContainsSymbol(librarySymbols []elf.Symbol, symbolName string) bool {
-	for _, symbol := range librarySymbols {
-		if symbol.Name == symbolName {
-			return true
+// readInputData takes the given address and size, and reads the input ELF's file data there. Returns the data, or an
+// error if the range isn't backed by file data of a single PT_LOAD segment.
+func (orbisElf *OrbisElf) readInputData(address uint64, size uint64) ([]byte, error) {
+	for _, progHeader := range orbisElf.ElfToConvert.Progs {
+		if progHeader.Type != elf.PT_LOAD || address < progHeader.Vaddr || address+size > progHeader.Vaddr+progHeader.Filesz {
+			continue
+		}
+
+		data := make([]byte, size)
+
+		if _, err := progHeader.ReadAt(data, int64(address-progHeader.Vaddr)); err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("0x%X-0x%X isn't mapped by any PT_LOAD segment", address, address+size)
+}
+
+// getDynamicSymbols returns the dynamic symbols of the input ELF, like ElfToConvert.DynamicSymbols. If the input has no
+// .dynsym (ie. its section headers have been stripped), the symbols are read through DT_SYMTAB and DT_STRTAB instead,
+// with the symbol count taken from DT_HASH, or from the string table if it directly follows the symbol table. Returns
+// the symbols (nil if there are none, ie. for a static executable), or an error if they can't be read.
+func (orbisElf *OrbisElf) getDynamicSymbols() ([]elf.Symbol, error) {
+	symbols, err := orbisElf.ElfToConvert.DynamicSymbols()
+	if err != elf.ErrNoSymbols {
+		return symbols, err
+	}
+
+	var tags [4]uint64
+
+	for i, tag := range []elf.DynTag{elf.DT_SYMTAB, elf.DT_STRTAB, elf.DT_STRSZ, elf.DT_HASH} {
+		if tags[i], err = orbisElf.getDynamicTag(tag); err != nil {
+			return nil, err
+		}
+	}
+
+	symbolTableAddr, stringTableAddr, stringTableSize, hashTableAddr := tags[0], tags[1], tags[2], tags[3]
+
+	if symbolTableAddr == 0 {
+		return nil, nil
+	}
+
+	// The second word of the hash table is nchain, which is the number of symbols
+	var symbolCount uint64
+
+	if hashTableAddr != 0 {
+		hashTableHeader, err := orbisElf.readInputData(hashTableAddr, 0x8)
+		if err != nil {
+			return nil, err
+		}
+
+		symbolCount = uint64(orbisElf.ElfToConvert.ByteOrder.Uint32(hashTableHeader[0x4:0x8]))
+	} else if stringTableAddr > symbolTableAddr {
+		symbolCount = (stringTableAddr - symbolTableAddr) / 0x18
+	} else {
+		return nil, errors.New("couldn't find the size of the dynamic symbol table (no DT_HASH)")
+	}
+
+	symbolTableData, err := orbisElf.readInputData(symbolTableAddr, symbolCount*0x18)
+	if err != nil {
+		return nil, err
+	}
+
+	stringTableData, err := orbisElf.readInputData(stringTableAddr, stringTableSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like debug/elf, the null symbol is left out
+	for i := uint64(0x18); i+0x18 <= uint64(len(symbolTableData)); i += 0x18 {
+		var symbol elf.Sym64
+
+		_ = binary.Read(bytes.NewReader(symbolTableData[i:i+0x18]), orbisElf.ElfToConvert.ByteOrder, &symbol)
+
+		if uint64(symbol.Name) >= uint64(len(stringTableData)) {
+			return nil, fmt.Errorf("dynamic symbol %d has an invalid name offset 0x%X", i/0x18, symbol.Name)
+		}
+
+		name := stringTableData[symbol.Name:]
+
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+
+		symbols = append(symbols, elf.Symbol{
+			Name:    string(name),
+			Info:    symbol.Info,
+			Other:   symbol.Other,
+			Section: elf.SectionIndex(symbol.Shndx),
+			Value:   symbol.Value,
+			Size:    symbol.Size,
+		})
+	}
+
+	return symbols, nil
+}
+
+// applyRelocationInPlace takes the given address and value, and writes the value to the output file where the input
+// ELF maps the address. Returns true if the value was written, false if the address isn't backed by file data.
+func (orbisElf *OrbisElf) applyRelocationInPlace(address uint64, value uint64) bool {
+	for _, progHeader := range orbisElf.ElfToConvert.Progs {
+		if progHeader.Type != elf.PT_LOAD || address < progHeader.Vaddr || address+8 > progHeader.Vaddr+progHeader.Filesz {
+			continue
 		}
+
+		valueBytes := make([]byte, 8)
+		binary.LittleEndian.PutUint64(valueBytes, value)
+
+		_, err := orbisElf.output.WriteAt(valueBytes, int64(progHeader.Off+(address-progHeader.Vaddr)))
+		return err == nil
 	}
 
 	return false
 }
 
+// indexLibrarySymbols takes a given library symbol list and indexes the symbols the library defines by name. If a name
+// is defined more than once, the first definition is kept. Returns the index.
+func indexLibrarySymbols(librarySymbols []elf.Symbol) map[string]elf.Symbol {
+	symbolIndex := make(map[string]elf.Symbol, len(librarySymbols))
+
+	for _, symbol := range librarySymbols {
+		if _, ok := symbolIndex[symbol.Name]; !ok && symbol.Section != elf.SHN_UNDEF {
+			symbolIndex[symbol.Name] = symbol
+		}
+	}
+
+	return symbolIndex
+}
+
 // intToByteArray takes a given integer and writes it into a byte array (little endian) and returns it.
 func intToByteArray(value int) []byte {
 	valueBuff := make([]byte, 4)
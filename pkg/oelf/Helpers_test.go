@@ -0,0 +1,213 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+)
+
+// testSection describes a section of an ELF built by buildTestELF. Sections with an Offset of 0 are placed after the
+// last section that has one. Size overrides the size of Data if it's set (ie. for NOBITS sections).
+type testSection struct {
+	Name      string
+	Type      elf.SectionType
+	Flags     elf.SectionFlag
+	Addr      uint64
+	Offset    uint64
+	Data      []byte
+	Size      uint64
+	Link      uint32
+	Info      uint32
+	Addralign uint64
+	Entsize   uint64
+}
+
+// buildTestELF takes the given ELF type, program headers, and sections, and builds a little endian x86-64 ELF from
+// them. A null section is added first and .shstrtab last, so section i of the list is section i+1 of the ELF. Returns
+// the ELF data.
+func buildTestELF(elfType elf.Type, progHeaders []elf.Prog64, sections []testSection) []byte {
+	headersSize := uint64(0x40 + len(progHeaders)*0x38)
+	fileData := make([]byte, headersSize)
+
+	writeAt := func(offset uint64, data []byte) {
+		if end := offset + uint64(len(data)); end > uint64(len(fileData)) {
+			fileData = append(fileData, make([]byte, end-uint64(len(fileData)))...)
+		}
+
+		copy(fileData[offset:], data)
+	}
+
+	for _, section := range sections {
+		if section.Offset != 0 && section.Type != elf.SHT_NOBITS {
+			writeAt(section.Offset, section.Data)
+		}
+	}
+
+	// Program headers can map memory past the last section
+	for _, progHeader := range progHeaders {
+		if progHeader.Type == uint32(elf.PT_LOAD) && progHeader.Off+progHeader.Filesz > uint64(len(fileData)) {
+			writeAt(progHeader.Off+progHeader.Filesz, nil)
+		}
+	}
+
+	sectionNames := []byte{0}
+	sectionHeaders := []elf.Section64{{}}
+
+	for _, section := range append(sections, testSection{Name: ".shstrtab", Type: elf.SHT_STRTAB}) {
+		sectionHeader := elf.Section64{
+			Name:      uint32(len(sectionNames)),
+			Type:      uint32(section.Type),
+			Flags:     uint64(section.Flags),
+			Addr:      section.Addr,
+			Off:       section.Offset,
+			Size:      uint64(len(section.Data)),
+			Link:      section.Link,
+			Info:      section.Info,
+			Addralign: section.Addralign,
+			Entsize:   section.Entsize,
+		}
+
+		sectionNames = append(sectionNames, append([]byte(section.Name), 0)...)
+
+		if section.Size != 0 {
+			sectionHeader.Size = section.Size
+		}
+
+		sectionHeaders = append(sectionHeaders, sectionHeader)
+	}
+
+	// Place the sections without an offset, then .shstrtab, then the section header table
+	for i := range sectionHeaders[1:] {
+		sectionHeader := &sectionHeaders[i+1]
+
+		if sectionHeader.Off != 0 || elf.SectionType(sectionHeader.Type) == elf.SHT_NOBITS {
+			continue
+		}
+
+		data := sectionNames
+
+		if i < len(sections) {
+			data = sections[i].Data
+		} else {
+			// .shstrtab is only complete once every section is named
+			sectionHeader.Size = uint64(len(sectionNames))
+		}
+
+		sectionHeader.Off = align(uint64(len(fileData)), 0x8)
+		writeAt(sectionHeader.Off, data)
+	}
+
+	sectionHeadersOffset := align(uint64(len(fileData)), 0x8)
+	sectionHeadersBuff := new(bytes.Buffer)
+	_ = binary.Write(sectionHeadersBuff, binary.LittleEndian, sectionHeaders)
+	writeAt(sectionHeadersOffset, sectionHeadersBuff.Bytes())
+
+	elfHeader := elf.Header64{
+		Type:      uint16(elfType),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     0x40,
+		Shoff:     sectionHeadersOffset,
+		Ehsize:    0x40,
+		Phentsize: 0x38,
+		Phnum:     uint16(len(progHeaders)),
+		Shentsize: 0x40,
+		Shnum:     uint16(len(sectionHeaders)),
+		Shstrndx:  uint16(len(sectionHeaders) - 1),
+	}
+
+	copy(elfHeader.Ident[:], elf.ELFMAG)
+	elfHeader.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	elfHeader.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	elfHeader.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	headersBuff := new(bytes.Buffer)
+	_ = binary.Write(headersBuff, binary.LittleEndian, elfHeader)
+	_ = binary.Write(headersBuff, binary.LittleEndian, progHeaders)
+	writeAt(0, headersBuff.Bytes())
+
+	return fileData
+}
+
+// parseTestELF parses the given ELF data built by buildTestELF, and fails the test if it isn't a valid ELF. Returns the
+// parsed ELF.
+func parseTestELF(t testing.TB, elfData []byte) *elf.File {
+	t.Helper()
+
+	elfFile, err := elf.NewFile(bytes.NewReader(elfData))
+	if err != nil {
+		t.Fatalf("test elf doesn't parse: %s", err.Error())
+	}
+
+	return elfFile
+}
+
+// encodeRelocations takes the given relocations and encodes them as the contents of an SHT_RELA section. Returns the
+// section data.
+func encodeRelocations(relocations []elf.Rela64) []byte {
+	relocationsBuff := new(bytes.Buffer)
+	_ = binary.Write(relocationsBuff, binary.LittleEndian, relocations)
+
+	return relocationsBuff.Bytes()
+}
+
+// newRelocation takes the given offset, symbol index, type, and addend, and returns them as a relocation entry.
+func newRelocation(offset uint64, symbolIndex uint32, rType elf.R_X86_64, addend int64) elf.Rela64 {
+	return elf.Rela64{
+		Off:    offset,
+		Info:   elf.R_INFO(symbolIndex, uint32(rType)),
+		Addend: addend,
+	}
+}
+
+// encodeDynamicTable takes the given dynamic table entries and encodes them as the contents of an SHT_DYNAMIC section,
+// followed by DT_NULL. Returns the section data.
+func encodeDynamicTable(entries []elf.Dyn64) []byte {
+	dynamicTableBuff := new(bytes.Buffer)
+	_ = binary.Write(dynamicTableBuff, binary.LittleEndian, append(entries, elf.Dyn64{Tag: int64(elf.DT_NULL)}))
+
+	return dynamicTableBuff.Bytes()
+}
+
+// encodeStringTable takes the given strings and encodes them as the contents of an SHT_STRTAB section, after the empty
+// string. Returns the section data and the offset of each string.
+func encodeStringTable(names []string) ([]byte, []uint32) {
+	stringTable := []byte{0}
+	offsets := make([]uint32, len(names))
+
+	for i, name := range names {
+		offsets[i] = uint32(len(stringTable))
+		stringTable = append(append(stringTable, name...), 0)
+	}
+
+	return stringTable, offsets
+}
+
+// encodeSymbols takes the given symbols and encodes them as the contents of an SHT_DYNSYM section, after the null
+// symbol. Returns the section data.
+func encodeSymbols(symbols []elf.Sym64) []byte {
+	symbolsBuff := new(bytes.Buffer)
+	_ = binary.Write(symbolsBuff, binary.LittleEndian, append([]elf.Sym64{{}}, symbols...))
+
+	return symbolsBuff.Bytes()
+}
+
+// stripTestSectionHeaders clears the section header fields of the ELF header of the given ELF data, so everything has to
+// be found through the program headers and the dynamic table.
+func stripTestSectionHeaders(elfData []byte) {
+	// e_shoff, e_shnum, and e_shstrndx
+	putUint64(elfData, 0x28, 0)
+	binary.LittleEndian.PutUint16(elfData[0x3C:], 0)
+	binary.LittleEndian.PutUint16(elfData[0x3E:], 0)
+}
+
+// putUint32 writes the given 32-bit value to data at the given offset.
+func putUint32(data []byte, offset uint64, value uint32) {
+	binary.LittleEndian.PutUint32(data[offset:], value)
+}
+
+// putUint64 writes the given 64-bit value to data at the given offset.
+func putUint64(data []byte, offset uint64, value uint64) {
+	binary.LittleEndian.PutUint64(data[offset:], value)
+}
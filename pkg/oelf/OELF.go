@@ -4,7 +4,8 @@ import (
 	"debug/elf"
 	"encoding/binary"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"os"
 )
 
@@ -16,6 +17,11 @@ type OrbisElf struct {
 
 	LibraryName            string
 	ElfToConvertName       string
+
+	// FileName is the input file name written to the dynamic table, which the module is named after unless there's a
+	// LibraryName. It's ElfToConvertName, unless a copy of the input is converted (ie. a relaid out one).
+	FileName string
+
 	ElfToConvert           *elf.File
 	LibrarySymbolDictionary *OrderedMap
 	ModuleList []string
@@ -23,7 +29,45 @@ type OrbisElf struct {
 	WrittenBytes           int
 	IsLibrary              bool
 
+	// IsFixedAddress is set for position-dependent executables, which are loaded at their link address (ET_SCE_EXEC)
+	// instead of a random base (ET_SCE_EXEC_ASLR)
+	IsFixedAddress bool
+
+	// LinkManifest holds the linking options given with the input ELF (nil if there are none), and OptionalModules the
+	// imported modules that are allowed to fail to load
+	LinkManifest    *LinkManifest
+	OptionalModules map[string]bool
+
+	// ExportList filters the symbols a library exports (nil to export all of them), and ExportedSymbols holds the
+	// symbols it ends up exporting
+	ExportList      *ExportList
+	ExportedSymbols []elf.Symbol
+
+	// StubCache holds parsed stub libraries between conversions (nil to parse them on each conversion)
+	StubCache *StubCache
+
+	// StubSymbols maps the names of imported symbols to their definition in the stub library they're resolved by, and
+	// ImportLibraries to the name of that library
+	StubSymbols     map[string]elf.Symbol
+	ImportLibraries map[string]string
+
+	// symbolIndex indexes the input's symbol table by name, see getSymbol
+	symbolIndex map[string]elf.Symbol
+
+	// Warnings holds problems with the input ELF that were worked around while converting it
+	Warnings []string
+
+	// FinalFile is where the orbis ELF is written by Close, nil if it isn't kept
 	FinalFile *os.File
+
+	// output is the orbis ELF being built over inputFile, which everything is written to
+	inputFile *os.File
+	output    *overlayFile
+}
+
+// warn records a warning about the conversion, formatted with the given parameters.
+func (orbisElf *OrbisElf) warn(format string, params ...interface{}) {
+	orbisElf.Warnings = append(orbisElf.Warnings, fmt.Sprintf(format, params...))
 }
 
 // validateInputELF performs checks on the ELF to be converted. It checks the byte order, machine, class, and
@@ -42,28 +86,43 @@ func (orbisElf *OrbisElf) validateInputELF() error {
 		return errors.New("elf must be a 64-bit elf")
 	}
 
+	// Fixed-address executables are loaded as-is, so the input must have been linked at its final address
+	if orbisElf.IsFixedAddress {
+		if orbisElf.ElfToConvert.Type != elf.ET_EXEC {
+			return fmt.Errorf("fixed-address executables must be linked as position-dependent (ET_EXEC), got %s",
+				orbisElf.ElfToConvert.Type)
+		}
+
+		for _, progHeader := range orbisElf.ElfToConvert.Progs {
+			if progHeader.Type == elf.PT_LOAD && progHeader.Vaddr < 0x4000 {
+				return fmt.Errorf("fixed-address executables must be linked at a base address (ie. 0x400000), "+
+					"PT_LOAD at 0x%X would map the null page", progHeader.Vaddr)
+			}
+		}
+	} else if orbisElf.ElfToConvert.Type == elf.ET_EXEC {
+		orbisElf.warn("input elf is position-dependent (ET_EXEC) but will be loaded at a random base, link it with " +
+			"-pie or convert it as a fixed-address executable")
+	}
+
 	return nil
 }
 
-// CreateOrbisElf initiates an instance of OrbisElf and returns it
-func CreateOrbisElf(isLib bool, inputFilePath string, outputFilePath string, libName string) (*OrbisElf, error) {
-	// Open the ELF file to be converted, and create a file for the final Orbis ELF
+// CreateOrbisElf initiates an instance of OrbisElf and returns it. If isFixedAddress is set, the input must be a
+// position-dependent executable, which will be loaded at its link address. The orbis ELF is built over the input in
+// memory, see overlayFile, and is only written out to outputFilePath by Close (if it isn't empty).
+func CreateOrbisElf(isLib bool, isFixedAddress bool, inputFilePath string, outputFilePath string, libName string) (*OrbisElf, error) {
+	// Open the ELF file to be converted, and create the file for the final Orbis ELF if it's kept
 	inputElf, err := elf.Open(inputFilePath)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create final oelf file
-	outputElf, err := os.Create(outputFilePath)
-	if err != nil {
-		return nil, err
-	}
-
 	orbisElf := OrbisElf{
 		LibraryName:      libName,
 		ElfToConvertName: inputFilePath,
+		FileName:         inputFilePath,
 		ElfToConvert:     inputElf,
-		FinalFile:        outputElf,
+		IsFixedAddress:   isFixedAddress,
 	}
 
 	// Validate ELF to convert before processing
@@ -72,18 +131,59 @@ func CreateOrbisElf(isLib bool, inputFilePath string, outputFilePath string, lib
 		return nil, err
 	}
 
-	// Copy contents of input file into output file
-	inputFileBytes, err := ioutil.ReadFile(inputFilePath)
+	// The input is read through rather than copied, so it stays open until Close
+	inputFile, err := os.Open(inputFilePath)
 	if err != nil {
 		return nil, err
 	}
 
-	writtenBytes, err := orbisElf.FinalFile.Write(inputFileBytes)
+	fileInfo, err := inputFile.Stat()
 	if err != nil {
+		_ = inputFile.Close()
 		return nil, err
 	}
 
+	if outputFilePath != "" {
+		if orbisElf.FinalFile, err = os.Create(outputFilePath); err != nil {
+			_ = inputFile.Close()
+			return nil, err
+		}
+	}
+
 	orbisElf.IsLibrary = isLib
-	orbisElf.WrittenBytes = writtenBytes
+	orbisElf.WrittenBytes = int(fileInfo.Size())
+	orbisElf.inputFile = inputFile
+	orbisElf.output = newOverlayFile(inputFile, fileInfo.Size())
 	return &orbisElf, nil
 }
+
+// Reader returns a reader for the orbis ELF written so far and its size, so it can be turned into an fself without
+// writing it out first. Returns an error if the orbis ELF was already closed.
+func (orbisElf *OrbisElf) Reader() (io.ReaderAt, int64, error) {
+	if orbisElf.output == nil {
+		return nil, 0, errors.New("orbis elf is closed")
+	}
+
+	return orbisElf.output, orbisElf.output.size, nil
+}
+
+// Close writes the orbis ELF to FinalFile if it's kept, and closes the files. Returns an error if the orbis ELF couldn't
+// be written or a file couldn't be closed, nil otherwise.
+func (orbisElf *OrbisElf) Close() error {
+	var err error
+
+	if orbisElf.FinalFile != nil {
+		_, err = io.Copy(orbisElf.FinalFile, io.NewSectionReader(orbisElf.output, 0, orbisElf.output.size))
+
+		if closeErr := orbisElf.FinalFile.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if closeErr := orbisElf.inputFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	orbisElf.output = nil
+	return err
+}
@@ -0,0 +1,166 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// _buildIdNoteName holds the name of the section the build ID note is written to in debug ELFs.
+const _buildIdNoteName = ".note.gnu.build-id"
+
+// NT_GNU_BUILD_ID is the note type used for the build ID note.
+const NT_GNU_BUILD_ID = 3
+
+// WriteDebugELF writes a separate debug ELF to the given path, containing the input ELF's .symtab, .strtab, and DWARF
+// sections, as well as the program headers generated for the final Orbis ELF. All other sections are kept as SHT_NOBITS
+// so section indices and addresses still match the input ELF. The given buildId (ie. the fself digest) is written
+// as a GNU build ID note so the debug ELF can be matched to the eboot or sprx it was created for. Returns an error if
+// the debug ELF couldn't be written, nil otherwise.
+func (orbisElf *OrbisElf) WriteDebugELF(outputPath string, buildId []byte) error {
+	inputFile, err := os.Open(orbisElf.ElfToConvertName)
+	if err != nil {
+		return err
+	}
+
+	defer inputFile.Close()
+
+	inputHdr := new(elf.Header64)
+
+	if err = binary.Read(inputFile, orbisElf.ElfToConvert.ByteOrder, inputHdr); err != nil {
+		return err
+	}
+
+	sectionHeaders, err := orbisElf.getRawSectionHeaders(inputFile, inputHdr)
+	if err != nil {
+		return err
+	}
+
+	if inputHdr.Shstrndx == uint16(elf.SHN_UNDEF) || int(inputHdr.Shstrndx) >= len(sectionHeaders) {
+		return errors.New("input elf has no section name table")
+	}
+
+	symbolTable := orbisElf.ElfToConvert.SectionByType(elf.SHT_SYMTAB)
+	if symbolTable == nil {
+		return errors.New("input elf has no .symtab, was it stripped?")
+	}
+
+	// The ELF header and program headers come first, followed by section data and then the section header table
+	debugData := make([]byte, 0x40+len(orbisElf.ProgramHeaders)*0x38)
+	buildIdNoteNameOffset := uint32(0)
+
+	for i := range sectionHeaders {
+		sectionHeader := &sectionHeaders[i]
+		section := orbisElf.ElfToConvert.Sections[i]
+
+		if elf.SectionType(sectionHeader.Type) == elf.SHT_NULL {
+			continue
+		}
+
+		if !isDebugELFSection(section, i == int(symbolTable.Link), i == int(inputHdr.Shstrndx)) {
+			// Keep the header so addresses and indices are valid, but drop the data
+			sectionHeader.Type = uint32(elf.SHT_NOBITS)
+			sectionHeader.Off = uint64(len(debugData))
+			continue
+		}
+
+		sectionData := make([]byte, section.FileSize)
+
+		if _, err := inputFile.ReadAt(sectionData, int64(section.Offset)); err != nil {
+			return err
+		}
+
+		// The section name table needs an extra name for the build ID note
+		if i == int(inputHdr.Shstrndx) {
+			buildIdNoteNameOffset = uint32(len(sectionData))
+			sectionData = append(sectionData, []byte(_buildIdNoteName+"\x00")...)
+			sectionHeader.Size = uint64(len(sectionData))
+		}
+
+		if sectionHeader.Addralign > 1 {
+			writePaddingBytes(&debugData, uint64(len(debugData)), sectionHeader.Addralign)
+		}
+
+		sectionHeader.Off = uint64(len(debugData))
+		debugData = append(debugData, sectionData...)
+	}
+
+	// Add the build ID note
+	buildIdNoteBuff := new(bytes.Buffer)
+
+	_ = binary.Write(buildIdNoteBuff, binary.LittleEndian, uint32(len("GNU\x00")))
+	_ = binary.Write(buildIdNoteBuff, binary.LittleEndian, uint32(len(buildId)))
+	_ = binary.Write(buildIdNoteBuff, binary.LittleEndian, uint32(NT_GNU_BUILD_ID))
+	buildIdNoteBuff.WriteString("GNU\x00")
+	buildIdNoteBuff.Write(buildId)
+
+	writePaddingBytes(&debugData, uint64(len(debugData)), 0x4)
+
+	sectionHeaders = append(sectionHeaders, elf.Section64{
+		Name:      buildIdNoteNameOffset,
+		Type:      uint32(elf.SHT_NOTE),
+		Off:       uint64(len(debugData)),
+		Size:      uint64(buildIdNoteBuff.Len()),
+		Addralign: 0x4,
+	})
+
+	debugData = append(debugData, buildIdNoteBuff.Bytes()...)
+
+	// Commit the section header table
+	writePaddingBytes(&debugData, uint64(len(debugData)), 0x8)
+	sectionHeadersOffset := uint64(len(debugData))
+
+	sectionHeadersBuff := new(bytes.Buffer)
+
+	if err := binary.Write(sectionHeadersBuff, binary.LittleEndian, sectionHeaders); err != nil {
+		return err
+	}
+
+	debugData = append(debugData, sectionHeadersBuff.Bytes()...)
+
+	// Program headers describe the final module layout, but carry no data
+	headersBuff := new(bytes.Buffer)
+
+	header := *inputHdr
+	header.Phoff = 0x40
+	header.Phentsize = 0x38
+	header.Phnum = uint16(len(orbisElf.ProgramHeaders))
+	header.Shoff = sectionHeadersOffset
+	header.Shentsize = 0x40
+	header.Shnum = uint16(len(sectionHeaders))
+
+	if err := binary.Write(headersBuff, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	for _, progHeader := range orbisElf.ProgramHeaders {
+		if err := binary.Write(headersBuff, binary.LittleEndian, elf.Prog64{
+			Type:  uint32(progHeader.Type),
+			Flags: uint32(progHeader.Flags),
+			Vaddr: progHeader.Vaddr,
+			Paddr: progHeader.Paddr,
+			Memsz: progHeader.Memsz,
+			Align: progHeader.Align,
+		}); err != nil {
+			return err
+		}
+	}
+
+	copy(debugData, headersBuff.Bytes())
+
+	return ioutil.WriteFile(outputPath, debugData, 0644)
+}
+
+// isDebugELFSection returns true if the given section should have its data kept in the debug ELF. This includes the
+// symbol table and its string table, the section name table, and all DWARF sections.
+func isDebugELFSection(section *elf.Section, isSymbolStringTable bool, isSectionNameTable bool) bool {
+	if section.Type == elf.SHT_SYMTAB || isSymbolStringTable || isSectionNameTable {
+		return true
+	}
+
+	return strings.HasPrefix(section.Name, ".debug_") || strings.HasPrefix(section.Name, ".zdebug_")
+}
@@ -0,0 +1,110 @@
+package oelf
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+// _exceptionFrameSections lists the sections the unwinder needs at runtime to handle C++ exceptions. The unwinder finds
+// .eh_frame_hdr through PT_GNU_EH_FRAME, which in turn points to .eh_frame. Language specific data (ie. catch clauses)
+// is in .gcc_except_table.
+var _exceptionFrameSections = []string{".eh_frame_hdr", ".eh_frame", ".gcc_except_table"}
+
+// planExceptionFrames makes sure the exception frame sections of the input ELF are mapped by the program headers that
+// were generated, and that PT_GNU_EH_FRAME points to .eh_frame_hdr. A missing or stale PT_GNU_EH_FRAME is regenerated
+// with a warning. Returns an error if any of the unwind tables aren't mapped, nil otherwise.
+func (orbisElf *OrbisElf) planExceptionFrames() error {
+	for _, sectionName := range _exceptionFrameSections {
+		section := orbisElf.ElfToConvert.Section(sectionName)
+
+		if section == nil || section.Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+
+		if orbisElf.getMappingSegment(section) == nil {
+			return fmt.Errorf("%s at 0x%X-0x%X isn't mapped by any segment, exceptions would fail to unwind", sectionName,
+				section.Addr, section.Addr+section.Size)
+		}
+	}
+
+	ehFrameHdrSection := orbisElf.ElfToConvert.Section(".eh_frame_hdr")
+	ehFrameHeaderIndex := -1
+
+	for i, progHeader := range orbisElf.ProgramHeaders {
+		if progHeader.Type == PT_GNU_EH_FRAME {
+			ehFrameHeaderIndex = i
+			break
+		}
+	}
+
+	if ehFrameHdrSection == nil {
+		if orbisElf.ElfToConvert.Section(".eh_frame") != nil {
+			orbisElf.warn("input elf has .eh_frame but no .eh_frame_hdr, exceptions won't unwind unless it's linked with --eh-frame-hdr")
+		}
+
+		// A PT_GNU_EH_FRAME without .eh_frame_hdr would point the unwinder at garbage
+		if ehFrameHeaderIndex >= 0 {
+			orbisElf.ProgramHeaders = append(orbisElf.ProgramHeaders[:ehFrameHeaderIndex], orbisElf.ProgramHeaders[ehFrameHeaderIndex+1:]...)
+		}
+
+		return nil
+	}
+
+	ehFrameHeader := generateEhFrameHeader(ehFrameHdrSection)
+
+	if ehFrameHeaderIndex < 0 {
+		orbisElf.warn("input elf has no PT_GNU_EH_FRAME, generated %s for .eh_frame_hdr", describeSegment(ehFrameHeader))
+		orbisElf.ProgramHeaders = append(orbisElf.ProgramHeaders, ehFrameHeader)
+		return nil
+	}
+
+	if existingHeader := orbisElf.ProgramHeaders[ehFrameHeaderIndex]; existingHeader.Vaddr != ehFrameHeader.Vaddr ||
+		existingHeader.Off != ehFrameHeader.Off || existingHeader.Memsz != ehFrameHeader.Memsz {
+		orbisElf.warn("%s doesn't match .eh_frame_hdr, replaced it with %s", describeSegment(existingHeader),
+			describeSegment(ehFrameHeader))
+	}
+
+	orbisElf.ProgramHeaders[ehFrameHeaderIndex] = ehFrameHeader
+	return nil
+}
+
+// getMappingSegment takes a given section of the input ELF and finds the generated segment that maps it into memory.
+// Returns the segment, or nil if the section isn't mapped.
+func (orbisElf *OrbisElf) getMappingSegment(section *elf.Section) *elf.Prog {
+	sectionRange := &elf.Prog{
+		ProgHeader: elf.ProgHeader{
+			Off:   section.Offset,
+			Vaddr: section.Addr,
+			Memsz: section.Size,
+		},
+	}
+
+	for _, progHeader := range orbisElf.ProgramHeaders {
+		if progHeader.Type != elf.PT_LOAD && progHeader.Type != PT_SCE_RELRO {
+			continue
+		}
+
+		if segmentCovers(progHeader, sectionRange) {
+			return progHeader
+		}
+	}
+
+	return nil
+}
+
+// generateEhFrameHeader takes the given .eh_frame_hdr section and creates a PT_GNU_EH_FRAME program header for it.
+// Returns the final program header.
+func generateEhFrameHeader(ehFrameHdrSection *elf.Section) *elf.Prog {
+	return &elf.Prog{
+		ProgHeader: elf.ProgHeader{
+			Type:   PT_GNU_EH_FRAME,
+			Flags:  elf.PF_R,
+			Off:    ehFrameHdrSection.Offset,
+			Vaddr:  ehFrameHdrSection.Addr,
+			Paddr:  ehFrameHdrSection.Addr,
+			Filesz: ehFrameHdrSection.Size,
+			Memsz:  ehFrameHdrSection.Size,
+			Align:  0x4,
+		},
+	}
+}
@@ -0,0 +1,84 @@
+package oelf
+
+import (
+	"debug/elf"
+	"testing"
+)
+
+func TestGenerateProgramHeadersPlansExceptionFrames(t *testing.T) {
+	// A PT_GNU_EH_FRAME of 0x20 bytes at the given address, which is also its offset
+	ehFrameSegment := func(addr uint64) elf.Prog64 {
+		return elf.Prog64{Type: PT_GNU_EH_FRAME, Flags: uint32(elf.PF_R), Off: addr, Vaddr: addr, Paddr: addr,
+			Filesz: 0x20, Memsz: 0x20, Align: 0x4}
+	}
+
+	ehFrameHdr := testSection{Name: ".eh_frame_hdr", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC, Addr: 0x800,
+		Offset: 0x800, Size: 0x20}
+	ehFrame := testSection{Name: ".eh_frame", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC, Addr: 0x820, Offset: 0x820,
+		Size: 0x40}
+
+	mappedSegments := []string{
+		"PT_LOAD [R|X] 0x0-0x1000 (offset 0x0) filesz 0x1000",
+		"PT_LOAD [R|W] 0x4000-0x4200 (offset 0x4000) filesz 0x100",
+	}
+
+	withEhFrameSegment := append(append([]string(nil), mappedSegments...),
+		"PT_GNU_EH_FRAME [R] 0x800-0x820 (offset 0x800) filesz 0x20")
+
+	runProgramHeaderTests(t, []programHeaderTest{
+		{
+			name:        "matching PT_GNU_EH_FRAME",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment, ehFrameSegment(0x800)},
+			sections:    []testSection{ehFrameHdr, ehFrame},
+			segments:    withEhFrameSegment,
+		},
+		{
+			name:        "no PT_GNU_EH_FRAME",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment},
+			sections:    []testSection{ehFrameHdr, ehFrame},
+			segments:    withEhFrameSegment,
+			warnings: []string{"input elf has no PT_GNU_EH_FRAME, generated PT_GNU_EH_FRAME [R] 0x800-0x820 (offset 0x800) " +
+				"for .eh_frame_hdr"},
+		},
+		{
+			name:        "stale PT_GNU_EH_FRAME",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment, ehFrameSegment(0x900)},
+			sections:    []testSection{ehFrameHdr, ehFrame},
+			segments:    withEhFrameSegment,
+			warnings: []string{"PT_GNU_EH_FRAME [R] 0x900-0x920 (offset 0x900) doesn't match .eh_frame_hdr, replaced it " +
+				"with PT_GNU_EH_FRAME [R] 0x800-0x820 (offset 0x800)"},
+		},
+		{
+			name:        "no .eh_frame_hdr",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment, ehFrameSegment(0x800)},
+			sections:    []testSection{ehFrame},
+			segments:    mappedSegments,
+			warnings: []string{"input elf has .eh_frame but no .eh_frame_hdr, exceptions won't unwind unless it's linked " +
+				"with --eh-frame-hdr"},
+		},
+		{
+			name:        "no exception frames",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment},
+			segments:    mappedSegments,
+		},
+		{
+			name:        "unmapped .eh_frame_hdr",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment},
+			sections: []testSection{
+				{Name: ".eh_frame_hdr", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC, Addr: 0x2000, Offset: 0x2000,
+					Size: 0x20},
+				ehFrame,
+			},
+			err: ".eh_frame_hdr at 0x2000-0x2020 isn't mapped by any segment, exceptions would fail to unwind",
+		},
+		{
+			name:        "unmapped .gcc_except_table",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment},
+			sections: []testSection{ehFrameHdr, ehFrame,
+				{Name: ".gcc_except_table", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC, Addr: 0x2000, Offset: 0x2000,
+					Size: 0x10},
+			},
+			err: ".gcc_except_table at 0x2000-0x2010 isn't mapped by any segment, exceptions would fail to unwind",
+		},
+	})
+}
@@ -0,0 +1,199 @@
+package oelf
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// ExportList holds glob patterns for the symbols a library exports. It's read from either a plain list with one
+// pattern per line, or a linker version script:
+//
+//	{
+//		global: foo_*; bar;
+//		local: *;
+//	};
+//
+// Symbols matching an Include pattern are exported. If there are no Include patterns, every symbol that doesn't match an
+// Exclude pattern is exported.
+type ExportList struct {
+	Include []string
+	Exclude []string
+
+	// matched holds the patterns that matched at least one symbol
+	matched map[string]bool
+}
+
+// ParseExportList takes the export list or version script at the given path and parses it. Returns the export list,
+// or an error if a pattern isn't a valid glob.
+func ParseExportList(listPath string) (*ExportList, error) {
+	listData, err := ioutil.ReadFile(listPath)
+	if err != nil {
+		return nil, err
+	}
+
+	exportList := &ExportList{
+		matched: make(map[string]bool),
+	}
+
+	// Comments are '#' for plain lists, and C-style for version scripts
+	lines := strings.Split(string(listData), "\n")
+
+	for i, line := range lines {
+		if commentStart := strings.Index(line, "#"); commentStart >= 0 {
+			line = line[:commentStart]
+		}
+
+		if commentStart := strings.Index(line, "//"); commentStart >= 0 {
+			line = line[:commentStart]
+		}
+
+		lines[i] = line
+	}
+
+	listText := strings.Join(lines, "\n")
+
+	for commentStart := strings.Index(listText, "/*"); commentStart >= 0; commentStart = strings.Index(listText, "/*") {
+		commentEnd := strings.Index(listText[commentStart:], "*/")
+		if commentEnd < 0 {
+			return nil, fmt.Errorf("%s: unterminated comment", listPath)
+		}
+
+		listText = listText[:commentStart] + " " + listText[commentStart+commentEnd+2:]
+	}
+
+	isVersionScript := strings.Contains(listText, "{")
+	isExcluding := false
+	depth := 0
+
+	tokens := strings.FieldsFunc(listText, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\r' || r == '\n' || r == ';'
+	})
+
+	for _, token := range tokens {
+		// Braces can be attached to version names and patterns, ie. `VERS_1.0{` or `};`. Trailing braces only take
+		// effect after the token itself.
+		for strings.HasPrefix(token, "}") {
+			depth--
+			token = token[1:]
+		}
+
+		depthAfter := depth
+
+		for strings.HasSuffix(token, "{") || strings.HasSuffix(token, "}") {
+			if strings.HasSuffix(token, "{") {
+				depthAfter++
+			} else {
+				depthAfter--
+			}
+
+			token = token[:len(token)-1]
+		}
+
+		// Outside of a version node are the node names and the names of the nodes they depend on
+		isOutside := isVersionScript && depth <= 0
+
+		// Each version node starts out global
+		if depth <= 0 && depthAfter > 0 {
+			isExcluding = false
+		}
+
+		depth = depthAfter
+
+		if token == "" || isOutside {
+			continue
+		}
+
+		switch token {
+		case "global:":
+			isExcluding = false
+			continue
+		case "local:":
+			isExcluding = true
+			continue
+		}
+
+		token = strings.Trim(token, "\"")
+
+		if _, err := path.Match(token, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern '%s': %s", listPath, token, err.Error())
+		}
+
+		if isExcluding {
+			exportList.Exclude = append(exportList.Exclude, token)
+		} else {
+			exportList.Include = append(exportList.Include, token)
+		}
+	}
+
+	return exportList, nil
+}
+
+// matchPatterns takes the given symbol name and checks it against the given patterns. Every matching pattern is
+// recorded, so unused patterns can be reported. Returns true if a pattern matches.
+func (exportList *ExportList) matchPatterns(patterns []string, symbolName string) bool {
+	isMatched := false
+
+	for _, pattern := range patterns {
+		if isMatch, _ := path.Match(pattern, symbolName); isMatch {
+			exportList.matched[pattern] = true
+			isMatched = true
+		}
+	}
+
+	return isMatched
+}
+
+// IsExported takes the given symbol name and checks if the export list exports it. Returns true if it's exported.
+func (exportList *ExportList) IsExported(symbolName string) bool {
+	if len(exportList.Include) > 0 {
+		return exportList.matchPatterns(exportList.Include, symbolName)
+	}
+
+	return !exportList.matchPatterns(exportList.Exclude, symbolName)
+}
+
+// resolveExportedSymbols decides which symbols of the input ELF a library exports. Global and weak symbols that are
+// defined and visible outside of the library are exported, filtered by the export list if there is one. Symbols are
+// taken from .symtab, or from .dynsym if the input is stripped.
+func (orbisElf *OrbisElf) resolveExportedSymbols() {
+	orbisElf.ExportedSymbols = nil
+
+	if !orbisElf.IsLibrary {
+		return
+	}
+
+	moduleSymbols, _ := orbisElf.getSymbols()
+
+	for _, symbol := range moduleSymbols {
+		symbolBind := elf.ST_BIND(symbol.Info)
+		symbolVisibility := elf.ST_VISIBILITY(symbol.Other)
+
+		// Only export global symbols that we have values for
+		if (symbolBind != elf.STB_GLOBAL && symbolBind != elf.STB_WEAK) || symbol.Value == 0 ||
+			symbol.Section == elf.SHN_UNDEF {
+			continue
+		}
+
+		// Hidden and internal symbols can't be referenced from outside of the library
+		if symbolVisibility == elf.STV_HIDDEN || symbolVisibility == elf.STV_INTERNAL {
+			continue
+		}
+
+		if orbisElf.ExportList != nil && !orbisElf.ExportList.IsExported(symbol.Name) {
+			continue
+		}
+
+		orbisElf.ExportedSymbols = append(orbisElf.ExportedSymbols, symbol)
+	}
+
+	if orbisElf.ExportList != nil {
+		for _, pattern := range orbisElf.ExportList.Include {
+			if !orbisElf.ExportList.matched[pattern] {
+				orbisElf.warn("export list pattern '%s' doesn't match any symbol", pattern)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package oelf
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExportList(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		include []string
+		exclude []string
+		err     string
+	}{
+		{"plain list", "foo\nbar_*   # comment\n\n", []string{"foo", "bar_*"}, nil, ""},
+		{"version script", "{\n\tglobal: foo_*; bar;\n\tlocal: *;\n};\n", []string{"foo_*", "bar"}, []string{"*"}, ""},
+		{
+			"named versions",
+			"VERS_1.0{ global: foo; local: *; };\nVERS_2.0 { bar; } VERS_1.0;\n",
+			[]string{"foo", "bar"},
+			[]string{"*"},
+			"",
+		},
+		{
+			"comments",
+			"/* exported\n   symbols */ {\n\tglobal: foo; // not bar\n\tlocal: \"hidden_*\"; # or baz\n};\n",
+			[]string{"foo"},
+			[]string{"hidden_*"},
+			"",
+		},
+		{"local only", "{ local: hidden_*; };", nil, []string{"hidden_*"}, ""},
+		{"invalid pattern", "{ global: foo[; };", nil, nil, "invalid pattern 'foo['"},
+		{"unterminated comment", "{ global: foo; /* };", nil, nil, "unterminated comment"},
+	}
+
+	for _, test := range tests {
+		listPath := filepath.Join(t.TempDir(), "exports.map")
+
+		if err := ioutil.WriteFile(listPath, []byte(test.list), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		exportList, err := ParseExportList(listPath)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		if !reflect.DeepEqual(exportList.Include, test.include) || !reflect.DeepEqual(exportList.Exclude, test.exclude) {
+			t.Errorf("%s: got include %q and exclude %q, want %q and %q", test.name, exportList.Include,
+				exportList.Exclude, test.include, test.exclude)
+		}
+	}
+}
+
+func TestIsExported(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		exported map[string]bool
+	}{
+		{
+			// Once there's a global pattern, `local: *` only hides what the global patterns don't match
+			"global globs with local *",
+			[]string{"foo_*", "bar"},
+			[]string{"*"},
+			map[string]bool{"foo_init": true, "foo_": true, "bar": true, "barbaz": false, "baz": false},
+		},
+		{
+			"local only",
+			nil,
+			[]string{"hidden_*", "internal"},
+			map[string]bool{"hidden_init": false, "internal": false, "internals": true, "visible": true},
+		},
+		{
+			"character classes",
+			[]string{"sce[A-Z]*"},
+			nil,
+			map[string]bool{"sceInit": true, "scenario": false},
+		},
+	}
+
+	for _, test := range tests {
+		exportList := &ExportList{
+			Include: test.include,
+			Exclude: test.exclude,
+			matched: make(map[string]bool),
+		}
+
+		for symbolName, exported := range test.exported {
+			if exportList.IsExported(symbolName) != exported {
+				t.Errorf("%s: IsExported(%q) is %v, want %v", test.name, symbolName, !exported, exported)
+			}
+		}
+	}
+}
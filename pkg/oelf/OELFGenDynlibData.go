@@ -38,6 +38,10 @@ const (
 
 	// _indexEncodingTable provides the encoding table for module indices that are appended to the end of NIDs.
 	_indexEncodingTable = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+-"
+
+	// _maxImportId is the largest library / module id, as ids are 16-bit in the dynamic table. Encoded in NIDs, it takes
+	// up to three characters, which is as many as the SCE loader decodes.
+	_maxImportId = 0xFFFF
 )
 
 // _moduleToLibDictionary contains a mapping of module names to library (prx) paths
@@ -110,6 +114,16 @@ var (
 
 	_needSceLibcIndex int
 	_numHashEntries   int
+
+	// _nidEntryOffsets holds the offset of each NID entry from _offsetOfNidTable, in the order they're written, followed
+	// by the offset just past the last one. Entries vary in length, as library and module ids of 64 and up take more
+	// than one character.
+	_nidEntryOffsets []uint64
+
+	// _symbolIndexMap maps input .dynsym indices of imports to their index in the SCE symbol table, and _symbolTableNames
+	// holds the input symbol name of each SCE symbol table entry so relocations can be checked against it
+	_symbolIndexMap   map[uint32]uint32
+	_symbolTableNames []string
 )
 
 ////
@@ -117,13 +131,7 @@ var (
 ////
 
 func OpenLibrary(name string, sdkPath string, libPath string) (*elf.File, error) {
-	var libDelimiter string
-	if runtime.GOOS == "windows" {
-		libDelimiter = ";"
-	} else {
-		libDelimiter = ":"
-	}
-	libDirs := append([]string{sdkPath + "/lib"}, strings.Split(libPath, libDelimiter)...)
+	libDirs := getLibraryDirs(sdkPath, libPath)
 	var err error
 	var lib *elf.File
 	for _, libDir := range libDirs {
@@ -135,19 +143,34 @@ func OpenLibrary(name string, sdkPath string, libPath string) (*elf.File, error)
 	return nil, err
 }
 
+// getLibraryDirs returns the directories libraries are searched in, which are the toolchain's lib directory followed by
+// the directories of the given library path.
+func getLibraryDirs(sdkPath string, libPath string) []string {
+	var libDelimiter string
+	if runtime.GOOS == "windows" {
+		libDelimiter = ";"
+	} else {
+		libDelimiter = ":"
+	}
+	return append([]string{sdkPath + "/lib"}, strings.Split(libPath, libDelimiter)...)
+}
+
 // GenerateLibrarySymbolDictionary parses the input ELF for any libraries as well as symbols it needs from shared
 // libraries, and creates a dictionary of library names to symbol lists for later use. Returns an error if a library failed
 // to open, or if we failed to get a symbol list for any library, nil otherwise.
 func (orbisElf *OrbisElf) GenerateLibrarySymbolDictionary(sdkPath string, libPath string) error {
-	var libraryObjs []*elf.File
+	var stubLibraries []*stubLibrary
+	var libraryNames []string
 
 	orbisElf.LibrarySymbolDictionary = NewOrderedMap()
 	orbisElf.LibraryModuleDictionary = NewOrderedMap()
 
 	orbisElf.ModuleList = make([]string, 0, 10)
+	orbisElf.StubSymbols = make(map[string]elf.Symbol)
+	orbisElf.ImportLibraries = make(map[string]string)
 
 	// Get all the imported libraries, create dictionary keys for them, and open them for symbol searching
-	libraries, err := orbisElf.ElfToConvert.ImportedLibraries()
+	libraries, err := orbisElf.getImportedLibraries()
 
 	if err != nil {
 		return err
@@ -169,8 +192,9 @@ func (orbisElf *OrbisElf) GenerateLibrarySymbolDictionary(sdkPath string, libPat
 	}
 
 	// Ensure libkernel is the first library
-	if libraryObj, err := OpenLibrary("libkernel.so", sdkPath, libPath); err == nil {
-		libraryObjs = append(libraryObjs, libraryObj)
+	if stubLibrary, err := orbisElf.loadStubLibrary("libkernel.so", sdkPath, libPath); err == nil {
+		stubLibraries = append(stubLibraries, stubLibrary)
+		libraryNames = append(libraryNames, "libkernel")
 		orbisElf.LibrarySymbolDictionary.Set("libkernel", []string{})
 
 		orbisElf.LibraryModuleDictionary.Set("libkernel", "libkernel")
@@ -186,24 +210,20 @@ func (orbisElf *OrbisElf) GenerateLibrarySymbolDictionary(sdkPath string, libPat
 			continue
 		}
 
-		// Open the library file for parsing
-		if libraryObj, err := OpenLibrary(library, sdkPath, libPath); err == nil {
-			libraryObjs = append(libraryObjs, libraryObj)
-		} else {
+		// Load the library's symbols, from the stub cache if possible
+		stubLibrary, err := orbisElf.loadStubLibrary(library, sdkPath, libPath)
+		if err != nil {
 			return err
 		}
 
+		stubLibraries = append(stubLibraries, stubLibrary)
+
 		// Add it to the dictionary
-		purifiedLibrary := strings.Replace(library, ".so", "", 1)
+		purifiedLibrary := stubLibrary.Name
+		libraryNames = append(libraryNames, purifiedLibrary)
 		orbisElf.LibrarySymbolDictionary.Set(purifiedLibrary, []string{})
-		
 
-		// Assume module name is the library name
-		moduleName := purifiedLibrary
-		// Check if it is a weird library hidden inside a module
-		if mn, ok := _extraLibraryToModule[purifiedLibrary]; ok {
-			moduleName = mn
-		} 
+		moduleName := stubLibrary.Module
 
 		// Prevent duplicate entries
 		if !contains(orbisElf.ModuleList, moduleName) {
@@ -229,23 +249,17 @@ func (orbisElf *OrbisElf) GenerateLibrarySymbolDictionary(sdkPath string, libPat
 
 	orbisElf.LibrarySymbolDictionary = rolsd
 
-	// Create a cache of libraries to symbols for better performancek
-	librarySymbolCache := make(map[*elf.File][]elf.Symbol)
-
-	for _, libraryObj := range libraryObjs {
-		if symbols, err := libraryObj.Symbols(); err == nil {
-			librarySymbolCache[libraryObj] = symbols
-		}
-	}
-
 	// Iterate the symbol table and cross-reference the shared object files to find which library they belong to, and
 	// add them to the dictionary.
-	symbols, err := orbisElf.ElfToConvert.Symbols()
+	symbols, err := orbisElf.getSymbols()
 
 	if err != nil {
 		return err
 	}
 
+	// Libraries that define the same symbols, mapped to the number of imports they share
+	duplicateDefinitions := NewOrderedMap()
+
 	// Add symbol lists to the library dictionary
 	for _, symbol := range symbols {
 		symbolName := symbol.Name
@@ -255,22 +269,55 @@ func (orbisElf *OrbisElf) GenerateLibrarySymbolDictionary(sdkPath string, libPat
 			continue
 		}
 
-		// Check all linked libraries for the symbol
-		for i, libraryObj := range libraryObjs {
-			foundSymbol := checkIfLibraryContainsSymbol(librarySymbolCache[libraryObj], symbolName)
+		// Check all linked libraries for the symbol. Libraries are in link order, with libkernel first.
+		var definingLibraries []int
+
+		for i, stubLibrary := range stubLibraries {
+			if _, ok := stubLibrary.Symbols[symbolName]; ok {
+				definingLibraries = append(definingLibraries, i)
+			}
+		}
+
+		if len(definingLibraries) == 0 {
+			continue
+		}
 
-			// Found it? Add it
-			if foundSymbol {
-				library := strings.Replace(libraries[i], ".so", "", 1)
+		// The first library in link order defines the symbol, unless the link manifest pins it to another one
+		libraryIndex, err := orbisElf.resolveSymbolLibrary(symbol, definingLibraries, libraryNames)
+		if err != nil {
+			return err
+		}
 
-				symbolList := orbisElf.LibrarySymbolDictionary.Get(library).([]string)
-				symbolList = append(symbolList, symbolName)
+		if len(definingLibraries) > 1 && symbol.Section == elf.SHN_UNDEF && libraryIndex == definingLibraries[0] {
+			var definingNames []string
 
-				orbisElf.LibrarySymbolDictionary.Set(library, symbolList)
+			for _, i := range definingLibraries {
+				definingNames = append(definingNames, libraryNames[i])
 			}
+
+			duplicateKey := strings.Join(definingNames, ", ")
+			duplicateCount, _ := duplicateDefinitions.Get(duplicateKey).(int)
+			duplicateDefinitions.Set(duplicateKey, duplicateCount+1)
 		}
+
+		library := libraryNames[libraryIndex]
+		orbisElf.StubSymbols[symbolName] = stubLibraries[libraryIndex].Symbols[symbolName]
+		orbisElf.ImportLibraries[symbolName] = library
+
+		symbolList := orbisElf.LibrarySymbolDictionary.Get(library).([]string)
+		symbolList = append(symbolList, symbolName)
+
+		orbisElf.LibrarySymbolDictionary.Set(library, symbolList)
+	}
+
+	for _, duplicateKey := range duplicateDefinitions.Keys() {
+		definingNames := strings.Split(duplicateKey.(string), ", ")
+
+		orbisElf.warn("%s all define the same %d import(s), they're imported from %s (pin them to a library in the "+
+			"link manifest to change it)", duplicateKey, duplicateDefinitions.Get(duplicateKey).(int), definingNames[0])
 	}
 
+	orbisElf.checkSymbolPins(symbols)
 	return nil
 }
 
@@ -286,6 +333,12 @@ func (orbisElf *OrbisElf) GenerateDynlibData(sdkPath string, libPath string) err
 		return err
 	}
 
+	if err = orbisElf.resolveOptionalModules(); err != nil {
+		return err
+	}
+
+	orbisElf.resolveExportedSymbols()
+
 	segmentSize = 0
 	tableOffsets := TableOffsets{}
 
@@ -294,10 +347,6 @@ func (orbisElf *OrbisElf) GenerateDynlibData(sdkPath string, libPath string) err
 		return err
 	}
 
-	if tableOffsets.jumpTableSz, err = orbisElf.getDynamicTag(elf.DT_PLTRELSZ); err != nil {
-		return err
-	}
-
 	_offsetOfDynlibData = uint64(orbisElf.WrittenBytes)
 
 	// Write the fingerprint
@@ -305,7 +354,7 @@ func (orbisElf *OrbisElf) GenerateDynlibData(sdkPath string, libPath string) err
 
 	// Write linking tables
 	tableOffsets.stringTable = segmentSize
-	tableOffsets.stringTableSz, err = writeStringTable(orbisElf, orbisElf.ElfToConvertName, orbisElf.LibraryName, orbisElf.ModuleList, orbisElf.LibrarySymbolDictionary, &segmentData)
+	tableOffsets.stringTableSz, err = writeStringTable(orbisElf, orbisElf.FileName, orbisElf.LibraryName, orbisElf.ModuleList, orbisElf.LibrarySymbolDictionary, &segmentData)
 	if err != nil {
 		return err
 	}
@@ -318,13 +367,14 @@ func (orbisElf *OrbisElf) GenerateDynlibData(sdkPath string, libPath string) err
 	tableOffsets.symbolTableSz = writeSymbolTable(orbisElf, &segmentData)
 	segmentSize += tableOffsets.symbolTableSz
 
-	// We can pre-calculate the location of the relocation table by using the PLTRELSZ. Since rela entries and symbol
-	// entries are the same size, the offset will match.
+	// The jump table is written first, followed by the rest of the relocation table
 	tableOffsets.jumpTable = segmentSize
+	tableOffsets.jumpTableSz, tableOffsets.relocationTableSz, err = writeRelocationTable(orbisElf, &segmentData)
+	if err != nil {
+		return err
+	}
 
 	tableOffsets.relocationTable = segmentSize + tableOffsets.jumpTableSz
-	tableOffsets.relocationTableSz = writeRelocationTable(orbisElf, &segmentData)
-
 	segmentSize += tableOffsets.relocationTableSz
 
 	// The relocation table size must omit the jump table, so we'll subtract the size of the jump table from the relocation
@@ -350,7 +400,7 @@ func (orbisElf *OrbisElf) GenerateDynlibData(sdkPath string, libPath string) err
 	_sizeOfDynamic = tableOffsets.dynamicTableSz
 	_sizeOfDynlibData = segmentSize
 
-	_, err = orbisElf.FinalFile.WriteAt(segmentData, int64(uint64(orbisElf.WrittenBytes)))
+	_, err = orbisElf.output.WriteAt(segmentData, int64(uint64(orbisElf.WrittenBytes)))
 	return err
 }
 
@@ -518,10 +568,19 @@ func writeNIDTable(orbisElf *OrbisElf, segmentData *[]byte) (uint64, error) {
 
 	// Iterate the symbol table of the input ELF to generate entries. We don't need to check err here because we've already
 	// checked it before we reach this point.
-	symbols, _ := orbisElf.ElfToConvert.DynamicSymbols()
+	symbols, _ := orbisElf.getDynamicSymbols()
 	libraries := orbisElf.LibrarySymbolDictionary.Keys()
 	modules := orbisElf.ModuleList
 
+	// Ids start at 1, as 0 is the module itself
+	if len(libraries) > _maxImportId {
+		return 0, fmt.Errorf("too many imported libraries (%d), at most %d are supported", len(libraries), _maxImportId)
+	}
+
+	if len(modules) > _maxImportId {
+		return 0, fmt.Errorf("too many imported modules (%d), at most %d are supported", len(modules), _maxImportId)
+	}
+
 	// Get libc index for Need_sceLibc
 	libcModuleIndex := -1
 
@@ -532,6 +591,24 @@ func writeNIDTable(orbisElf *OrbisElf, segmentData *[]byte) (uint64, error) {
 		}
 	}
 
+	// Index libraries and modules by name, the first entry wins as in the tables that are written
+	libraryIndices := make(map[string]int)
+	moduleIndices := make(map[string]int)
+
+	for idx, library := range libraries {
+		if _, ok := libraryIndices[library.(string)]; !ok {
+			libraryIndices[library.(string)] = idx
+		}
+	}
+
+	for idx, module := range modules {
+		if _, ok := moduleIndices[module]; !ok {
+			moduleIndices[module] = idx
+		}
+	}
+
+	_nidEntryOffsets = nil
+
 	// Each symbol might need an NID entry
 	for _, symbol := range symbols {
 		symbolLibraryIndex := -1
@@ -545,27 +622,18 @@ func writeNIDTable(orbisElf *OrbisElf, segmentData *[]byte) (uint64, error) {
 			continue
 		}
 
-		for idx, library := range libraries {
-			libName := library.(string)
-			libSyms := orbisElf.LibrarySymbolDictionary.Get(libName).([]string)
-			if contains(libSyms, symbol.Name) {
-				libraryName = libName
-				symbolLibraryIndex = idx
-				break
-			}
+		if libName, ok := orbisElf.ImportLibraries[symbol.Name]; ok {
+			libraryName = libName
+			symbolLibraryIndex = libraryIndices[libName]
 		}
 
-
 		if symbolLibraryIndex < 0 {
 			return 0, errors.New(fmt.Sprintf("missing library for symbol (%s)", symbol.Name))
 		}
 
 		moduleName = orbisElf.LibraryModuleDictionary.Get(libraryName).(string)
-		for idx, module := range modules {
-			if moduleName == module {
-				symbolModuleIndex = idx
-				break
-			}
+		if idx, ok := moduleIndices[moduleName]; ok {
+			symbolModuleIndex = idx
 		}
 
 		if symbolModuleIndex < 0 {
@@ -576,34 +644,33 @@ func writeNIDTable(orbisElf *OrbisElf, segmentData *[]byte) (uint64, error) {
 		// fmt.Printf("[%s;] %s: %d %s: %d \n", symbol.Name, moduleName, symbolModuleIndex, libraryName, symbolLibraryIndex)
 
 		// Build the NID and insert it into the table
+		_nidEntryOffsets = append(_nidEntryOffsets, uint64(nidTableBuff.Len()))
 		nidTableBuff.WriteString(buildNIDEntry(symbol.Name, 1+symbolLibraryIndex, 1+symbolModuleIndex))
 	}
 
 	if libcModuleIndex >= 0 {
 		// Add an additional symbol for Need_sceLibc
+		_nidEntryOffsets = append(_nidEntryOffsets, uint64(nidTableBuff.Len()))
 		nidTableBuff.WriteString(buildNIDEntry("Need_sceLibc", 1+libcModuleIndex, 1+libcModuleIndex))
 	}
 
 	// Add exported symbols for libraries
-	if orbisElf.IsLibrary {
-		moduleSymbols, _ := orbisElf.ElfToConvert.Symbols()
-		moduleId := 0
+	moduleId := 0
 
-		for _, symbol := range moduleSymbols {
-			// Only export global symbols that we have values for
-			if ((symbol.Info>>4&0xf) == uint8(elf.STB_GLOBAL) || (symbol.Info>>4&0xf) == uint8(elf.STB_WEAK)) && symbol.Value != 0 {
-				nidTableBuff.WriteString(buildNIDEntry(symbol.Name, moduleId, moduleId))
-			}
-		}
+	for _, symbol := range orbisElf.ExportedSymbols {
+		_nidEntryOffsets = append(_nidEntryOffsets, uint64(nidTableBuff.Len()))
+		nidTableBuff.WriteString(buildNIDEntry(symbol.Name, moduleId, moduleId))
 	}
 
+	_nidEntryOffsets = append(_nidEntryOffsets, uint64(nidTableBuff.Len()))
+
 	// Commit to segment data
 	*segmentData = append(*segmentData, nidTableBuff.Bytes()...)
 	return uint64(len(nidTableBuff.Bytes())), nil
 }
 
 // buildNIDEntry is a helper function that takes a symbolName and moduleId to construct an NID entry for the string table.
-// Currently assumes module (and thus library) ID will always be < 26.
+// Library and module IDs must be at most _maxImportId.
 // Currently matches library ID to module ID.
 // Returns the final constructed string of the NID entry.
 func buildNIDEntry(symbolName string, libraryId int, moduleId int) string {
@@ -619,13 +686,22 @@ func buildNIDEntry(symbolName string, libraryId int, moduleId int) string {
 	}
 
 	// Format: [NID Hash] + '#' + [Library Index] + "#" + [Module Index]
-	libraryIdChar := string(_indexEncodingTable[libraryId])
-	moduleIdChar := string(_indexEncodingTable[moduleId])
-
-	nid += "#" + libraryIdChar + "#" + moduleIdChar + "\x00"
+	nid += "#" + encodeNIDIndex(libraryId) + "#" + encodeNIDIndex(moduleId) + "\x00"
 	return nid
 }
 
+// encodeNIDIndex takes a given library or module id and encodes it for an NID entry. Ids are encoded in base 64 using
+// _indexEncodingTable, most significant digit first, so ids below 64 take a single character. Returns the encoded id.
+func encodeNIDIndex(id int) string {
+	encoded := string(_indexEncodingTable[id%64])
+
+	for id /= 64; id > 0; id /= 64 {
+		encoded = string(_indexEncodingTable[id%64]) + encoded
+	}
+
+	return encoded
+}
+
 // calculateNID is a helper function that takes a symbolName and calculates the NID hash using a sha1 of the symbol name
 // with the suffix key appended to it. Returns the string of the NID hash base64'd.
 func calculateNID(symbolName string) string {
@@ -669,22 +745,29 @@ func writeSymbolTable(orbisElf *OrbisElf, segmentData *[]byte) uint64 {
 		Info: uint8(elf.STT_SECTION),
 	})
 
+	_symbolIndexMap = make(map[uint32]uint32)
+	_symbolTableNames = []string{"", ""}
+
 	// Add external symbol entries
 	numSymbols := 0
 	numExportedSymbols := 0
-	symbols, _ := orbisElf.ElfToConvert.DynamicSymbols()
+	symbols, _ := orbisElf.getDynamicSymbols()
 
-	for _, symbol := range symbols {
+	for i, symbol := range symbols {
 
 		// Skip symbols that have a valid section index - they're defined in the ELF and are not external
 		if symbol.Section != elf.SHN_UNDEF {
 			continue
 		}
 
+		// Defined symbols are left out, so imports don't keep their input index. debug/elf leaves out the null symbol.
+		_symbolIndexMap[uint32(i+1)] = uint32(len(_symbolTableNames))
+		_symbolTableNames = append(_symbolTableNames, symbol.Name)
+
 		if symbol.Name != "" {
 			_ = binary.Write(symbolTableBuff, binary.LittleEndian, elf.Sym64{
-				Name: uint32(_offsetOfNidTable + uint64(numSymbols*0x10)),
-				Info: symbol.Info,
+				Name: uint32(_offsetOfNidTable + _nidEntryOffsets[numSymbols]),
+				Info: orbisElf.getImportSymbolInfo(symbol),
 			})
 
 			numSymbols++ // should it go outside?
@@ -712,8 +795,9 @@ func writeSymbolTable(orbisElf *OrbisElf, segmentData *[]byte) uint64 {
 		_needSceLibcIndex = numSymbols
 
 		// Add Need_sceLibc entry
+		_symbolTableNames = append(_symbolTableNames, "Need_sceLibc")
 		_ = binary.Write(symbolTableBuff, binary.LittleEndian, elf.Sym64{
-			Name: uint32(_offsetOfNidTable + uint64((_needSceLibcIndex)*0x10)),
+			Name: uint32(_offsetOfNidTable + _nidEntryOffsets[_needSceLibcIndex]),
 			Info: (uint8(elf.STB_GLOBAL) << 4) | uint8(elf.STT_OBJECT),
 		})
 
@@ -721,39 +805,34 @@ func writeSymbolTable(orbisElf *OrbisElf, segmentData *[]byte) uint64 {
 	}
 
 	// Add exported symbols for libraries
-	if orbisElf.IsLibrary {
-		moduleSymbols, _ := orbisElf.ElfToConvert.Symbols()
-
-		for _, symbol := range moduleSymbols {
-			// Only export global symbols that we have values for
-			if ((symbol.Info>>4&0xf) == uint8(elf.STB_GLOBAL) || (symbol.Info>>4&0xf) == uint8(elf.STB_WEAK)) && symbol.Value != 0 {
-				_ = binary.Write(symbolTableBuff, binary.LittleEndian, elf.Sym64{
-					Name:  uint32(_offsetOfNidTable + uint64(numSymbols*0x10)),
-					Info:  symbol.Info,
-					Other: symbol.Other,
-					Value: symbol.Value,
-					Size:  symbol.Size,
-					Shndx: uint16(symbol.Section),
-				})
-
-				numSymbols++
-				numExportedSymbols++
-			}
-		}
+	for _, symbol := range orbisElf.ExportedSymbols {
+		_symbolTableNames = append(_symbolTableNames, symbol.Name)
+		_ = binary.Write(symbolTableBuff, binary.LittleEndian, elf.Sym64{
+			Name:  uint32(_offsetOfNidTable + _nidEntryOffsets[numSymbols]),
+			Info:  symbol.Info,
+			Other: symbol.Other,
+			Value: symbol.Value,
+			Size:  symbol.Size,
+			Shndx: uint16(symbol.Section),
+		})
+
+		numSymbols++
+		numExportedSymbols++
 	}
 
-	// Add module weak symbols (libraries only)
+	// Add module weak symbols (libraries only), their names follow the NID table
 	if orbisElf.IsLibrary {
-		moduleStopOffset := (numSymbols) * 0x10
-		moduleStartOffset := moduleStopOffset + len("module_stop"+"\x00")
+		moduleStopOffset := _nidEntryOffsets[numSymbols]
+		moduleStartOffset := moduleStopOffset + uint64(len("module_stop"+"\x00"))
+		_symbolTableNames = append(_symbolTableNames, "module_stop", "module_start")
 
 		_ = binary.Write(symbolTableBuff, binary.LittleEndian, elf.Sym64{
-			Name: uint32(_offsetOfNidTable + uint64(moduleStopOffset)),
+			Name: uint32(_offsetOfNidTable + moduleStopOffset),
 			Info: uint8(elf.STB_WEAK) << 4,
 		})
 
 		_ = binary.Write(symbolTableBuff, binary.LittleEndian, elf.Sym64{
-			Name: uint32(_offsetOfNidTable + uint64(moduleStartOffset)),
+			Name: uint32(_offsetOfNidTable + moduleStartOffset),
 			Info: uint8(elf.STB_WEAK) << 4,
 		})
 
@@ -768,56 +847,83 @@ func writeSymbolTable(orbisElf *OrbisElf, segmentData *[]byte) uint64 {
 	return sizeOfTable
 }
 
-// writeRelocationTable uses the input ELF's Procedure Linkage Table (PLT) as well as .data.rel.ro and .sce_process_param
-// to write a table of relocation / rela entries to segmentData. Returns the number of bytes written.
-func writeRelocationTable(orbisElf *OrbisElf, segmentData *[]byte) uint64 {
-	relocationTableBuff := new(bytes.Buffer)
+// getImportSymbolInfo takes the given undefined symbol of the input ELF and builds the info (binding and type) of its SCE
+// symbol table entry. The type is taken from the stub library's definition, as that's what the import is resolved to,
+// and a warning is recorded if the input disagrees with it. Weak imports are always STB_WEAK. Returns the symbol info.
+func (orbisElf *OrbisElf) getImportSymbolInfo(symbol elf.Symbol) uint8 {
+	symbolBind := elf.ST_BIND(symbol.Info)
+	symbolType := elf.ST_TYPE(symbol.Info)
+
+	if stubSymbol, ok := orbisElf.StubSymbols[symbol.Name]; ok {
+		libraryName, _ := orbisElf.getImportModule(symbol.Name)
+		stubBind := elf.ST_BIND(stubSymbol.Info)
+		stubType := elf.ST_TYPE(stubSymbol.Info)
+
+		if stubBind == elf.STB_LOCAL {
+			orbisElf.warn("import '%s' is local to its stub library %s, it may not be exported", symbol.Name,
+				libraryName)
+		}
 
-	// Get the old relocation procedure linkage table
-	if oldRelaPltTableSection := orbisElf.ElfToConvert.Section(".rela.plt"); oldRelaPltTableSection != nil {
-		oldRelaPltTableData, err := oldRelaPltTableSection.Data()
+		// An untyped reference takes the stub's type silently, anything else has to agree with it
+		if stubType != elf.STT_NOTYPE && stubType != symbolType {
+			if symbolType != elf.STT_NOTYPE {
+				orbisElf.warn("import '%s' is %s in the input elf, but %s in its stub library %s, using %s",
+					symbol.Name, symbolType, stubType, libraryName, stubType)
+			}
 
-		if err != nil {
-			return 0
+			symbolType = stubType
 		}
+	}
 
-		// Add entries from the old relocation PLT table - jump slots / PLT entries
-		for len(oldRelaPltTableData) > 0 {
-			rOffset := orbisElf.ElfToConvert.ByteOrder.Uint64(oldRelaPltTableData[0x0:0x8])
-			rInfo := orbisElf.ElfToConvert.ByteOrder.Uint64(oldRelaPltTableData[0x8:0x10])
-			rAddend := orbisElf.ElfToConvert.ByteOrder.Uint64(oldRelaPltTableData[0x10:0x18])
+	// Weak imports are allowed to stay unresolved, which the loader needs for imports from optional modules
+	if orbisElf.isWeakImport(symbol) {
+		symbolBind = elf.STB_WEAK
+	}
 
-			oldRelaPltTableData = oldRelaPltTableData[0x18:]
+	return elf.ST_INFO(symbolBind, symbolType)
+}
 
-			_ = binary.Write(relocationTableBuff, binary.LittleEndian, elf.Rela64{
-				Off:    rOffset,
-				Info:   rInfo + (1 << 32), // Add one to the symbol index to account for STT_SECTION
-				Addend: int64(rAddend),
-			})
-		}
+// writeRelocationTable uses the input ELF's jump table (DT_JMPREL) and relocation table (DT_RELA) as well as
+// .sce_process_param to write a table of relocation / rela entries to segmentData. Each relocation is translated for the SCE loader. The
+// jump table keeps its count and order, since PLT stubs refer to its entries by index, so jump slots that were rewritten
+// (ie. for locally defined functions) stay where they were. Returns the number of bytes written for the jump table and
+// for the whole table, or an error naming a relocation that can't be translated.
+func writeRelocationTable(orbisElf *OrbisElf, segmentData *[]byte) (uint64, uint64, error) {
+	jumpTableBuff := new(bytes.Buffer)
+	relocationTableBuff := new(bytes.Buffer)
+
+	symbols, err := orbisElf.getDynamicSymbols()
+	if err != nil {
+		return 0, 0, err
 	}
 
-	// Get the old relocation dynamic table
-	if oldRelaDynTableSection := orbisElf.ElfToConvert.Section(".rela.dyn"); oldRelaDynTableSection != nil {
-		oldRelaDynTableData, err := oldRelaDynTableSection.Data()
+	// Jump slots / PLT entries come from the old relocation PLT table, relative entries from the old dynamic table
+	relocationTables, err := orbisElf.getRelocationTables()
+	if err != nil {
+		return 0, 0, err
+	}
 
+	for _, relocationTable := range relocationTables {
+		relocations, err := orbisElf.readRelocations(relocationTable)
 		if err != nil {
-			return 0
+			return 0, 0, err
 		}
 
-		// Add entries from the old relocation dynamic table - relative entries
-		for len(oldRelaDynTableData) > 0 {
-			rOffset := orbisElf.ElfToConvert.ByteOrder.Uint64(oldRelaDynTableData[0x0:0x8])
-			rInfo := orbisElf.ElfToConvert.ByteOrder.Uint64(oldRelaDynTableData[0x8:0x10])
-			rAddend := orbisElf.ElfToConvert.ByteOrder.Uint64(oldRelaDynTableData[0x10:0x18])
+		for _, relocation := range relocations {
+			translated, err := orbisElf.translateRelocation(relocation, symbols)
+			if err != nil {
+				return 0, 0, err
+			}
 
-			oldRelaDynTableData = oldRelaDynTableData[0x18:]
+			if translated == nil {
+				continue
+			}
 
-			_ = binary.Write(relocationTableBuff, binary.LittleEndian, elf.Rela64{
-				Off:    rOffset,
-				Info:   rInfo + (1 << 32), // Add one to the symbol index to account for STT_SECTION
-				Addend: int64(rAddend),
-			})
+			if relocationTable.IsJumpTable {
+				_ = binary.Write(jumpTableBuff, binary.LittleEndian, translated)
+			} else {
+				_ = binary.Write(relocationTableBuff, binary.LittleEndian, translated)
+			}
 		}
 	}
 
@@ -837,8 +943,9 @@ func writeRelocationTable(orbisElf *OrbisElf, segmentData *[]byte) uint64 {
 	}
 
 	// Commit to segment data
+	*segmentData = append(*segmentData, jumpTableBuff.Bytes()...)
 	*segmentData = append(*segmentData, relocationTableBuff.Bytes()...)
-	return uint64(len(relocationTableBuff.Bytes()))
+	return uint64(jumpTableBuff.Len()), uint64(jumpTableBuff.Len() + relocationTableBuff.Len()), nil
 }
 
 // writeHashTable uses numHashEntries which was set when constructing the symbol table to write the hash table to
@@ -989,11 +1096,16 @@ func writeDynamicTable(orbisElf *OrbisElf, tableOffsets *TableOffsets, segmentDa
 		writeDynamicEntry(dynamicTableBuff, uint64(elf.DT_NEEDED), libraryOffset)
 	}
 
-	// Imported modules
+	// Imported modules, optional ones are marked by their attributes
 	for i, moduleOffset := range _importedModuleOffsets {
 		moduleId := uint16(1 + i)
 		moduleValue := makeModuleTagValue(uint32(moduleOffset), 1, 1, moduleId)
 		writeDynamicEntry(dynamicTableBuff, DT_SCE_IMPORT_MODULE, moduleValue)
+
+		if orbisElf.OptionalModules[orbisElf.ModuleList[i]] {
+			moduleAttr := makeModuleAttrTagValue(SCE_MODULE_ATTR_WEAK_IMPORT, moduleId)
+			writeDynamicEntry(dynamicTableBuff, DT_SCE_MODULE_ATTR, moduleAttr)
+		}
 	}
 
 	// Exported library (libraries only)
@@ -1006,10 +1118,16 @@ func writeDynamicTable(orbisElf *OrbisElf, tableOffsets *TableOffsets, segmentDa
 	}
 
 	// Imported libraries
+	libraries := orbisElf.LibrarySymbolDictionary.Keys()
+
 	for i, libraryOffset := range _importedLibraryOffsets {
 		libraryId := uint16(1 + i)
 		libraryValue := makeLibTagValue(uint32(libraryOffset), 1, libraryId)
-		libraryAttr := makeLibAttrTagValue(0x9, libraryId)
+		libraryAttr := makeLibAttrTagValue(SCE_LIB_ATTR_IMPORT, libraryId)
+
+		if i < len(libraries) && orbisElf.isOptionalLibrary(libraries[i].(string)) {
+			libraryAttr = makeLibAttrTagValue(SCE_LIB_ATTR_IMPORT|SCE_LIB_ATTR_WEAK_IMPORT, libraryId)
+		}
 
 		writeDynamicEntry(dynamicTableBuff, DT_SCE_IMPORT_LIB, libraryValue)
 		writeDynamicEntry(dynamicTableBuff, DT_SCE_IMPORT_LIB_ATTR, libraryAttr)
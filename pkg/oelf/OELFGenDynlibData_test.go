@@ -0,0 +1,237 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodeNIDIndex(t *testing.T) {
+	tests := []struct {
+		id      int
+		encoded string
+	}{
+		{0, "A"},
+		{1, "B"},
+		{25, "Z"},
+		{26, "a"},
+		{52, "0"},
+		{62, "+"},
+		{63, "-"},
+		{64, "BA"},
+		{65, "BB"},
+		{127, "B-"},
+		{128, "CA"},
+		{4095, "--"},
+		{4096, "BAA"},
+		{_maxImportId, "P--"},
+	}
+
+	for _, test := range tests {
+		if encoded := encodeNIDIndex(test.id); encoded != test.encoded {
+			t.Errorf("encodeNIDIndex(%d) = %q, want %q", test.id, encoded, test.encoded)
+		}
+	}
+}
+
+func TestBuildNIDEntry(t *testing.T) {
+	tests := []struct {
+		symbolName string
+		libraryId  int
+		moduleId   int
+		entry      string
+	}{
+		{"__PS4_NID_abc_plusdef_minus", 0, 0, "abc+def-#A#A\x00"},
+		{"__PS4_NID_abc", 64, 0xFFFF, "abc#BA#P--\x00"},
+		{"printf", 1, 1, calculateNID("printf") + "#B#B\x00"},
+	}
+
+	for _, test := range tests {
+		if entry := buildNIDEntry(test.symbolName, test.libraryId, test.moduleId); entry != test.entry {
+			t.Errorf("buildNIDEntry(%q, %d, %d) = %q, want %q", test.symbolName, test.libraryId, test.moduleId, entry,
+				test.entry)
+		}
+	}
+}
+
+// readTestString returns the null-terminated string at the given offset of the given string table.
+func readTestString(stringTable []byte, offset uint32) string {
+	if int(offset) >= len(stringTable) {
+		return ""
+	}
+
+	end := bytes.IndexByte(stringTable[offset:], 0)
+
+	if end < 0 {
+		return string(stringTable[offset:])
+	}
+
+	return string(stringTable[offset : offset+uint32(end)])
+}
+
+func TestWriteSymbolTableNamesPointAtTheirNID(t *testing.T) {
+	// Library and module ids of 64 and up take two characters, so their NID entries are longer than the others
+	sdkPath, inputElf := writeTestStubLibraries(t, 70, 2)
+
+	orbisElf := &OrbisElf{ElfToConvert: inputElf, IsLibrary: true}
+
+	if err := orbisElf.GenerateLibrarySymbolDictionary(sdkPath, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var stringTable, symbolTable []byte
+
+	if _, err := writeStringTable(orbisElf, "test", "", orbisElf.ModuleList, orbisElf.LibrarySymbolDictionary,
+		&stringTable); err != nil {
+		t.Fatal(err)
+	}
+
+	writeSymbolTable(orbisElf, &symbolTable)
+
+	symbols := make([]elf.Sym64, len(symbolTable)/0x18)
+	_ = binary.Read(bytes.NewReader(symbolTable), binary.LittleEndian, symbols)
+
+	if len(symbols) != len(_symbolTableNames) || len(symbols) != 2+70*2+2 {
+		t.Fatalf("got %d symbols (%d names), want %d", len(symbols), len(_symbolTableNames), 2+70*2+2)
+	}
+
+	for i, symbol := range symbols[2:] {
+		name := _symbolTableNames[2+i]
+		entry := readTestString(stringTable, symbol.Name)
+
+		// module_stop and module_start are named as is
+		if name == "module_stop" || name == "module_start" {
+			if entry != name {
+				t.Errorf("%s points at %q", name, entry)
+			}
+
+			continue
+		}
+
+		if !strings.HasPrefix(entry, calculateNID(name)+"#") || stringTable[symbol.Name-1] != 0 {
+			t.Errorf("%s points at %q, want its NID entry %s#...", name, entry, calculateNID(name))
+		}
+	}
+}
+
+// _benchmarkLibraryCount and _benchmarkImportsPerLibrary set the size of the synthetic input used by
+// BenchmarkGenerateLibrarySymbolDictionary, which is about the size of a large homebrew port.
+const (
+	_benchmarkLibraryCount      = 20
+	_benchmarkImportsPerLibrary = 2000
+)
+
+// buildTestSymbolELF builds an ELF whose .symtab and .dynsym hold the given symbols, and whose dynamic table lists the given
+// libraries as DT_NEEDED. Symbols are defined if defined is set, undefined otherwise. Returns the ELF data.
+func buildTestSymbolELF(elfType elf.Type, symbolNames []string, defined bool, neededLibraries []string) []byte {
+	symbolStrings, symbolNameOffsets := encodeStringTable(symbolNames)
+	symbols := make([]elf.Sym64, len(symbolNames))
+
+	for i := range symbolNames {
+		symbols[i] = elf.Sym64{Name: symbolNameOffsets[i], Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)}
+
+		if defined {
+			symbols[i].Shndx = 1
+		}
+	}
+
+	dynamicStrings, libraryNameOffsets := encodeStringTable(neededLibraries)
+	dynamicEntries := make([]elf.Dyn64, len(neededLibraries))
+
+	for i := range neededLibraries {
+		dynamicEntries[i] = elf.Dyn64{Tag: int64(elf.DT_NEEDED), Val: uint64(libraryNameOffsets[i])}
+	}
+
+	return buildTestELF(elfType, nil, []testSection{
+		{Name: ".symtab", Type: elf.SHT_SYMTAB, Data: encodeSymbols(symbols), Link: 2, Info: 1, Entsize: 0x18},
+		{Name: ".strtab", Type: elf.SHT_STRTAB, Data: symbolStrings},
+		{Name: ".dynamic", Type: elf.SHT_DYNAMIC, Data: encodeDynamicTable(dynamicEntries), Link: 4, Entsize: 0x10},
+		{Name: ".dynstr", Type: elf.SHT_STRTAB, Data: dynamicStrings},
+		{Name: ".dynsym", Type: elf.SHT_DYNSYM, Data: encodeSymbols(symbols), Link: 2, Info: 1, Entsize: 0x18},
+	})
+}
+
+// writeTestStubLibraries writes the given number of stub libraries to the lib directory of a new toolchain directory,
+// each defining importsPerLibrary functions. Returns the toolchain directory, and an input ELF that imports every
+// function of every stub.
+func writeTestStubLibraries(tb testing.TB, libraryCount int, importsPerLibrary int) (string, *elf.File) {
+	tb.Helper()
+
+	sdkPath := tb.TempDir()
+	libDir := filepath.Join(sdkPath, "lib")
+
+	if err := os.MkdirAll(libDir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+
+	var libraries []string
+	var imports []string
+
+	for i := 0; i < libraryCount; i++ {
+		library := fmt.Sprintf("libSceBench%d.so", i)
+
+		if i == 0 {
+			library = "libkernel.so"
+		}
+
+		var librarySymbols []string
+
+		for j := 0; j < importsPerLibrary; j++ {
+			librarySymbols = append(librarySymbols, fmt.Sprintf("sceBench%dFunction%d", i, j))
+		}
+
+		stubData := buildTestSymbolELF(elf.ET_DYN, librarySymbols, true, nil)
+
+		if err := ioutil.WriteFile(filepath.Join(libDir, library), stubData, 0644); err != nil {
+			tb.Fatal(err)
+		}
+
+		libraries = append(libraries, library)
+		imports = append(imports, librarySymbols...)
+	}
+
+	return sdkPath, parseTestELF(tb, buildTestSymbolELF(elf.ET_DYN, imports, false, libraries))
+}
+
+func BenchmarkGenerateLibrarySymbolDictionary(b *testing.B) {
+	sdkPath, inputElf := writeTestStubLibraries(b, _benchmarkLibraryCount, _benchmarkImportsPerLibrary)
+
+	stubCache, err := OpenStubCache(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, benchmark := range []struct {
+		name      string
+		stubCache *StubCache
+	}{
+		{"NoCache", nil},
+		{"StubCache", stubCache},
+	} {
+		b.Run(benchmark.name, func(b *testing.B) {
+			// The first run fills the cache, so only cache hits are measured
+			for i := -1; i < b.N; i++ {
+				if i == 0 {
+					b.ResetTimer()
+				}
+
+				orbisElf := &OrbisElf{ElfToConvert: inputElf, StubCache: benchmark.stubCache}
+
+				if err := orbisElf.GenerateLibrarySymbolDictionary(sdkPath, ""); err != nil {
+					b.Fatal(err)
+				}
+
+				if len(orbisElf.ImportLibraries) != _benchmarkLibraryCount*_benchmarkImportsPerLibrary {
+					b.Fatalf("resolved %d imports, want %d", len(orbisElf.ImportLibraries),
+						_benchmarkLibraryCount*_benchmarkImportsPerLibrary)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"debug/elf"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math"
 	"sort"
 	"strings"
@@ -19,47 +21,101 @@ func getFirstRwDataSection(e *elf.File) *elf.Section {
 	}
 	return nil
 }
-func getLastRwDataSection(e *elf.File) *elf.Section {
-	for i := len(e.Sections) - 1; i >= 0; i-- {
-		s := e.Sections[i]
-		if strings.HasPrefix(s.Name, ".data") && s.Name != ".data.rel.ro" {
-			return s
+
+// getDataSectionsExtent takes the given first `.data` section and finds the extent of all the allocated, writable
+// sections from there on, which make up the data segment. This includes every NOBITS section (`.bss.*`, `COMMON`, or
+// anything placed after `.bss`), except for `.tbss`, which only takes up space in the TLS template. Returns the file
+// size and the memory size of the data segment.
+func getDataSectionsExtent(e *elf.File, firstDataSection *elf.Section) (uint64, uint64) {
+	fileEnd := firstDataSection.Offset
+	memEnd := firstDataSection.Addr
+
+	for _, s := range e.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Flags&elf.SHF_WRITE == 0 || s.Addr < firstDataSection.Addr {
+			continue
 		}
+
+		if s.Type == elf.SHT_NOBITS {
+			if s.Flags&elf.SHF_TLS != 0 {
+				continue
+			}
+		} else {
+			fileEnd = maxUint64(fileEnd, s.Offset+s.Size)
+		}
+
+		memEnd = maxUint64(memEnd, s.Addr+s.Size)
 	}
-	return nil
+
+	return fileEnd - firstDataSection.Offset, memEnd - firstDataSection.Addr
 }
 
-// GenerateProgramHeaders parses the input ELF's section header table to generate updated program headers.
-// Returns nil.
+// GenerateProgramHeaders parses the input ELF's section header table to generate updated program headers. Any number of
+// executable and writable PT_LOAD segments are merged into one code and one data segment, and read-only PT_LOAD segments
+// are merged into the code segment or kept on their own. Returns an error if the segments can't be mapped, nil otherwise.
 func (orbisElf *OrbisElf) GenerateProgramHeaders() error {
+	// The layout is worked out from sections, unlike the dynlib data, which only needs the dynamic table
+	if len(orbisElf.ElfToConvert.Sections) == 0 {
+		return errors.New("input elf has no section headers, which are needed to lay out its segments")
+	}
+
 	// Get all the necessary sections first
 	// TODO: Verify these sections exist in OrbisElf.ValidateInputELF()
 	textSection := orbisElf.ElfToConvert.Section(".text")
 	relroSection := orbisElf.ElfToConvert.Section(".data.rel.ro")
 	procParamSection := orbisElf.ElfToConvert.Section(".data.sce_process_param")
-	bssSection := orbisElf.ElfToConvert.Section(".bss")
 
-	firstDataSection := getFirstRwDataSection(orbisElf.ElfToConvert)
-	lastDataSection := getLastRwDataSection(orbisElf.ElfToConvert)
-	allDataFilesz := (lastDataSection.Offset - firstDataSection.Offset) + lastDataSection.Size
-	allDataMemsz := (lastDataSection.Addr - firstDataSection.Addr) + lastDataSection.Size
-
-	if bssSection != nil {
-		allDataMemsz += align(bssSection.Size, 16);
-	}
 	if orbisElf.IsLibrary {
 		procParamSection = orbisElf.ElfToConvert.Section(".data.sce_module_param")
 	}
 
+	firstDataSection := getFirstRwDataSection(orbisElf.ElfToConvert)
+
+	if procParamSection == nil || firstDataSection == nil {
+		return errors.New("input elf has no .data.sce_process_param or .data.sce_module_param section")
+	}
+
+	allDataFilesz, allDataMemsz := getDataSectionsExtent(orbisElf.ElfToConvert, firstDataSection)
+
 	// Get GNU_RELRO header pre-emptively (we'll need to check it to eliminate duplicate PT_LOAD headers)
 	gnuRelroSegment := orbisElf.getProgramHeader(elf.PT_GNU_RELRO, elf.PF_R)
-	relroAlignedMemsz := align(gnuRelroSegment.Memsz, 0x4000);
+	relroAlignedMemsz := uint64(0)
+
+	if gnuRelroSegment != nil {
+		relroAlignedMemsz = align(gnuRelroSegment.Memsz, 0x4000)
+	}
+
+	// The data segment must contain SCE specific data and any read-write `.data` sections
+	codeSegments := make([]*elf.Prog, 0)
+	readOnlySegments := make([]*elf.Prog, 0)
+	dataSegments := []*elf.Prog{
+		{
+			ProgHeader: elf.ProgHeader{
+				Type:   elf.PT_LOAD,
+				Flags:  elf.PF_R | elf.PF_W,
+				Off:    firstDataSection.Offset,
+				Vaddr:  firstDataSection.Addr,
+				Filesz: allDataFilesz,
+				Memsz:  allDataMemsz,
+			},
+		},
+	}
 
 	// First pass: drop program headers that we don't need and copy all others
 	for _, progHeader := range orbisElf.ElfToConvert.Progs {
-		// PT_LOAD read-only should be consolidated into PT_LOAD for .text
-		if progHeader.Type == elf.PT_LOAD && progHeader.Flags == elf.PF_R {
-			continue
+		loadKind := loadSegmentReadOnly
+
+		if progHeader.Type == elf.PT_LOAD {
+			var err error
+
+			if loadKind, err = getLoadSegmentKind(progHeader); err != nil {
+				return err
+			}
+
+			// PT_LOAD read-only should be consolidated into PT_LOAD for .text, which is checked once it's been expanded
+			if loadKind == loadSegmentReadOnly {
+				readOnlySegments = append(readOnlySegments, progHeader)
+				continue
+			}
 		}
 
 		// PT_LOAD for relro will be handled by SCE_RELRO, we can get rid of it
@@ -82,6 +138,23 @@ func (orbisElf *OrbisElf) GenerateProgramHeaders() error {
 			}
 		}
 
+		// Code and data PT_LOADs are merged once they've all been found
+		if progHeader.Type == elf.PT_LOAD {
+			if loadKind == loadSegmentCode {
+				codeSegments = append(codeSegments, progHeader)
+				continue
+			}
+
+			// Only extra read-write regions need to be merged, the one holding `.data` is already covered
+			dataSegment := clipDataSegment(progHeader, gnuRelroSegment, firstDataSection.Addr)
+
+			if dataSegment != nil && !segmentsOverlap(dataSegment, dataSegments[0]) {
+				dataSegments = append(dataSegments, dataSegment)
+			}
+
+			continue
+		}
+
 		// GNU_RELRO will sometimes get generated even if no .data.rel.ro is present. This is bad for PS4 because the
 		// header will be unaligned and it's not necessary. Get rid of it if there's no relro section.
 		if progHeader.Type == elf.PT_GNU_RELRO && relroSection == nil {
@@ -97,6 +170,85 @@ func (orbisElf *OrbisElf) GenerateProgramHeaders() error {
 		orbisElf.ProgramHeaders = append(orbisElf.ProgramHeaders, progHeader)
 	}
 
+	// The PS4 expects one code and one data segment, so merge them if there's more
+	codeSegment, err := mergeLoadSegments("executable", elf.PF_R|elf.PF_X, codeSegments)
+	if err != nil {
+		return err
+	}
+
+	dataSegment, err := mergeLoadSegments("writable", elf.PF_R|elf.PF_W, dataSegments)
+	if err != nil {
+		return err
+	}
+
+	if err := checkSegmentsDisjoint(codeSegment, dataSegment); err != nil {
+		return err
+	}
+
+	if relroSection != nil && dataSegment.Vaddr < firstDataSection.Addr {
+		return fmt.Errorf("merged data segment %s overlaps the relro segment", describeSegment(dataSegment))
+	}
+
+	if len(codeSegments) > 1 {
+		orbisElf.warn("merged %d executable PT_LOAD segments into %s", len(codeSegments), describeSegment(codeSegment))
+	}
+
+	if len(dataSegments) > 1 {
+		orbisElf.warn("merged %d writable PT_LOAD segments into %s", len(dataSegments), describeSegment(dataSegment))
+	}
+
+	if codeSegment == nil {
+		return errors.New("input elf has no executable PT_LOAD segment")
+	}
+
+	// PT_LOAD for .text will have it's size expanded to be contiguous with relro if needed. Relro doesn't always start
+	// with .data.rel.ro (ie. it's page aligned by RelayoutELF), so use PT_GNU_RELRO if there is one.
+	if relroSection != nil {
+		relroOffset := relroSection.Offset
+
+		if gnuRelroSegment != nil {
+			relroOffset = gnuRelroSegment.Off
+		}
+
+		expandedSize := relroOffset - codeSegment.Off
+		codeSegment.Filesz = expandedSize
+		codeSegment.Memsz = expandedSize
+	}
+
+	orbisElf.ProgramHeaders = append(orbisElf.ProgramHeaders, codeSegment, dataSegment)
+
+	// Read-only data is expected to be covered by the code segment. If it isn't (ie. lld places .rodata before .text),
+	// it has to be merged into the code segment or mapped on its own, otherwise it won't be loaded at all.
+	mappedSegments := []*elf.Prog{dataSegment}
+
+	if relroSection != nil && gnuRelroSegment != nil {
+		mappedSegments = append(mappedSegments, &elf.Prog{
+			ProgHeader: elf.ProgHeader{
+				Type:  PT_SCE_RELRO,
+				Flags: elf.PF_R,
+				Off:   gnuRelroSegment.Off,
+				Vaddr: gnuRelroSegment.Vaddr,
+				Memsz: firstDataSection.Addr - gnuRelroSegment.Vaddr,
+			},
+		})
+	}
+
+	for _, readOnlySegment := range readOnlySegments {
+		if segmentCovers(codeSegment, readOnlySegment) {
+			continue
+		}
+
+		separateSegment, err := orbisElf.mapReadOnlySegment(readOnlySegment, codeSegment, mappedSegments)
+		if err != nil {
+			return err
+		}
+
+		if separateSegment != nil {
+			orbisElf.ProgramHeaders = append(orbisElf.ProgramHeaders, separateSegment)
+			mappedSegments = append(mappedSegments, separateSegment)
+		}
+	}
+
 	// Second pass: modify headers as required
 	for _, progHeader := range orbisElf.ProgramHeaders {
 		// We generate a new dynamic table, so we'll need to update this header
@@ -114,37 +266,18 @@ func (orbisElf *OrbisElf) GenerateProgramHeaders() error {
 			progHeader.Type = PT_SCE_RELRO
 
 			// We need to fill the hole between the SCE_RELRO segment and the PT_LOAD segment for .data. Since
-			// .data.sce_process_param should be the first thing in the data segment, we can use this to calculate.
-			expandedSize := firstDataSection.Offset - progHeader.Off
-			progHeader.Filesz = expandedSize
-			progHeader.Memsz = expandedSize
+			// .data.sce_process_param should be the first thing in the data segment, we can use this to calculate. The
+			// hole can be larger in memory than in the file (ie. a linker script that skips a page before .data), the
+			// rest of it is zero filled.
+			progHeader.Filesz = firstDataSection.Offset - progHeader.Off
+			progHeader.Memsz = firstDataSection.Addr - progHeader.Vaddr
 			progHeader.Align = 0x4000
 		}
+	}
 
-		// PT_LOAD's must be page aligned
-		if progHeader.Type == elf.PT_LOAD {
-			if progHeader.Align != 0x4000 {
-				progHeader.Align = 0x4000
-			}
-
-			// PT_LOAD for .text will have it's size expanded to be contiguous with relro if needed
-			if progHeader.Flags == (elf.PF_R | elf.PF_X) {
-				if relroSection != nil {
-					expandedSize := relroSection.Offset - progHeader.Off
-					progHeader.Filesz = expandedSize
-					progHeader.Memsz = expandedSize
-				}
-			}
-
-			// PT_LOAD for read-write data must contain SCE specific data and any read-write `.data` sections
-			if progHeader.Flags == (elf.PF_R | elf.PF_W) {
-				progHeader.Off = firstDataSection.Offset
-				progHeader.Vaddr = firstDataSection.Addr
-				progHeader.Paddr = firstDataSection.Addr
-				progHeader.Filesz = allDataFilesz
-				progHeader.Memsz = allDataMemsz
-			}
-		}
+	// Exception frames must end up mapped, and PT_GNU_EH_FRAME must point to them for C++ exceptions to unwind
+	if err := orbisElf.planExceptionFrames(); err != nil {
+		return err
 	}
 
 	// Generate PS4-specific headers
@@ -159,7 +292,9 @@ func (orbisElf *OrbisElf) GenerateProgramHeaders() error {
 	}
 
 	sort.Sort(programHeaderList(orbisElf.ProgramHeaders))
-	return nil
+
+	// Make sure the final layout can actually be loaded before anything gets written
+	return orbisElf.validateLayout()
 }
 
 // OrbisElf.RewriteProgramHeaders iterates the list of new program headers and overwrites the ELF's program header table
@@ -195,7 +330,7 @@ func (orbisElf *OrbisElf) RewriteProgramHeaders() error {
 		}
 
 		// Overwrite the entry in the file
-		if _, err := orbisElf.FinalFile.WriteAt(progHeaderBuff.Bytes(), writeOffset); err != nil {
+		if _, err := orbisElf.output.WriteAt(progHeaderBuff.Bytes(), writeOffset); err != nil {
 			return err
 		}
 	}
@@ -311,9 +446,17 @@ func (s programHeaderList) Swap(i int, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 
-// Less uses the getProgramHeaderPriority() function to sort the list by priority.
+// Less uses the getProgramHeaderPriority() function to sort the list by priority. PT_LOADs of the same priority (ie. a
+// separate read-only PT_LOAD and the code PT_LOAD) are sorted by address.
 func (s programHeaderList) Less(i int, j int) bool {
-	return getProgramHeaderPriority(progHeaderTypeOrder, s[i].ProgHeader.Type, s[i].ProgHeader.Flags) < getProgramHeaderPriority(progHeaderTypeOrder, s[j].Type, s[j].Flags)
+	priorityI := getProgramHeaderPriority(progHeaderTypeOrder, s[i].ProgHeader.Type, s[i].ProgHeader.Flags)
+	priorityJ := getProgramHeaderPriority(progHeaderTypeOrder, s[j].Type, s[j].Flags)
+
+	if priorityI == priorityJ && s[i].Type == elf.PT_LOAD && s[j].Type == elf.PT_LOAD {
+		return s[i].Vaddr < s[j].Vaddr
+	}
+
+	return priorityI < priorityJ
 }
 
 // align takes a given int and aligns it to a given value. Returns the aligned value.
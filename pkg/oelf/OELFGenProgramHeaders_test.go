@@ -0,0 +1,223 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestLoadSegment returns a PT_LOAD with the given flags, mapping filesz bytes at the given offset to memsz bytes at
+// the given address.
+func newTestLoadSegment(flags elf.ProgFlag, off uint64, vaddr uint64, filesz uint64, memsz uint64) elf.Prog64 {
+	return elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(flags),
+		Off:    off,
+		Vaddr:  vaddr,
+		Paddr:  vaddr,
+		Filesz: filesz,
+		Memsz:  memsz,
+		Align:  0x4000,
+	}
+}
+
+// _testCodeSegment and _testDataSegment are the code and data segments of an input built by
+// generateTestProgramHeaders, with .text in the code segment, and .data.sce_process_param, .data, and .bss in the
+// data segment.
+var (
+	_testCodeSegment = newTestLoadSegment(elf.PF_R|elf.PF_X, 0x0, 0x0, 0x1000, 0x1000)
+	_testDataSegment = newTestLoadSegment(elf.PF_R|elf.PF_W, 0x4000, 0x4000, 0x100, 0x200)
+)
+
+// generateTestProgramHeaders builds an executable with the given program headers, and runs GenerateProgramHeaders on
+// it. Besides the given sections, it has .text at 0x100-0x200, and .data.sce_process_param, .data, and .bss at
+// 0x4000-0x4200. Returns the OrbisElf, and the error from GenerateProgramHeaders.
+func generateTestProgramHeaders(t *testing.T, progHeaders []elf.Prog64, sections []testSection) (*OrbisElf, error) {
+	t.Helper()
+
+	allSections := []testSection{
+		{Name: ".text", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR, Addr: 0x100, Offset: 0x100,
+			Size: 0x100},
+	}
+
+	allSections = append(allSections, sections...)
+	allSections = append(allSections,
+		testSection{Name: ".data.sce_process_param", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+			Addr: 0x4000, Offset: 0x4000, Size: 0x50},
+		testSection{Name: ".data", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE, Addr: 0x4050,
+			Offset: 0x4050, Size: 0xB0},
+		testSection{Name: ".bss", Type: elf.SHT_NOBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE, Addr: 0x4100,
+			Offset: 0x4100, Size: 0x100},
+	)
+
+	elfData := buildTestELF(elf.ET_DYN, progHeaders, allSections)
+
+	// The dynlib data isn't written, so its segment is empty
+	_offsetOfDynlibData = 0
+	_sizeOfDynlibData = 0
+
+	orbisElf := &OrbisElf{
+		ElfToConvert: parseTestELF(t, elfData),
+		output:       newOverlayFile(bytes.NewReader(elfData), int64(len(elfData))),
+	}
+
+	return orbisElf, orbisElf.GenerateProgramHeaders()
+}
+
+// describeTestSegments describes the given program headers with their file sizes, leaving out the PT_SCE_PROC_PARAM,
+// PT_SCE_DYNLIBDATA, and PT_INTERP headers every executable gets. Returns the descriptions in order.
+func describeTestSegments(progHeaders []*elf.Prog) []string {
+	descriptions := make([]string, 0)
+
+	for _, progHeader := range progHeaders {
+		switch progHeader.Type {
+		case PT_SCE_PROC_PARAM, PT_SCE_DYNLIBDATA, elf.PT_INTERP:
+			continue
+		}
+
+		descriptions = append(descriptions, fmt.Sprintf("%s filesz 0x%X", describeSegment(progHeader), progHeader.Filesz))
+	}
+
+	return descriptions
+}
+
+// programHeaderTest is a case of a GenerateProgramHeaders table test. The input has the given program headers and
+// sections (see generateTestProgramHeaders). Either the segments and warnings (see describeTestSegments), or an error
+// containing err, are expected.
+type programHeaderTest struct {
+	name        string
+	progHeaders []elf.Prog64
+	sections    []testSection
+	segments    []string
+	warnings    []string
+	err         string
+}
+
+// runProgramHeaderTests runs GenerateProgramHeaders for each of the given tests and checks the result.
+func runProgramHeaderTests(t *testing.T, tests []programHeaderTest) {
+	t.Helper()
+
+	for _, test := range tests {
+		orbisElf, err := generateTestProgramHeaders(t, test.progHeaders, test.sections)
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		if segments := describeTestSegments(orbisElf.ProgramHeaders); !reflect.DeepEqual(segments, test.segments) {
+			t.Errorf("%s: got segments %q, want %q", test.name, segments, test.segments)
+		}
+
+		if !reflect.DeepEqual(orbisElf.Warnings, test.warnings) {
+			t.Errorf("%s: got warnings %q, want %q", test.name, orbisElf.Warnings, test.warnings)
+		}
+	}
+}
+
+func TestGenerateProgramHeadersMergesSegments(t *testing.T) {
+	runProgramHeaderTests(t, []programHeaderTest{
+		{
+			name:        "one code and one data segment",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment},
+			segments: []string{
+				"PT_LOAD [R|X] 0x0-0x1000 (offset 0x0) filesz 0x1000",
+				"PT_LOAD [R|W] 0x4000-0x4200 (offset 0x4000) filesz 0x100",
+			},
+		},
+		{
+			name: "two code segments",
+			progHeaders: []elf.Prog64{_testCodeSegment, newTestLoadSegment(elf.PF_R|elf.PF_X, 0x1000, 0x1000, 0x800, 0x800),
+				_testDataSegment},
+			segments: []string{
+				"PT_LOAD [R|X] 0x0-0x1800 (offset 0x0) filesz 0x1800",
+				"PT_LOAD [R|W] 0x4000-0x4200 (offset 0x4000) filesz 0x100",
+			},
+			warnings: []string{"merged 2 executable PT_LOAD segments into PT_LOAD [R|X] 0x0-0x1800 (offset 0x0)"},
+		},
+		{
+			name: "two data segments",
+			progHeaders: []elf.Prog64{_testCodeSegment, newTestLoadSegment(elf.PF_R|elf.PF_W, 0x2000, 0x2000, 0x100, 0x100),
+				_testDataSegment},
+			sections: []testSection{
+				{Name: ".got", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE, Addr: 0x2000, Offset: 0x2000,
+					Size: 0x8},
+			},
+			segments: []string{
+				"PT_LOAD [R|X] 0x0-0x1000 (offset 0x0) filesz 0x1000",
+				"PT_LOAD [R|W] 0x2000-0x4200 (offset 0x2000) filesz 0x2100",
+			},
+			warnings: []string{"merged 2 writable PT_LOAD segments into PT_LOAD [R|W] 0x2000-0x4200 (offset 0x2000)"},
+		},
+		{
+			name: "code segments out of step",
+			progHeaders: []elf.Prog64{_testCodeSegment, newTestLoadSegment(elf.PF_R|elf.PF_X, 0x1000, 0x2000, 0x800, 0x800),
+				_testDataSegment},
+			err: "can't merge executable segments PT_LOAD [R|X] 0x0-0x1000 (offset 0x0) and PT_LOAD [R|X] 0x2000-0x2800 " +
+				"(offset 0x1000), their file offsets and addresses aren't in step",
+		},
+		{
+			name: "interleaved code and data",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment,
+				newTestLoadSegment(elf.PF_R|elf.PF_X, 0x8000, 0x8000, 0x100, 0x100)},
+			err: "merged code segment PT_LOAD [R|X] 0x0-0x8100 (offset 0x0) overlaps merged data segment PT_LOAD [R|W] " +
+				"0x4000-0x4200 (offset 0x4000)",
+		},
+		{
+			name: "writable and executable segment",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment,
+				newTestLoadSegment(elf.PF_R|elf.PF_W|elf.PF_X, 0x8000, 0x8000, 0x100, 0x100)},
+			err: "PT_LOAD [R|W|X] 0x8000-0x8100 (offset 0x8000) is both writable and executable",
+		},
+	})
+}
+
+func TestGenerateProgramHeadersSizesDataSegment(t *testing.T) {
+	codeSegment := "PT_LOAD [R|X] 0x0-0x1000 (offset 0x0) filesz 0x1000"
+
+	runProgramHeaderTests(t, []programHeaderTest{
+		{
+			name:        ".lbss after .bss",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment},
+			sections: []testSection{
+				{Name: ".lbss", Type: elf.SHT_NOBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE, Addr: 0x4200,
+					Offset: 0x4200, Size: 0x100},
+			},
+			segments: []string{codeSegment, "PT_LOAD [R|W] 0x4000-0x4300 (offset 0x4000) filesz 0x100"},
+		},
+		{
+			name:        ".ldata after .bss",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment},
+			sections: []testSection{
+				{Name: ".ldata", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE, Addr: 0x4300,
+					Offset: 0x4300, Size: 0x80},
+			},
+			segments: []string{codeSegment, "PT_LOAD [R|W] 0x4000-0x4380 (offset 0x4000) filesz 0x380"},
+		},
+		{
+			name: ".tbss",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment,
+				{Type: uint32(elf.PT_TLS), Flags: uint32(elf.PF_R), Off: 0x4200, Vaddr: 0x4200, Memsz: 0x1000, Align: 0x10}},
+			sections: []testSection{
+				{Name: ".tbss", Type: elf.SHT_NOBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE | elf.SHF_TLS, Addr: 0x4200,
+					Offset: 0x4200, Size: 0x1000},
+			},
+			segments: []string{
+				codeSegment,
+				"PT_LOAD [R|W] 0x4000-0x4200 (offset 0x4000) filesz 0x100",
+				"PT_TLS [R] 0x4200-0x5200 (offset 0x4200) filesz 0x0",
+			},
+		},
+	})
+}
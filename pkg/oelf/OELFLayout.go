@@ -0,0 +1,629 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// _layoutPageSize is the page size segments are mapped with, and the alignment they're placed at when relaying out an
+// ELF.
+const _layoutPageSize = 0x4000
+
+// LayoutRegion is a group of input ELF memory that's moved as a whole when relaying out an ELF. The code region holds
+// everything that isn't writable, the relro region holds everything covered by PT_GNU_RELRO, and the data region holds
+// the remaining writable data (including .bss).
+type LayoutRegion struct {
+	Name  string
+	Start uint64
+	End   uint64
+	Shift uint64
+}
+
+// layoutChunk is the part of an input PT_LOAD segment that falls into one region.
+type layoutChunk struct {
+	region *LayoutRegion
+	Off    uint64
+	Vaddr  uint64
+	Filesz uint64
+	Memsz  uint64
+}
+
+// Layout describes how an input ELF is relaid out. The input is read from, and the output written to, the files as it's
+// built, so neither has to be held in memory. The first error writing the output is kept in outputErr.
+type Layout struct {
+	Regions  []*LayoutRegion
+	Warnings []string
+
+	inputElf   *elf.File
+	input      io.ReaderAt
+	inputSize  uint64
+	output     io.WriterAt
+	outputSize uint64
+	outputErr  error
+	chunks     []layoutChunk
+	baseAddr   uint64
+}
+
+// RelayoutELF takes the ELF at the given input path and writes a copy of it to the given output path, where the code,
+// relro, and data segments start on their own 0x4000 aligned pages and every file offset is in step with its address.
+// Segments are only moved to a higher address if they'd share a page with the previous segment. Moving a segment
+// requires the input to be linked with --emit-relocs, so references from code can be adjusted along with dynamic
+// relocations, symbols, and the dynamic table. Returns the layout, or an error if the ELF couldn't be relaid out.
+func RelayoutELF(inputPath string, outputPath string) (*Layout, error) {
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer inputFile.Close()
+
+	inputInfo, err := inputFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	inputElf, err := elf.NewFile(inputFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if inputElf.Type != elf.ET_DYN {
+		return nil, errors.New("relaying out requires a position independent elf (-pie or -shared)")
+	}
+
+	layout, err := planLayout(inputElf, inputFile, uint64(inputInfo.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	layout.output = outputFile
+	err = layout.build()
+
+	if closeErr := outputFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	// Don't leave a partial output behind
+	if err != nil {
+		_ = os.Remove(outputPath)
+		return nil, err
+	}
+
+	return layout, nil
+}
+
+// planLayout takes the given input ELF, along with the file it's read from and its size, and splits its PT_LOAD
+// segments into the code, relro, and data regions, then decides how far each region needs to move so that no two regions
+// share a page. Returns the layout, or an error if the regions are interleaved.
+func planLayout(inputElf *elf.File, input io.ReaderAt, inputSize uint64) (*Layout, error) {
+	layout := Layout{
+		inputElf:  inputElf,
+		input:     input,
+		inputSize: inputSize,
+	}
+
+	codeRegion := &LayoutRegion{Name: "code"}
+	relroRegion := &LayoutRegion{Name: "relro"}
+	dataRegion := &LayoutRegion{Name: "data"}
+
+	relroStart, relroEnd := uint64(0), uint64(0)
+
+	for _, progHeader := range inputElf.Progs {
+		if progHeader.Type == elf.PT_GNU_RELRO {
+			relroStart, relroEnd = progHeader.Vaddr, progHeader.Vaddr+progHeader.Memsz
+		}
+	}
+
+	for _, progHeader := range inputElf.Progs {
+		if progHeader.Type != elf.PT_LOAD {
+			continue
+		}
+
+		loadKind, err := getLoadSegmentKind(progHeader)
+		if err != nil {
+			return nil, err
+		}
+
+		if loadKind != loadSegmentData {
+			layout.addChunk(codeRegion, progHeader, progHeader.Vaddr, progHeader.Vaddr+progHeader.Memsz)
+			continue
+		}
+
+		// Writable segments are split where relro ends, since relro and data might need to move separately
+		loadStart, loadEnd := progHeader.Vaddr, progHeader.Vaddr+progHeader.Memsz
+
+		if loadStart < relroStart {
+			layout.addChunk(dataRegion, progHeader, loadStart, minUint64(loadEnd, relroStart))
+		}
+
+		layout.addChunk(relroRegion, progHeader, maxUint64(loadStart, relroStart), minUint64(loadEnd, relroEnd))
+		layout.addChunk(dataRegion, progHeader, maxUint64(loadStart, relroEnd), loadEnd)
+	}
+
+	if len(layout.chunks) == 0 {
+		return nil, errors.New("input elf has no PT_LOAD segments")
+	}
+
+	sort.SliceStable(layout.chunks, func(i int, j int) bool {
+		return layout.chunks[i].Vaddr < layout.chunks[j].Vaddr
+	})
+
+	for _, region := range []*LayoutRegion{codeRegion, relroRegion, dataRegion} {
+		if region.End > region.Start {
+			layout.Regions = append(layout.Regions, region)
+		}
+	}
+
+	if layout.Regions[0] != codeRegion {
+		return nil, errors.New("input elf has no code segment")
+	}
+
+	// Regions keep their order, and each one after the code region starts on the first page the previous one doesn't use
+	layout.baseAddr = codeRegion.Start &^ (_layoutPageSize - 1)
+	previousRegion := codeRegion
+
+	for _, region := range layout.Regions[1:] {
+		if region.Start < previousRegion.End {
+			return nil, fmt.Errorf("%s region 0x%X-0x%X overlaps the %s region, the input's code and data segments are "+
+				"interleaved", region.Name, region.Start, region.End, previousRegion.Name)
+		}
+
+		regionPage := region.Start &^ (_layoutPageSize - 1)
+		previousEnd := previousRegion.End + previousRegion.Shift
+
+		if region == relroRegion {
+			// Relro keeps its offset into the page, since PT_GNU_RELRO is expanded to start at the page
+			region.Shift = maxUint64(regionPage, align(previousEnd, _layoutPageSize)) - regionPage
+		} else {
+			// The data segment starts with .data.sce_process_param, which has to be at the start of a page
+			region.Shift = maxUint64(align(region.Start, _layoutPageSize), align(previousEnd, _layoutPageSize)) - region.Start
+		}
+
+		if err := layout.checkShiftAlignment(region); err != nil {
+			return nil, err
+		}
+
+		previousRegion = region
+	}
+
+	return &layout, nil
+}
+
+// checkShiftAlignment makes sure moving the given region keeps every section in it aligned. Returns an error if a
+// section would lose its alignment, nil otherwise.
+func (layout *Layout) checkShiftAlignment(region *LayoutRegion) error {
+	for _, section := range layout.inputElf.Sections {
+		if section.Flags&elf.SHF_ALLOC == 0 || section.Addr < region.Start || section.Addr >= region.End {
+			continue
+		}
+
+		if section.Addralign > 1 && region.Shift%section.Addralign != 0 {
+			return fmt.Errorf("moving the %s region by 0x%X would break the 0x%X alignment of %s", region.Name,
+				region.Shift, section.Addralign, section.Name)
+		}
+	}
+
+	return nil
+}
+
+// addChunk adds the part of the given PT_LOAD between start and end to the given region. Empty parts are ignored.
+func (layout *Layout) addChunk(region *LayoutRegion, progHeader *elf.Prog, start uint64, end uint64) {
+	if end <= start {
+		return
+	}
+
+	chunk := layoutChunk{
+		region: region,
+		Off:    progHeader.Off + (start - progHeader.Vaddr),
+		Vaddr:  start,
+		Memsz:  end - start,
+	}
+
+	if loadFileEnd := progHeader.Vaddr + progHeader.Filesz; loadFileEnd > start {
+		chunk.Filesz = minUint64(loadFileEnd, end) - start
+	}
+
+	if region.End == region.Start {
+		region.Start, region.End = start, end
+	} else {
+		region.Start, region.End = minUint64(region.Start, start), maxUint64(region.End, end)
+	}
+
+	layout.chunks = append(layout.chunks, chunk)
+}
+
+// NeedsShift returns true if any region of the layout moves to a different address.
+func (layout *Layout) NeedsShift() bool {
+	for _, region := range layout.Regions {
+		if region.Shift != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getRegion takes a given input address and finds the region it belongs to. Addresses just past the end of a region
+// (ie. end symbols) belong to that region. Returns the region, or nil if the address isn't in any region.
+func (layout *Layout) getRegion(addr uint64) *LayoutRegion {
+	for _, region := range layout.Regions {
+		if addr >= region.Start && addr < region.End {
+			return region
+		}
+	}
+
+	for _, region := range layout.Regions {
+		if addr == region.End {
+			return region
+		}
+	}
+
+	return nil
+}
+
+// newAddress takes a given input address and returns where it ends up in the output. Addresses outside of every
+// region are returned as is.
+func (layout *Layout) newAddress(addr uint64) uint64 {
+	if region := layout.getRegion(addr); region != nil {
+		return addr + region.Shift
+	}
+
+	return addr
+}
+
+// newOffset takes a given input address and returns the output file offset its data is written to.
+func (layout *Layout) newOffset(addr uint64) uint64 {
+	return layout.newAddress(addr) - layout.baseAddr
+}
+
+// getInputOffset takes a given input address and finds the input file offset that holds its data. Returns the offset,
+// and false if the address isn't backed by file data.
+func (layout *Layout) getInputOffset(addr uint64, size uint64) (uint64, bool) {
+	for _, chunk := range layout.chunks {
+		if addr >= chunk.Vaddr && addr+size <= chunk.Vaddr+chunk.Filesz {
+			return chunk.Off + (addr - chunk.Vaddr), true
+		}
+	}
+
+	return 0, false
+}
+
+// build writes the relaid out ELF to the layout's output. Loadable data comes first, followed by non-loadable sections
+// and the section header table. The file is padded to a page so the dynlib data appended later is aligned.
+func (layout *Layout) build() error {
+	inputHdr := elf.Header64{}
+
+	if err := binary.Read(io.NewSectionReader(layout.input, 0, 0x40), binary.LittleEndian, &inputHdr); err != nil {
+		return err
+	}
+
+	headersOrbisElf := OrbisElf{ElfToConvert: layout.inputElf}
+
+	sectionHeaders, err := headersOrbisElf.getRawSectionHeaders(layout.input, &inputHdr)
+	if err != nil {
+		return err
+	}
+
+	// Copy the loadable data of each chunk to its new offset
+	headersEnd := inputHdr.Phoff + uint64(inputHdr.Phnum)*uint64(inputHdr.Phentsize)
+
+	for _, chunk := range layout.chunks {
+		newOffset := layout.newOffset(chunk.Vaddr)
+
+		if newOffset < headersEnd && chunk.Off != 0 {
+			return fmt.Errorf("input elf maps 0x%X-0x%X over the program header table", chunk.Vaddr, chunk.Vaddr+chunk.Memsz)
+		}
+
+		if chunk.Filesz > layout.inputSize || chunk.Off > layout.inputSize-chunk.Filesz {
+			return fmt.Errorf("segment data at offset 0x%X is truncated", chunk.Off)
+		}
+
+		layout.copyAt(newOffset, chunk.Off, chunk.Filesz)
+	}
+
+	layout.padTo(headersEnd)
+
+	// Sections keep their data, only their location changes
+	for i := range sectionHeaders {
+		sectionHeader := &sectionHeaders[i]
+		sectionType := elf.SectionType(sectionHeader.Type)
+
+		if sectionType == elf.SHT_NULL {
+			continue
+		}
+
+		if elf.SectionFlag(sectionHeader.Flags)&elf.SHF_ALLOC != 0 && layout.getRegion(sectionHeader.Addr) != nil {
+			sectionHeader.Addr = layout.newAddress(sectionHeader.Addr)
+			sectionHeader.Off = sectionHeader.Addr - layout.baseAddr
+			continue
+		}
+
+		if elf.SectionFlag(sectionHeader.Flags)&elf.SHF_ALLOC != 0 {
+			layout.warn("section %d at 0x%X isn't in any segment, it's kept as non-loadable data", i, sectionHeader.Addr)
+		}
+
+		layout.padTo(layout.outputSize + padSize(layout.outputSize, sectionHeader.Addralign))
+
+		newOffset := layout.outputSize
+
+		if sectionType != elf.SHT_NOBITS {
+			if sectionHeader.Size > layout.inputSize || sectionHeader.Off > layout.inputSize-sectionHeader.Size {
+				return fmt.Errorf("section %d data is truncated", i)
+			}
+
+			layout.copyAt(newOffset, sectionHeader.Off, sectionHeader.Size)
+		}
+
+		sectionHeader.Off = newOffset
+	}
+
+	// Addresses in the data need to follow any region that moved
+	if layout.NeedsShift() {
+		if err := layout.adjustReferences(sectionHeaders); err != nil {
+			return err
+		}
+	}
+
+	// Commit the section header table
+	layout.padTo(align(layout.outputSize, 0x8))
+	sectionHeadersOffset := layout.outputSize
+
+	sectionHeadersBuff := new(bytes.Buffer)
+
+	if err := binary.Write(sectionHeadersBuff, binary.LittleEndian, sectionHeaders); err != nil {
+		return err
+	}
+
+	layout.writeAt(sectionHeadersOffset, sectionHeadersBuff.Bytes())
+	layout.padTo(align(layout.outputSize, _layoutPageSize))
+
+	// Commit the ELF header and program header table
+	progHeaders := layout.buildProgramHeaders()
+
+	if len(progHeaders) > int(inputHdr.Phnum) {
+		return errors.New("relaid out program header table doesn't fit the input's")
+	}
+
+	outputHdr := inputHdr
+	outputHdr.Entry = layout.newAddress(inputHdr.Entry)
+	outputHdr.Phnum = uint16(len(progHeaders))
+	outputHdr.Shoff = sectionHeadersOffset
+
+	headersBuff := new(bytes.Buffer)
+
+	if err := binary.Write(headersBuff, binary.LittleEndian, outputHdr); err != nil {
+		return err
+	}
+
+	layout.writeAt(0, headersBuff.Bytes())
+	headersBuff.Reset()
+
+	if err := binary.Write(headersBuff, binary.LittleEndian, progHeaders); err != nil {
+		return err
+	}
+
+	// Clear out program headers that were dropped
+	layout.writeAt(inputHdr.Phoff, make([]byte, uint64(inputHdr.Phnum)*0x38))
+	layout.writeAt(inputHdr.Phoff, headersBuff.Bytes())
+
+	return layout.outputErr
+}
+
+// buildProgramHeaders generates the program headers of the relaid out ELF. The code region gets one R|X PT_LOAD, and
+// the relro and data regions share one R|W PT_LOAD that starts at the relro page. PT_GNU_RELRO is expanded to start at
+// its page as well. Other program headers are kept, with their addresses and offsets updated. Returns the program
+// headers.
+func (layout *Layout) buildProgramHeaders() []elf.Prog64 {
+	var progHeaders []elf.Prog64
+	var writableStart, writableEnd, writableFileEnd uint64
+
+	codeRegion := layout.Regions[0]
+	codeFileEnd := uint64(0)
+
+	for _, chunk := range layout.chunks {
+		chunkFileEnd := layout.newOffset(chunk.Vaddr) + chunk.Filesz
+
+		if chunk.region == codeRegion {
+			codeFileEnd = maxUint64(codeFileEnd, chunkFileEnd)
+			continue
+		}
+
+		regionPage := layout.newAddress(chunk.region.Start) &^ (_layoutPageSize - 1)
+
+		if writableEnd == 0 || regionPage < writableStart {
+			writableStart = regionPage
+		}
+
+		writableEnd = maxUint64(writableEnd, layout.newAddress(chunk.Vaddr)+chunk.Memsz)
+
+		if chunk.Filesz > 0 {
+			writableFileEnd = maxUint64(writableFileEnd, chunkFileEnd)
+		}
+	}
+
+	loadsWritten := false
+
+	for _, progHeader := range layout.inputElf.Progs {
+		switch progHeader.Type {
+		case elf.PT_LOAD:
+			// All loads are replaced with the ones for the regions, in the place of the first one
+			if loadsWritten {
+				continue
+			}
+
+			loadsWritten = true
+			progHeaders = append(progHeaders, elf.Prog64{
+				Type:   uint32(elf.PT_LOAD),
+				Flags:  uint32(elf.PF_R | elf.PF_X),
+				Off:    codeRegion.Start - layout.baseAddr,
+				Vaddr:  codeRegion.Start,
+				Paddr:  codeRegion.Start,
+				Filesz: codeFileEnd - (codeRegion.Start - layout.baseAddr),
+				Memsz:  codeRegion.End - codeRegion.Start,
+				Align:  _layoutPageSize,
+			})
+
+			if writableEnd > writableStart {
+				writableFilesz := uint64(0)
+
+				if writableFileEnd > writableStart-layout.baseAddr {
+					writableFilesz = writableFileEnd - (writableStart - layout.baseAddr)
+				}
+
+				progHeaders = append(progHeaders, elf.Prog64{
+					Type:   uint32(elf.PT_LOAD),
+					Flags:  uint32(elf.PF_R | elf.PF_W),
+					Off:    writableStart - layout.baseAddr,
+					Vaddr:  writableStart,
+					Paddr:  writableStart,
+					Filesz: writableFilesz,
+					Memsz:  writableEnd - writableStart,
+					Align:  _layoutPageSize,
+				})
+			}
+		case elf.PT_GNU_RELRO:
+			relroPage := layout.newAddress(progHeader.Vaddr) &^ (_layoutPageSize - 1)
+			relroEnd := layout.newAddress(progHeader.Vaddr) + progHeader.Memsz
+
+			progHeaders = append(progHeaders, elf.Prog64{
+				Type:   uint32(progHeader.Type),
+				Flags:  uint32(progHeader.Flags),
+				Off:    relroPage - layout.baseAddr,
+				Vaddr:  relroPage,
+				Paddr:  relroPage,
+				Filesz: relroEnd - relroPage,
+				Memsz:  relroEnd - relroPage,
+				Align:  progHeader.Align,
+			})
+		default:
+			newAddr := layout.newAddress(progHeader.Vaddr)
+			newOffset := progHeader.Off
+
+			if _, ok := layout.getInputOffset(progHeader.Vaddr, progHeader.Filesz); ok && progHeader.Filesz > 0 {
+				newOffset = layout.newOffset(progHeader.Vaddr)
+			}
+
+			progHeaders = append(progHeaders, elf.Prog64{
+				Type:   uint32(progHeader.Type),
+				Flags:  uint32(progHeader.Flags),
+				Off:    newOffset,
+				Vaddr:  newAddr,
+				Paddr:  newAddr,
+				Filesz: progHeader.Filesz,
+				Memsz:  progHeader.Memsz,
+				Align:  progHeader.Align,
+			})
+		}
+	}
+
+	return progHeaders
+}
+
+// Report describes the regions of the layout, and how far each one was moved.
+func (layout *Layout) Report() string {
+	report := new(strings.Builder)
+
+	report.WriteString("Layout regions:\n")
+
+	for _, region := range layout.Regions {
+		fmt.Fprintf(report, "  %s 0x%X-0x%X", region.Name, region.Start, region.End)
+
+		if region.Shift != 0 {
+			fmt.Fprintf(report, " moved to 0x%X-0x%X", region.Start+region.Shift, region.End+region.Shift)
+		}
+
+		report.WriteString("\n")
+	}
+
+	return report.String()
+}
+
+// warn records a warning about relaying out the ELF, formatted with the given parameters.
+func (layout *Layout) warn(format string, params ...interface{}) {
+	layout.Warnings = append(layout.Warnings, fmt.Sprintf(format, params...))
+}
+
+// writeAt writes the given data to the output at the given offset, growing the output as needed. Gaps are filled with
+// null bytes. Once a write fails, the error is kept in outputErr and later writes are skipped.
+func (layout *Layout) writeAt(offset uint64, data []byte) {
+	layout.padTo(offset)
+
+	if layout.outputErr != nil {
+		return
+	}
+
+	if _, err := layout.output.WriteAt(data, int64(offset)); err != nil {
+		layout.outputErr = err
+		return
+	}
+
+	layout.outputSize = maxUint64(layout.outputSize, offset+uint64(len(data)))
+}
+
+// copyAt copies size bytes of the input at the given input offset to the output at the given output offset.
+func (layout *Layout) copyAt(outputOffset uint64, inputOffset uint64, size uint64) {
+	buffer := make([]byte, minUint64(size, 0x10000))
+
+	for copied := uint64(0); copied < size && layout.outputErr == nil; {
+		chunk := buffer[:minUint64(size-copied, uint64(len(buffer)))]
+
+		if _, err := layout.input.ReadAt(chunk, int64(inputOffset+copied)); err != nil {
+			layout.outputErr = err
+			return
+		}
+
+		layout.writeAt(outputOffset+copied, chunk)
+		copied += uint64(len(chunk))
+	}
+}
+
+// padTo grows the output with null bytes until it's at least the given size. File offsets are kept in step with
+// addresses, so a gap can be as large as the .bss before it, and the null bytes are written in chunks.
+func (layout *Layout) padTo(size uint64) {
+	if layout.outputSize >= size || layout.outputErr != nil {
+		return
+	}
+
+	buffer := make([]byte, minUint64(size-layout.outputSize, 0x10000))
+
+	for layout.outputSize < size {
+		chunk := buffer[:minUint64(size-layout.outputSize, uint64(len(buffer)))]
+
+		if _, err := layout.output.WriteAt(chunk, int64(layout.outputSize)); err != nil {
+			layout.outputErr = err
+			return
+		}
+
+		layout.outputSize += uint64(len(chunk))
+	}
+}
+
+// padSize takes a given offset and alignment, and returns how many bytes of padding are needed to align the offset.
+func padSize(offset uint64, alignment uint64) uint64 {
+	if alignment <= 1 {
+		return 0
+	}
+
+	return align(offset, alignment) - offset
+}
+
+// minUint64 returns the smaller of the two given values.
+func minUint64(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,400 @@
+package oelf
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// _pltSectionNames lists the sections holding linker generated PLT stubs. They have no static relocations, even with
+// --emit-relocs, so their references to the GOT are found by decoding the stubs.
+var _pltSectionNames = []string{".plt", ".plt.got", ".plt.sec"}
+
+// _gotSectionNames lists the sections that hold the global offset table.
+var _gotSectionNames = []string{".got", ".got.plt"}
+
+// _dynamicPointerTags lists the dynamic table tags whose values are addresses.
+var _dynamicPointerTags = []elf.DynTag{
+	elf.DT_PLTGOT, elf.DT_HASH, elf.DT_STRTAB, elf.DT_SYMTAB, elf.DT_RELA, elf.DT_INIT, elf.DT_FINI, elf.DT_REL,
+	elf.DT_JMPREL, elf.DT_INIT_ARRAY, elf.DT_FINI_ARRAY, elf.DT_PREINIT_ARRAY, elf.DT_GNU_HASH, elf.DT_VERSYM,
+	elf.DT_VERDEF, elf.DT_VERNEED,
+}
+
+// adjustReferences updates every address in the output that refers to a region that moved. This covers dynamic
+// relocations, static relocations kept by --emit-relocs, symbol tables, the dynamic table, PLT stubs, and the GOT
+// header. The given sectionHeaders are the output section headers. Returns an error if a reference couldn't be
+// adjusted, nil otherwise.
+func (layout *Layout) adjustReferences(sectionHeaders []elf.Section64) error {
+	if err := layout.checkStaticRelocations(); err != nil {
+		return err
+	}
+
+	for i, section := range layout.inputElf.Sections {
+		outputOffset := sectionHeaders[i].Off
+
+		switch {
+		case section.Type == elf.SHT_RELA && section.Flags&elf.SHF_ALLOC != 0:
+			if err := layout.adjustDynamicRelocations(section, outputOffset); err != nil {
+				return err
+			}
+		case section.Type == elf.SHT_RELA && isStaticRelocationSection(layout.inputElf, section):
+			if err := layout.adjustStaticRelocations(section); err != nil {
+				return err
+			}
+		case section.Type == elf.SHT_SYMTAB || section.Type == elf.SHT_DYNSYM:
+			layout.adjustSymbols(section, outputOffset)
+		case section.Type == elf.SHT_DYNAMIC:
+			layout.adjustDynamicTable(section, outputOffset)
+		}
+	}
+
+	for _, sectionName := range _pltSectionNames {
+		if section := layout.inputElf.Section(sectionName); section != nil {
+			layout.adjustPltStubs(section)
+		}
+	}
+
+	// The first GOT entry holds the address of the dynamic table, without a relocation
+	if dynamicSection := layout.inputElf.SectionByType(elf.SHT_DYNAMIC); dynamicSection != nil {
+		for _, sectionName := range _gotSectionNames {
+			if section := layout.inputElf.Section(sectionName); section != nil && section.Size >= 8 {
+				if value, ok := layout.readUint64(section.Addr); ok && value == dynamicSection.Addr {
+					layout.writeUint64(section.Addr, layout.newAddress(value))
+				}
+			}
+		}
+	}
+
+	for _, section := range layout.inputElf.Sections {
+		if strings.HasPrefix(section.Name, ".debug_") {
+			layout.warn("DWARF info isn't adjusted for moved regions, line info for moved data will be off")
+			break
+		}
+	}
+
+	return nil
+}
+
+// checkStaticRelocations makes sure every code section has static relocations, which are needed to find the
+// references in code to regions that moved. Returns an error if a code section has none, nil otherwise.
+func (layout *Layout) checkStaticRelocations() error {
+	relocatedSections := make(map[int]bool)
+
+	for _, section := range layout.inputElf.Sections {
+		if section.Type == elf.SHT_RELA && isStaticRelocationSection(layout.inputElf, section) {
+			relocatedSections[int(section.Info)] = true
+		}
+	}
+
+	for i, section := range layout.inputElf.Sections {
+		if section.Flags&elf.SHF_EXECINSTR == 0 || section.Size == 0 || contains(_pltSectionNames, section.Name) {
+			continue
+		}
+
+		if !relocatedSections[i] {
+			return fmt.Errorf("segments have to move to start on their own page, but %s has no relocations to adjust "+
+				"its references (link with --emit-relocs, or with a linker script that aligns segments to 0x4000)", section.Name)
+		}
+	}
+
+	return nil
+}
+
+// adjustDynamicRelocations takes the given dynamic relocation section and updates the offsets of its entries, as well
+// as the addends of relative relocations. The fields being relocated are updated if the relocation type says they hold
+// an address. The section is written at outputOffset. Returns an error if the section couldn't be read, nil otherwise.
+func (layout *Layout) adjustDynamicRelocations(section *elf.Section, outputOffset uint64) error {
+	relaData, err := section.Data()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+0x18 <= len(relaData); i += 0x18 {
+		rOffset := binary.LittleEndian.Uint64(relaData[i : i+0x8])
+		rType := elf.R_X86_64(elf.R_TYPE64(binary.LittleEndian.Uint64(relaData[i+0x8 : i+0x10])))
+		rAddend := binary.LittleEndian.Uint64(relaData[i+0x10 : i+0x18])
+
+		if rType == elf.R_X86_64_RELATIVE || rType == elf.R_X86_64_IRELATIVE {
+			rAddend = layout.newAddress(rAddend)
+		}
+
+		// TLS fields hold offsets and module ids rather than addresses, which could be mistaken for one in a moved region
+		if isAddressRelocation(rType) {
+			if value, ok := layout.readUint64(rOffset); ok && value != 0 {
+				layout.writeUint64(rOffset, layout.newAddress(value))
+			}
+		}
+
+		entryOffset := outputOffset + uint64(i)
+
+		layout.writeOutputUint64(entryOffset, layout.newAddress(rOffset))
+		layout.writeOutputUint64(entryOffset+0x10, rAddend)
+	}
+
+	return nil
+}
+
+// adjustStaticRelocations takes the given static relocation section and fixes up the fields it relocates, so that
+// PC-relative and absolute references still reach their targets after regions moved. Returns an error if a field
+// can't be adjusted, nil otherwise.
+func (layout *Layout) adjustStaticRelocations(section *elf.Section) error {
+	relaData, err := section.Data()
+	if err != nil {
+		return err
+	}
+
+	gotAddr := uint64(0)
+
+	if gotPltSection := layout.inputElf.Section(".got.plt"); gotPltSection != nil {
+		gotAddr = gotPltSection.Addr
+	}
+
+	for i := 0; i+0x18 <= len(relaData); i += 0x18 {
+		rOffset := binary.LittleEndian.Uint64(relaData[i : i+0x8])
+		rType := elf.R_X86_64(elf.R_TYPE64(binary.LittleEndian.Uint64(relaData[i+0x8 : i+0x10])))
+
+		switch rType {
+		case elf.R_X86_64_PC32, elf.R_X86_64_PLT32, elf.R_X86_64_GOTPCREL, elf.R_X86_64_GOTPCRELX,
+			elf.R_X86_64_REX_GOTPCRELX, elf.R_X86_64_GOTPC32, elf.R_X86_64_TLSGD, elf.R_X86_64_TLSLD,
+			elf.R_X86_64_GOTTPOFF, elf.R_X86_64_GOTPC32_TLSDESC:
+			fieldAddr := rOffset
+
+			// An indirect jump through the GOT can be relaxed to a direct jump, which moves the field back a byte
+			if rType == elf.R_X86_64_GOTPCRELX || rType == elf.R_X86_64_REX_GOTPCRELX {
+				if opcode, ok := layout.readBytes(rOffset-2, 1); ok && opcode[0] == 0xE9 {
+					fieldAddr = rOffset - 1
+				}
+			}
+
+			field, ok := layout.readBytes(fieldAddr, 4)
+			if !ok {
+				continue
+			}
+
+			displacement := int64(int32(binary.LittleEndian.Uint32(field)))
+			target := uint64(int64(fieldAddr) + 4 + displacement)
+
+			// TLS accesses that were relaxed to the local exec model no longer refer to the GOT
+			if isTLSRelocation(rType) && !layout.isGotAddress(target) {
+				continue
+			}
+
+			adjusted := displacement + layout.getShiftDelta(target, fieldAddr)
+
+			if adjusted < math.MinInt32 || adjusted > math.MaxInt32 {
+				return fmt.Errorf("%s at 0x%X is out of range after moving regions", rType, rOffset)
+			}
+
+			binary.LittleEndian.PutUint32(field, uint32(int32(adjusted)))
+			layout.writeBytes(fieldAddr, field)
+		case elf.R_X86_64_PC64, elf.R_X86_64_GOTPC64:
+			if value, ok := layout.readUint64(rOffset); ok {
+				layout.writeUint64(rOffset, uint64(int64(value)+layout.getShiftDelta(rOffset+value, rOffset)))
+			}
+		case elf.R_X86_64_GOTOFF64:
+			if value, ok := layout.readUint64(rOffset); ok {
+				layout.writeUint64(rOffset, uint64(int64(value)+layout.getShiftDelta(gotAddr+value, gotAddr)))
+			}
+		case elf.R_X86_64_64:
+			if value, ok := layout.readUint64(rOffset); ok {
+				layout.writeUint64(rOffset, layout.newAddress(value))
+			}
+		case elf.R_X86_64_32, elf.R_X86_64_32S:
+			field, ok := layout.readBytes(rOffset, 4)
+			if !ok {
+				continue
+			}
+
+			value := binary.LittleEndian.Uint32(field)
+
+			if layout.newAddress(uint64(value)) > math.MaxUint32 {
+				return fmt.Errorf("%s at 0x%X is out of range after moving regions", rType, rOffset)
+			}
+
+			binary.LittleEndian.PutUint32(field, uint32(layout.newAddress(uint64(value))))
+			layout.writeBytes(rOffset, field)
+		case elf.R_X86_64_NONE, elf.R_X86_64_TPOFF32, elf.R_X86_64_TPOFF64, elf.R_X86_64_DTPOFF32,
+			elf.R_X86_64_DTPOFF64, elf.R_X86_64_DTPMOD64, elf.R_X86_64_SIZE32, elf.R_X86_64_SIZE64,
+			elf.R_X86_64_TLSDESC_CALL, elf.R_X86_64_GOT32, elf.R_X86_64_GOT64:
+			// Offsets within TLS or the GOT don't change
+		default:
+			return fmt.Errorf("can't adjust %s at 0x%X for moved regions", rType, rOffset)
+		}
+	}
+
+	return nil
+}
+
+// adjustSymbols takes the given symbol table and updates the value of every symbol defined in a loadable section. The
+// table is written at outputOffset.
+func (layout *Layout) adjustSymbols(section *elf.Section, outputOffset uint64) {
+	symbolData, err := section.Data()
+	if err != nil {
+		return
+	}
+
+	for i := 0; i+0x18 <= len(symbolData); i += 0x18 {
+		symbolInfo := symbolData[i+0x4]
+		sectionIndex := elf.SectionIndex(binary.LittleEndian.Uint16(symbolData[i+0x6 : i+0x8]))
+		value := binary.LittleEndian.Uint64(symbolData[i+0x8 : i+0x10])
+
+		if sectionIndex == elf.SHN_UNDEF || sectionIndex >= elf.SHN_LORESERVE || int(sectionIndex) >= len(layout.inputElf.Sections) {
+			continue
+		}
+
+		// TLS symbol values are offsets into the TLS block
+		if elf.ST_TYPE(symbolInfo) == elf.STT_TLS {
+			continue
+		}
+
+		symbolSection := layout.inputElf.Sections[sectionIndex]
+
+		if symbolSection.Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+
+		// Use the symbol's section to find its region, since end symbols can sit right on a region boundary
+		if region := layout.getRegion(symbolSection.Addr); region != nil {
+			layout.writeOutputUint64(outputOffset+uint64(i)+0x8, value+region.Shift)
+		}
+	}
+}
+
+// adjustDynamicTable takes the given dynamic table section and updates the entries that hold addresses. The table is
+// written at outputOffset.
+func (layout *Layout) adjustDynamicTable(section *elf.Section, outputOffset uint64) {
+	dynamicData, err := section.Data()
+	if err != nil {
+		return
+	}
+
+	for i := 0; i+0x10 <= len(dynamicData); i += 0x10 {
+		tag := elf.DynTag(binary.LittleEndian.Uint64(dynamicData[i : i+0x8]))
+		value := binary.LittleEndian.Uint64(dynamicData[i+0x8 : i+0x10])
+
+		for _, pointerTag := range _dynamicPointerTags {
+			if tag == pointerTag {
+				layout.writeOutputUint64(outputOffset+uint64(i)+0x8, layout.newAddress(value))
+				break
+			}
+		}
+	}
+}
+
+// adjustPltStubs takes the given PLT section and updates the GOT references of its stubs. These are `jmp *disp(%rip)`
+// and `push disp(%rip)` instructions whose target is in the GOT.
+func (layout *Layout) adjustPltStubs(section *elf.Section) {
+	pltData, err := section.Data()
+	if err != nil {
+		return
+	}
+
+	for i := 0; i+6 <= len(pltData); i++ {
+		if pltData[i] != 0xFF || (pltData[i+1] != 0x25 && pltData[i+1] != 0x35) {
+			continue
+		}
+
+		fieldAddr := section.Addr + uint64(i) + 2
+		displacement := int64(int32(binary.LittleEndian.Uint32(pltData[i+2 : i+6])))
+		target := uint64(int64(fieldAddr) + 4 + displacement)
+
+		if !layout.isGotAddress(target) {
+			continue
+		}
+
+		field := make([]byte, 4)
+		binary.LittleEndian.PutUint32(field, uint32(int32(displacement+layout.getShiftDelta(target, fieldAddr))))
+		layout.writeBytes(fieldAddr, field)
+
+		i += 5
+	}
+}
+
+// isStaticRelocationSection returns true if the given relocation section holds static relocations kept by
+// --emit-relocs for a loadable section of the given ELF.
+func isStaticRelocationSection(inputElf *elf.File, section *elf.Section) bool {
+	if section.Flags&elf.SHF_ALLOC != 0 || section.Info == 0 || int(section.Info) >= len(inputElf.Sections) {
+		return false
+	}
+
+	return inputElf.Sections[section.Info].Flags&elf.SHF_ALLOC != 0
+}
+
+// isAddressRelocation returns true if the field relocated by a dynamic relocation of the given type holds an address.
+func isAddressRelocation(rType elf.R_X86_64) bool {
+	return rType == elf.R_X86_64_RELATIVE || rType == elf.R_X86_64_64 || rType == elf.R_X86_64_GLOB_DAT ||
+		rType == elf.R_X86_64_JMP_SLOT
+}
+
+// isTLSRelocation returns true if the given relocation type refers to a TLS GOT entry.
+func isTLSRelocation(rType elf.R_X86_64) bool {
+	return rType == elf.R_X86_64_TLSGD || rType == elf.R_X86_64_TLSLD || rType == elf.R_X86_64_GOTTPOFF ||
+		rType == elf.R_X86_64_GOTPC32_TLSDESC
+}
+
+// isGotAddress returns true if the given input address is inside one of the GOT sections.
+func (layout *Layout) isGotAddress(addr uint64) bool {
+	for _, sectionName := range _gotSectionNames {
+		if section := layout.inputElf.Section(sectionName); section != nil {
+			if addr >= section.Addr && addr < section.Addr+section.Size {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getShiftDelta takes a given target and the address referring to it, and returns how much further apart they are
+// after moving regions.
+func (layout *Layout) getShiftDelta(target uint64, referrer uint64) int64 {
+	return int64(layout.newAddress(target)-target) - int64(layout.newAddress(referrer)-referrer)
+}
+
+// readBytes reads size bytes of input data at the given input address. Returns the data, and false if the address
+// isn't backed by file data.
+func (layout *Layout) readBytes(addr uint64, size uint64) ([]byte, bool) {
+	inputOffset, ok := layout.getInputOffset(addr, size)
+	if !ok {
+		return nil, false
+	}
+
+	data := make([]byte, size)
+
+	if _, err := layout.input.ReadAt(data, int64(inputOffset)); err != nil {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// readUint64 reads a 64-bit value of input data at the given input address. Returns the value, and false if the address
+// isn't backed by file data.
+func (layout *Layout) readUint64(addr uint64) (uint64, bool) {
+	data, ok := layout.readBytes(addr, 8)
+	if !ok {
+		return 0, false
+	}
+
+	return binary.LittleEndian.Uint64(data), true
+}
+
+// writeBytes writes the given data to where the given input address ends up in the output.
+func (layout *Layout) writeBytes(addr uint64, data []byte) {
+	layout.writeAt(layout.newOffset(addr), data)
+}
+
+// writeUint64 writes a 64-bit value to where the given input address ends up in the output.
+func (layout *Layout) writeUint64(addr uint64, value uint64) {
+	layout.writeOutputUint64(layout.newOffset(addr), value)
+}
+
+// writeOutputUint64 writes a 64-bit value to the output at the given offset.
+func (layout *Layout) writeOutputUint64(offset uint64, value uint64) {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, value)
+
+	layout.writeAt(offset, data)
+}
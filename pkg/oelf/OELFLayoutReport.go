@@ -0,0 +1,40 @@
+package oelf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LayoutReport describes the layout of the converted Orbis ELF, for use after GenerateProgramHeaders. It lists the
+// generated program headers and the segment each exception frame section is mapped by. Returns the report as
+// printable lines.
+func (orbisElf *OrbisElf) LayoutReport() string {
+	report := new(strings.Builder)
+
+	report.WriteString("Segments:\n")
+
+	for _, progHeader := range orbisElf.ProgramHeaders {
+		fmt.Fprintf(report, "  %s\n", describeSegment(progHeader))
+	}
+
+	report.WriteString("Exception frames:\n")
+
+	for _, sectionName := range _exceptionFrameSections {
+		section := orbisElf.ElfToConvert.Section(sectionName)
+
+		if section == nil {
+			fmt.Fprintf(report, "  %s not present\n", sectionName)
+			continue
+		}
+
+		sectionDescription := fmt.Sprintf("%s 0x%X-0x%X", sectionName, section.Addr, section.Addr+section.Size)
+
+		if segment := orbisElf.getMappingSegment(section); segment != nil {
+			fmt.Fprintf(report, "  %s in %s\n", sectionDescription, describeSegment(segment))
+		} else {
+			fmt.Fprintf(report, "  %s not mapped\n", sectionDescription)
+		}
+	}
+
+	return report.String()
+}
@@ -0,0 +1,437 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The layout test ELF has a code segment at 0x0-0x1000, followed by a writable segment at 0x1000-0x1040 that shares its
+// page. Relro (.data.rel.ro) has to move up a page to 0x5000, and the rest of the data (.got.plt) to the page after it,
+// at 0x8000.
+const (
+	_testRelroShift = 0x4000
+	_testDataShift  = 0x8000 - 0x1020
+)
+
+// buildLayoutTestELF builds the layout test ELF, with the given dynamic relocations in .rela.dyn and static relocations
+// for .text in .rela.text. Returns the ELF data.
+func buildLayoutTestELF(dynamicRelocations []elf.Rela64, staticRelocations []elf.Rela64) []byte {
+	text := make([]byte, 0x40)
+
+	putUint32(text, 0x04, 0x1028-(0x404+4)) // PC32 to .got.plt
+	putUint32(text, 0x0C, 0x420-(0x40C+4))  // PC32 to .text
+	putUint64(text, 0x10, 0x1008)           // 64 to .data.rel.ro
+	putUint32(text, 0x18, 0x1030)           // 32 to .got.plt
+	putUint64(text, 0x28, 0x1000-0x428)     // PC64 to .data.rel.ro
+	text[0x30] = 0xE9                       // jmp relaxed from a GOTPCRELX...
+	putUint32(text, 0x31, 0x1000-(0x431+4)) // ...to .data.rel.ro
+	putUint32(text, 0x38, 0x10)             // TPOFF32
+
+	relro := make([]byte, 0x20)
+
+	putUint64(relro, 0x00, 0x1028) // RELATIVE
+	putUint64(relro, 0x08, 0x420)  // GLOB_DAT
+	putUint64(relro, 0x10, 0x1004) // DTPOFF64, an offset that happens to look like an address in relro
+	putUint64(relro, 0x18, 0x1010) // 64
+
+	got := make([]byte, 0x20)
+
+	putUint64(got, 0x00, 0x1008) // DTPMOD64, a module id that happens to look like an address in relro
+	putUint64(got, 0x10, 0x1024) // TPOFF64
+	putUint64(got, 0x18, 0x410)  // JMP_SLOT
+
+	progHeaders := []elf.Prog64{
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_X), Off: 0, Vaddr: 0, Filesz: 0x1000, Memsz: 0x1000, Align: 0x4000},
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_W), Off: 0x1000, Vaddr: 0x1000, Filesz: 0x40, Memsz: 0x40, Align: 0x4000},
+		{Type: uint32(elf.PT_GNU_RELRO), Flags: uint32(elf.PF_R), Off: 0x1000, Vaddr: 0x1000, Filesz: 0x20, Memsz: 0x20, Align: 1},
+	}
+
+	return buildTestELF(elf.ET_DYN, progHeaders, []testSection{
+		{Name: ".text", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR, Addr: 0x400, Offset: 0x400, Data: text, Addralign: 16},
+		{Name: ".rela.dyn", Type: elf.SHT_RELA, Flags: elf.SHF_ALLOC, Addr: 0x800, Offset: 0x800, Data: encodeRelocations(dynamicRelocations), Addralign: 8, Entsize: 0x18},
+		{Name: ".data.rel.ro", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE, Addr: 0x1000, Offset: 0x1000, Data: relro, Addralign: 8},
+		{Name: ".got.plt", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_WRITE, Addr: 0x1020, Offset: 0x1020, Data: got, Addralign: 8},
+		{Name: ".rela.text", Type: elf.SHT_RELA, Flags: elf.SHF_INFO_LINK, Data: encodeRelocations(staticRelocations), Info: 1, Addralign: 8, Entsize: 0x18},
+	})
+}
+
+// testOutput is an in-memory io.WriterAt for layout outputs.
+type testOutput struct {
+	data []byte
+}
+
+// WriteAt writes the given data at the given offset, growing the output as needed.
+func (output *testOutput) WriteAt(data []byte, offset int64) (int, error) {
+	if end := int(offset) + len(data); end > len(output.data) {
+		output.data = append(output.data, make([]byte, end-len(output.data))...)
+	}
+
+	return copy(output.data[offset:], data), nil
+}
+
+// newTestLayout plans the layout of the given ELF data, and copies its loadable data to the output like build does, so
+// references can be adjusted. Returns the layout.
+func newTestLayout(t *testing.T, elfData []byte) *Layout {
+	t.Helper()
+
+	layout, err := planLayout(parseTestELF(t, elfData), bytes.NewReader(elfData), uint64(len(elfData)))
+	if err != nil {
+		t.Fatalf("planLayout: %s", err.Error())
+	}
+
+	layout.output = &testOutput{}
+
+	for _, chunk := range layout.chunks {
+		layout.copyAt(layout.newOffset(chunk.Vaddr), chunk.Off, chunk.Filesz)
+	}
+
+	return layout
+}
+
+// readOutputUint32 reads a 32-bit value of the layout's output at the given offset.
+func readOutputUint32(layout *Layout, offset uint64) uint32 {
+	return binary.LittleEndian.Uint32(layout.output.(*testOutput).data[offset:])
+}
+
+// readOutputUint64 reads a 64-bit value of the layout's output at the given offset.
+func readOutputUint64(layout *Layout, offset uint64) uint64 {
+	return binary.LittleEndian.Uint64(layout.output.(*testOutput).data[offset:])
+}
+
+func TestPlanLayoutShifts(t *testing.T) {
+	layout := newTestLayout(t, buildLayoutTestELF(nil, nil))
+
+	expectedRegions := []LayoutRegion{
+		{Name: "code", Start: 0x0, End: 0x1000, Shift: 0},
+		{Name: "relro", Start: 0x1000, End: 0x1020, Shift: _testRelroShift},
+		{Name: "data", Start: 0x1020, End: 0x1040, Shift: _testDataShift},
+	}
+
+	if len(layout.Regions) != len(expectedRegions) {
+		t.Fatalf("got %d regions, want %d", len(layout.Regions), len(expectedRegions))
+	}
+
+	for i, region := range layout.Regions {
+		if *region != expectedRegions[i] {
+			t.Errorf("region %d = %+v, want %+v", i, *region, expectedRegions[i])
+		}
+	}
+}
+
+func TestNewAddress(t *testing.T) {
+	layout := newTestLayout(t, buildLayoutTestELF(nil, nil))
+
+	tests := []struct {
+		addr    uint64
+		newAddr uint64
+	}{
+		{0x0, 0x0},
+		{0x400, 0x400},
+		{0xFFF, 0xFFF},
+		{0x1000, 0x1000 + _testRelroShift}, // code end is relro start, which wins
+		{0x101F, 0x101F + _testRelroShift},
+		{0x1020, 0x1020 + _testDataShift}, // relro end is data start, which wins
+		{0x103F, 0x103F + _testDataShift},
+		{0x1040, 0x1040 + _testDataShift}, // end symbols belong to the region they end
+		{0x1041, 0x1041},                  // outside of every region
+		{0x2000, 0x2000},
+	}
+
+	for _, test := range tests {
+		if newAddr := layout.newAddress(test.addr); newAddr != test.newAddr {
+			t.Errorf("newAddress(0x%X) = 0x%X, want 0x%X", test.addr, newAddr, test.newAddr)
+		}
+	}
+}
+
+func TestGetShiftDelta(t *testing.T) {
+	layout := newTestLayout(t, buildLayoutTestELF(nil, nil))
+
+	tests := []struct {
+		target   uint64
+		referrer uint64
+		delta    int64
+	}{
+		{0x420, 0x404, 0},
+		{0x1028, 0x404, _testDataShift},
+		{0x404, 0x1028, -_testDataShift},
+		{0x1000, 0x404, _testRelroShift},
+		{0x1000, 0x1028, _testRelroShift - _testDataShift},
+		{0x1008, 0x1010, 0},
+		{0x2000, 0x404, 0},
+	}
+
+	for _, test := range tests {
+		if delta := layout.getShiftDelta(test.target, test.referrer); delta != test.delta {
+			t.Errorf("getShiftDelta(0x%X, 0x%X) = %d, want %d", test.target, test.referrer, delta, test.delta)
+		}
+	}
+}
+
+func TestAdjustStaticRelocations(t *testing.T) {
+	staticRelocations := []elf.Rela64{
+		newRelocation(0x404, 0, elf.R_X86_64_PC32, -4),
+		newRelocation(0x40C, 0, elf.R_X86_64_PC32, -4),
+		newRelocation(0x410, 0, elf.R_X86_64_64, 0),
+		newRelocation(0x418, 0, elf.R_X86_64_32, 0),
+		newRelocation(0x428, 0, elf.R_X86_64_PC64, 0),
+		newRelocation(0x432, 0, elf.R_X86_64_REX_GOTPCRELX, -4),
+		newRelocation(0x438, 0, elf.R_X86_64_TPOFF32, 0),
+	}
+
+	layout := newTestLayout(t, buildLayoutTestELF(nil, staticRelocations))
+
+	if err := layout.adjustStaticRelocations(layout.inputElf.Section(".rela.text")); err != nil {
+		t.Fatalf("adjustStaticRelocations: %s", err.Error())
+	}
+
+	// .text doesn't move, so fields are at their input address
+	tests := []struct {
+		description string
+		offset      uint64
+		size        int
+		value       uint64
+	}{
+		{"PC32 to moved data", 0x404, 4, 0x1028 + _testDataShift - (0x404 + 4)},
+		{"PC32 to code", 0x40C, 4, 0x420 - (0x40C + 4)},
+		{"64", 0x410, 8, 0x1008 + _testRelroShift},
+		{"32", 0x418, 4, 0x1030 + _testDataShift},
+		{"PC64", 0x428, 8, 0x1000 + _testRelroShift - 0x428},
+		{"relaxed GOTPCRELX", 0x431, 4, 0x1000 + _testRelroShift - (0x431 + 4)},
+		{"TPOFF32", 0x438, 4, 0x10},
+	}
+
+	for _, test := range tests {
+		value := uint64(readOutputUint32(layout, test.offset))
+
+		if test.size == 8 {
+			value = readOutputUint64(layout, test.offset)
+		}
+
+		if value != test.value {
+			t.Errorf("%s: field at 0x%X = 0x%X, want 0x%X", test.description, test.offset, value, test.value)
+		}
+	}
+}
+
+func TestAdjustStaticRelocationsRejectsUnknownTypes(t *testing.T) {
+	staticRelocations := []elf.Rela64{
+		newRelocation(0x410, 0, elf.R_X86_64_COPY, 0),
+	}
+
+	layout := newTestLayout(t, buildLayoutTestELF(nil, staticRelocations))
+
+	err := layout.adjustStaticRelocations(layout.inputElf.Section(".rela.text"))
+	if err == nil || !strings.Contains(err.Error(), "R_X86_64_COPY") {
+		t.Errorf("got error %v, want an error about R_X86_64_COPY", err)
+	}
+}
+
+func TestAdjustDynamicRelocations(t *testing.T) {
+	dynamicRelocations := []elf.Rela64{
+		newRelocation(0x1000, 0, elf.R_X86_64_RELATIVE, 0x1028),
+		newRelocation(0x1008, 1, elf.R_X86_64_GLOB_DAT, 0),
+		newRelocation(0x1010, 1, elf.R_X86_64_DTPOFF64, 0),
+		newRelocation(0x1018, 1, elf.R_X86_64_64, 0),
+		newRelocation(0x1020, 1, elf.R_X86_64_DTPMOD64, 0),
+		newRelocation(0x1030, 1, elf.R_X86_64_TPOFF64, 0),
+		newRelocation(0x1038, 1, elf.R_X86_64_JMP_SLOT, 0),
+	}
+
+	layout := newTestLayout(t, buildLayoutTestELF(dynamicRelocations, nil))
+	relaSection := layout.inputElf.Section(".rela.dyn")
+
+	// .rela.dyn is in the code region, so it doesn't move
+	if err := layout.adjustDynamicRelocations(relaSection, relaSection.Offset); err != nil {
+		t.Fatalf("adjustDynamicRelocations: %s", err.Error())
+	}
+
+	tests := []struct {
+		description string
+		offset      uint64
+		addend      uint64
+		value       uint64
+	}{
+		{"RELATIVE", 0x1000 + _testRelroShift, 0x1028 + _testDataShift, 0x1028 + _testDataShift},
+		{"GLOB_DAT to code", 0x1008 + _testRelroShift, 0, 0x420},
+		{"DTPOFF64", 0x1010 + _testRelroShift, 0, 0x1004},
+		{"64", 0x1018 + _testRelroShift, 0, 0x1010 + _testRelroShift},
+		{"DTPMOD64", 0x1020 + _testDataShift, 0, 0x1008},
+		{"TPOFF64", 0x1030 + _testDataShift, 0, 0x1024},
+		{"JMP_SLOT to code", 0x1038 + _testDataShift, 0, 0x410},
+	}
+
+	for i, test := range tests {
+		entryOffset := relaSection.Offset + uint64(i*0x18)
+
+		if offset := readOutputUint64(layout, entryOffset); offset != test.offset {
+			t.Errorf("%s: relocation offset = 0x%X, want 0x%X", test.description, offset, test.offset)
+		}
+
+		if addend := readOutputUint64(layout, entryOffset+0x10); addend != test.addend {
+			t.Errorf("%s: relocation addend = 0x%X, want 0x%X", test.description, addend, test.addend)
+		}
+
+		// The layout's base is 0, so output offsets are the same as addresses
+		if value := readOutputUint64(layout, test.offset); value != test.value {
+			t.Errorf("%s: field at 0x%X = 0x%X, want 0x%X", test.description, test.offset, value, test.value)
+		}
+	}
+}
+
+func TestAdjustDynamicRelocationsReturnsReadErrors(t *testing.T) {
+	elfData := buildLayoutTestELF(nil, nil)
+
+	// Make .rela.dyn (section 2) reach past the end of the file, so it can't be read
+	sectionHeadersOffset := binary.LittleEndian.Uint64(elfData[0x28:])
+	putUint64(elfData, sectionHeadersOffset+2*0x40+0x20, uint64(len(elfData))*2)
+
+	layout := newTestLayout(t, elfData)
+	relaSection := layout.inputElf.Section(".rela.dyn")
+
+	if err := layout.adjustDynamicRelocations(relaSection, relaSection.Offset); err == nil {
+		t.Error("expected an error for a truncated relocation table")
+	}
+}
+
+func TestRelayoutELF(t *testing.T) {
+	staticRelocations := []elf.Rela64{
+		newRelocation(0x404, 0, elf.R_X86_64_PC32, -4),
+		newRelocation(0x410, 0, elf.R_X86_64_64, 0),
+	}
+
+	inputPath := filepath.Join(t.TempDir(), "input.elf")
+	outputPath := filepath.Join(t.TempDir(), "output.elf")
+
+	if err := ioutil.WriteFile(inputPath, buildLayoutTestELF(nil, staticRelocations), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RelayoutELF(inputPath, outputPath); err != nil {
+		t.Fatalf("RelayoutELF: %s", err.Error())
+	}
+
+	outputData, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(outputData)%_layoutPageSize != 0 {
+		t.Errorf("output is 0x%X bytes, want a multiple of 0x%X", len(outputData), _layoutPageSize)
+	}
+
+	outputElf := parseTestELF(t, outputData)
+
+	for _, want := range []struct {
+		name string
+		addr uint64
+	}{
+		{".text", 0x400},
+		{".data.rel.ro", 0x1000 + _testRelroShift},
+		{".got.plt", 0x1020 + _testDataShift},
+	} {
+		section := outputElf.Section(want.name)
+
+		if section == nil || section.Addr != want.addr || section.Offset != want.addr {
+			t.Errorf("%s is at %+v, want address and offset 0x%X", want.name, section, want.addr)
+		}
+	}
+
+	if value := binary.LittleEndian.Uint32(outputData[0x404:]); value != 0x1028+_testDataShift-(0x404+4) {
+		t.Errorf("PC32 field = 0x%X, want 0x%X", value, 0x1028+_testDataShift-(0x404+4))
+	}
+
+	if value := binary.LittleEndian.Uint64(outputData[0x410:]); value != 0x1008+_testRelroShift {
+		t.Errorf("64 field = 0x%X, want 0x%X", value, 0x1008+_testRelroShift)
+	}
+}
+
+func TestRelayoutELFRemovesOutputOnErrors(t *testing.T) {
+	inputPath := filepath.Join(t.TempDir(), "input.elf")
+	outputPath := filepath.Join(t.TempDir(), "output.elf")
+
+	staticRelocations := []elf.Rela64{
+		newRelocation(0x410, 0, elf.R_X86_64_COPY, 0),
+	}
+
+	if err := ioutil.WriteFile(inputPath, buildLayoutTestELF(nil, staticRelocations), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RelayoutELF(inputPath, outputPath); err == nil {
+		t.Fatal("expected an error for an R_X86_64_COPY static relocation")
+	}
+
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("output was left behind (stat error %v)", err)
+	}
+}
+
+// failingOutput is an io.WriterAt that fails every write.
+type failingOutput struct{}
+
+// WriteAt returns an error.
+func (failingOutput) WriteAt([]byte, int64) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestBuildReturnsWriteErrors(t *testing.T) {
+	elfData := buildLayoutTestELF(nil, []elf.Rela64{newRelocation(0x404, 0, elf.R_X86_64_PC32, -4)})
+
+	layout, err := planLayout(parseTestELF(t, elfData), bytes.NewReader(elfData), uint64(len(elfData)))
+	if err != nil {
+		t.Fatalf("planLayout: %s", err.Error())
+	}
+
+	layout.output = failingOutput{}
+
+	if err := layout.build(); err == nil || err.Error() != "disk full" {
+		t.Errorf("got error %v, want the write error", err)
+	}
+}
+
+// recordingOutput is a Layout output that keeps the size of the largest write made to it.
+type recordingOutput struct {
+	*overlayFile
+	largestWrite int
+}
+
+// WriteAt writes to the underlying overlayFile, and records the size of the write.
+func (output *recordingOutput) WriteAt(data []byte, offset int64) (int, error) {
+	if len(data) > output.largestWrite {
+		output.largestWrite = len(data)
+	}
+
+	return output.overlayFile.WriteAt(data, offset)
+}
+
+func TestPadToWritesInChunks(t *testing.T) {
+	output := &recordingOutput{overlayFile: newOverlayFile(bytes.NewReader(nil), 0)}
+	layout := &Layout{output: output}
+
+	layout.writeAt(0, []byte{1})
+	layout.padTo(0x123457)
+
+	if layout.outputErr != nil || layout.outputSize != 0x123457 || output.size != 0x123457 {
+		t.Fatalf("output is 0x%X bytes (0x%X written) with error %v, want 0x123457", layout.outputSize, output.size,
+			layout.outputErr)
+	}
+
+	if output.largestWrite > 0x10000 {
+		t.Errorf("largest write is 0x%X bytes, want at most 0x10000", output.largestWrite)
+	}
+
+	data := make([]byte, output.size)
+	_, _ = output.ReadAt(data, 0)
+
+	if data[0] != 1 || bytes.Count(data[1:], []byte{0}) != len(data)-1 {
+		t.Errorf("padding overwrote the data or isn't null bytes")
+	}
+}
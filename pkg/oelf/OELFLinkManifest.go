@@ -0,0 +1,232 @@
+package oelf
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// LinkManifest holds linking options that can't be expressed in the input ELF. It's read from a text file with one
+// directive per line, and '#' starting a comment:
+//
+//	optional libSceVrTracker          # the module may fail to load, its imports are weak
+//	pin sceKernelUsleep libScePosix   # import the symbol from this library, even if others define it too
+type LinkManifest struct {
+	// OptionalModules holds the names of modules (or libraries, which stand for the module they're in) that are
+	// imported weakly
+	OptionalModules map[string]bool
+
+	// SymbolLibraries maps the names of imported symbols to the library they're pinned to
+	SymbolLibraries map[string]string
+}
+
+// ParseLinkManifest takes the link manifest at the given path and parses it. Returns the manifest, or an error naming
+// the line of a directive that couldn't be parsed.
+func ParseLinkManifest(path string) (*LinkManifest, error) {
+	manifestData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &LinkManifest{
+		OptionalModules: make(map[string]bool),
+		SymbolLibraries: make(map[string]string),
+	}
+
+	for i, line := range strings.Split(string(manifestData), "\n") {
+		if commentStart := strings.Index(line, "#"); commentStart >= 0 {
+			line = line[:commentStart]
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "optional":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%s:%d: optional needs at least one module name", path, i+1)
+			}
+
+			for _, moduleName := range fields[1:] {
+				moduleName = strings.TrimSuffix(strings.TrimSuffix(moduleName, ".so"), ".prx")
+				manifest.OptionalModules[moduleName] = true
+			}
+		case "pin":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: pin needs a symbol name and a library name", path, i+1)
+			}
+
+			libraryName := strings.TrimSuffix(strings.TrimSuffix(fields[2], ".so"), ".prx")
+
+			if pinnedLibrary, ok := manifest.SymbolLibraries[fields[1]]; ok && pinnedLibrary != libraryName {
+				return nil, fmt.Errorf("%s:%d: '%s' is already pinned to %s", path, i+1, fields[1], pinnedLibrary)
+			}
+
+			manifest.SymbolLibraries[fields[1]] = libraryName
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown directive '%s'", path, i+1, fields[0])
+		}
+	}
+
+	return manifest, nil
+}
+
+// resolveSymbolLibrary takes the given input symbol and the indices of the libraries that define it (in link order),
+// and decides which one it's imported from. That's the library the link manifest pins it to, or the first one
+// otherwise. Returns the index of the library, or an error if the symbol is pinned to a library that doesn't define it.
+func (orbisElf *OrbisElf) resolveSymbolLibrary(symbol elf.Symbol, definingLibraries []int, libraryNames []string) (int, error) {
+	if orbisElf.LinkManifest == nil {
+		return definingLibraries[0], nil
+	}
+
+	pinnedLibrary, ok := orbisElf.LinkManifest.SymbolLibraries[symbol.Name]
+	if !ok {
+		return definingLibraries[0], nil
+	}
+
+	for _, i := range definingLibraries {
+		if libraryNames[i] == pinnedLibrary {
+			return i, nil
+		}
+	}
+
+	if contains(libraryNames, pinnedLibrary) {
+		return 0, fmt.Errorf("link manifest pins '%s' to %s, but %s doesn't define it", symbol.Name, pinnedLibrary,
+			pinnedLibrary)
+	}
+
+	return 0, fmt.Errorf("link manifest pins '%s' to %s, but %s isn't linked", symbol.Name, pinnedLibrary, pinnedLibrary)
+}
+
+// checkSymbolPins takes the given input symbols and records a warning for each symbol the link manifest pins that
+// isn't one of them. Pins are checked by name, in sorted order.
+func (orbisElf *OrbisElf) checkSymbolPins(symbols []elf.Symbol) {
+	if orbisElf.LinkManifest == nil {
+		return
+	}
+
+	symbolNames := make(map[string]bool)
+
+	for _, symbol := range symbols {
+		symbolNames[symbol.Name] = true
+	}
+
+	pinnedSymbols := make([]string, 0, len(orbisElf.LinkManifest.SymbolLibraries))
+
+	for symbolName := range orbisElf.LinkManifest.SymbolLibraries {
+		pinnedSymbols = append(pinnedSymbols, symbolName)
+	}
+
+	sort.Strings(pinnedSymbols)
+
+	for _, symbolName := range pinnedSymbols {
+		if !symbolNames[symbolName] {
+			orbisElf.warn("link manifest pins '%s' to %s, but it isn't imported", symbolName,
+				orbisElf.LinkManifest.SymbolLibraries[symbolName])
+		}
+	}
+}
+
+// getImportModule takes the given imported symbol name and finds the library it's imported from, and the module that
+// library is in. Returns the library and module names, which are empty if the symbol isn't imported from any library.
+func (orbisElf *OrbisElf) getImportModule(symbolName string) (string, string) {
+	libraryName, ok := orbisElf.ImportLibraries[symbolName]
+	if !ok {
+		return "", ""
+	}
+
+	moduleName, _ := orbisElf.LibraryModuleDictionary.Get(libraryName).(string)
+	return libraryName, moduleName
+}
+
+// resolveOptionalModules decides which imported modules are optional, which are the ones marked as optional by the
+// link manifest, and the ones that only weak undefined symbols of the input ELF are imported from. Returns an error if
+// the manifest marks a module that can't be optional, nil otherwise. Marked modules are checked by name, in sorted
+// order.
+func (orbisElf *OrbisElf) resolveOptionalModules() error {
+	orbisElf.OptionalModules = make(map[string]bool)
+
+	if orbisElf.LinkManifest != nil {
+		markedModules := make([]string, 0, len(orbisElf.LinkManifest.OptionalModules))
+
+		for moduleName := range orbisElf.LinkManifest.OptionalModules {
+			markedModules = append(markedModules, moduleName)
+		}
+
+		sort.Strings(markedModules)
+
+		for _, moduleName := range markedModules {
+			// A library stands for the module it's in
+			if libraryModule, ok := orbisElf.LibraryModuleDictionary.Get(moduleName).(string); ok {
+				moduleName = libraryModule
+			}
+
+			if !contains(orbisElf.ModuleList, moduleName) {
+				orbisElf.warn("link manifest marks %s as optional, but it isn't imported", moduleName)
+				continue
+			}
+
+			// The process can't start without libkernel, and libc is always needed through Need_sceLibc
+			if moduleName == "libkernel" || moduleName == "libc" {
+				return fmt.Errorf("link manifest marks %s as optional, but it's always needed", moduleName)
+			}
+
+			orbisElf.OptionalModules[moduleName] = true
+		}
+	}
+
+	// Modules that are only imported from weakly are optional too
+	symbols, _ := orbisElf.getDynamicSymbols()
+	hasStrongImports := make(map[string]bool)
+	hasWeakImports := make(map[string]bool)
+
+	for _, symbol := range symbols {
+		if symbol.Section != elf.SHN_UNDEF || symbol.Name == "" {
+			continue
+		}
+
+		_, moduleName := orbisElf.getImportModule(symbol.Name)
+
+		if elf.ST_BIND(symbol.Info) == elf.STB_WEAK {
+			hasWeakImports[moduleName] = true
+		} else {
+			hasStrongImports[moduleName] = true
+		}
+	}
+
+	for _, moduleName := range orbisElf.ModuleList {
+		if hasWeakImports[moduleName] && !hasStrongImports[moduleName] && moduleName != "libkernel" &&
+			moduleName != "libc" {
+			orbisElf.OptionalModules[moduleName] = true
+		}
+	}
+
+	return nil
+}
+
+// isWeakImport takes the given undefined symbol of the input ELF and checks if it's imported weakly, either because
+// it's weak in the input ELF or because it's imported from an optional module. Returns true if it's a weak import.
+func (orbisElf *OrbisElf) isWeakImport(symbol elf.Symbol) bool {
+	if elf.ST_BIND(symbol.Info) == elf.STB_WEAK {
+		return true
+	}
+
+	_, moduleName := orbisElf.getImportModule(symbol.Name)
+	return orbisElf.OptionalModules[moduleName]
+}
+
+// isOptionalLibrary takes the given imported library name and checks if the module it's in is optional. Returns true if
+// the library is optional.
+func (orbisElf *OrbisElf) isOptionalLibrary(libraryName string) bool {
+	if moduleName, ok := orbisElf.LibraryModuleDictionary.Get(libraryName).(string); ok {
+		return orbisElf.OptionalModules[moduleName]
+	}
+
+	// Libraries that aren't in the dictionary are named after their module
+	return orbisElf.OptionalModules[libraryName]
+}
@@ -0,0 +1,381 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestManifest writes the given link manifest to a new file. Returns its path.
+func writeTestManifest(t *testing.T, manifest string) string {
+	t.Helper()
+
+	manifestPath := filepath.Join(t.TempDir(), "link.manifest")
+
+	if err := ioutil.WriteFile(manifestPath, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return manifestPath
+}
+
+func TestParseLinkManifest(t *testing.T) {
+	tests := []struct {
+		name            string
+		manifest        string
+		optionalModules map[string]bool
+		symbolLibraries map[string]string
+		err             string
+	}{
+		{"empty", "", map[string]bool{}, map[string]string{}, ""},
+		{"comments only", "# nothing here\n\n   # or here\n", map[string]bool{}, map[string]string{}, ""},
+		{
+			"directives",
+			"optional libSceVrTracker libSceNpToolkit.prx # weak\n" +
+				"pin sceKernelUsleep libScePosix.so\n" +
+				"\toptional libSceAudio3d.so\n" +
+				"pin sceKernelUsleep libScePosix\n",
+			map[string]bool{"libSceVrTracker": true, "libSceNpToolkit": true, "libSceAudio3d": true},
+			map[string]string{"sceKernelUsleep": "libScePosix"},
+			"",
+		},
+		{"optional without modules", "optional # none\n", nil, nil, ":1: optional needs at least one module name"},
+		{"pin without a library", "\npin sceKernelUsleep\n", nil, nil, ":2: pin needs a symbol name and a library name"},
+		{
+			"pinned twice",
+			"pin sceKernelUsleep libScePosix\npin sceKernelUsleep libkernel\n",
+			nil,
+			nil,
+			":2: 'sceKernelUsleep' is already pinned to libScePosix",
+		},
+		{"unknown directive", "weak libSceVrTracker\n", nil, nil, ":1: unknown directive 'weak'"},
+	}
+
+	for _, test := range tests {
+		manifest, err := ParseLinkManifest(writeTestManifest(t, test.manifest))
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		if !reflect.DeepEqual(manifest.OptionalModules, test.optionalModules) {
+			t.Errorf("%s: optional modules are %v, want %v", test.name, manifest.OptionalModules, test.optionalModules)
+		}
+
+		if !reflect.DeepEqual(manifest.SymbolLibraries, test.symbolLibraries) {
+			t.Errorf("%s: pins are %v, want %v", test.name, manifest.SymbolLibraries, test.symbolLibraries)
+		}
+	}
+}
+
+// buildTestWeakImportELF builds an ELF that needs the given libraries and imports the given symbols through .dynsym,
+// weakly if they're in weakImports. Returns the ELF data.
+func buildTestWeakImportELF(imports []string, weakImports map[string]bool, neededLibraries []string) []byte {
+	stringTable, nameOffsets := encodeStringTable(append(append([]string(nil), neededLibraries...), imports...))
+	symbols := make([]elf.Sym64, len(imports))
+
+	for i, symbolName := range imports {
+		symbolBind := elf.STB_GLOBAL
+
+		if weakImports[symbolName] {
+			symbolBind = elf.STB_WEAK
+		}
+
+		symbols[i] = elf.Sym64{Name: nameOffsets[len(neededLibraries)+i], Info: elf.ST_INFO(symbolBind, elf.STT_FUNC)}
+	}
+
+	dynamicEntries := make([]elf.Dyn64, len(neededLibraries))
+
+	for i := range neededLibraries {
+		dynamicEntries[i] = elf.Dyn64{Tag: int64(elf.DT_NEEDED), Val: uint64(nameOffsets[i])}
+	}
+
+	return buildTestELF(elf.ET_DYN, nil, []testSection{
+		{Name: ".dynamic", Type: elf.SHT_DYNAMIC, Data: encodeDynamicTable(dynamicEntries), Link: 2, Entsize: 0x10},
+		{Name: ".dynstr", Type: elf.SHT_STRTAB, Data: stringTable},
+		{Name: ".dynsym", Type: elf.SHT_DYNSYM, Data: encodeSymbols(symbols), Link: 2, Info: 1, Entsize: 0x18},
+	})
+}
+
+func TestResolveOptionalModules(t *testing.T) {
+	// libkernel, libSceBench1, libSceBench2, and libSceBench3 define sceBench<N>Function0 and sceBench<N>Function1
+	sdkPath, _ := writeTestStubLibraries(t, 4, 2)
+
+	imports := []string{"sceBench0Function0", "sceBench1Function0", "sceBench1Function1", "sceBench2Function0",
+		"sceBench3Function0"}
+	neededLibraries := []string{"libkernel.so", "libSceBench1.so", "libSceBench2.so", "libSceBench3.so"}
+
+	// Only libSceBench2 is imported from weakly alone, and libkernel is never optional
+	weakImports := map[string]bool{"sceBench0Function0": true, "sceBench1Function0": true, "sceBench2Function0": true}
+
+	elfData := buildTestWeakImportELF(imports, weakImports, neededLibraries)
+
+	tests := []struct {
+		name            string
+		manifest        string
+		optionalModules map[string]bool
+		warnings        []string
+		err             string
+	}{
+		{"no manifest", "", map[string]bool{"libSceBench2": true}, nil, ""},
+		{
+			"marked module",
+			"optional libSceBench3\n",
+			map[string]bool{"libSceBench2": true, "libSceBench3": true},
+			nil,
+			"",
+		},
+		{
+			"marked library",
+			"optional libSceBench1.so\n",
+			map[string]bool{"libSceBench1": true, "libSceBench2": true},
+			nil,
+			"",
+		},
+		{
+			"marked modules that aren't imported",
+			"optional libSceZeta libSceBench3 libSceAlpha\noptional libSceMu.prx libSceDelta\n",
+			map[string]bool{"libSceBench2": true, "libSceBench3": true},
+			[]string{
+				"link manifest marks libSceAlpha as optional, but it isn't imported",
+				"link manifest marks libSceDelta as optional, but it isn't imported",
+				"link manifest marks libSceMu as optional, but it isn't imported",
+				"link manifest marks libSceZeta as optional, but it isn't imported",
+			},
+			"",
+		},
+		{
+			"marked libkernel",
+			"optional libkernel.so\n",
+			nil,
+			nil,
+			"link manifest marks libkernel as optional, but it's always needed",
+		},
+	}
+
+	for _, test := range tests {
+		orbisElf := &OrbisElf{
+			ElfToConvert: parseTestELF(t, elfData),
+			output:       newOverlayFile(bytes.NewReader(elfData), int64(len(elfData))),
+		}
+
+		if test.manifest != "" {
+			manifest, err := ParseLinkManifest(writeTestManifest(t, test.manifest))
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err.Error())
+			}
+
+			orbisElf.LinkManifest = manifest
+		}
+
+		if err := orbisElf.GenerateLibrarySymbolDictionary(sdkPath, ""); err != nil {
+			t.Fatalf("%s: GenerateLibrarySymbolDictionary: %s", test.name, err.Error())
+		}
+
+		err := orbisElf.resolveOptionalModules()
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		if !reflect.DeepEqual(orbisElf.OptionalModules, test.optionalModules) {
+			t.Errorf("%s: optional modules are %v, want %v", test.name, orbisElf.OptionalModules, test.optionalModules)
+		}
+
+		if !reflect.DeepEqual(orbisElf.Warnings, test.warnings) {
+			t.Errorf("%s: got warnings %q, want %q", test.name, orbisElf.Warnings, test.warnings)
+		}
+	}
+}
+
+func TestResolveSymbolLibrary(t *testing.T) {
+	libraryNames := []string{"libkernel", "libScePosix", "libSceLibcInternal"}
+	symbol := elf.Symbol{Name: "sceKernelUsleep", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)}
+
+	tests := []struct {
+		name              string
+		manifest          string
+		definingLibraries []int
+		library           int
+		err               string
+	}{
+		{"no manifest", "", []int{1, 0}, 1, ""},
+		{"not pinned", "pin sceKernelNanosleep libkernel\n", []int{1, 0}, 1, ""},
+		{"pinned to a later library", "pin sceKernelUsleep libkernel\n", []int{1, 0}, 0, ""},
+		{"pinned to the first library", "pin sceKernelUsleep libScePosix.so\n", []int{1, 0}, 1, ""},
+		{
+			"pinned to a library that doesn't define it",
+			"pin sceKernelUsleep libSceLibcInternal\n",
+			[]int{1, 0},
+			0,
+			"link manifest pins 'sceKernelUsleep' to libSceLibcInternal, but libSceLibcInternal doesn't define it",
+		},
+		{
+			"pinned to a library that isn't linked",
+			"pin sceKernelUsleep libSceFios2\n",
+			[]int{1, 0},
+			0,
+			"link manifest pins 'sceKernelUsleep' to libSceFios2, but libSceFios2 isn't linked",
+		},
+	}
+
+	for _, test := range tests {
+		orbisElf := &OrbisElf{}
+
+		if test.manifest != "" {
+			manifest, err := ParseLinkManifest(writeTestManifest(t, test.manifest))
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err.Error())
+			}
+
+			orbisElf.LinkManifest = manifest
+		}
+
+		library, err := orbisElf.resolveSymbolLibrary(symbol, test.definingLibraries, libraryNames)
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil || library != test.library {
+			t.Errorf("%s: got library %d (error %v), want %d", test.name, library, err, test.library)
+		}
+	}
+}
+
+func TestCheckSymbolPins(t *testing.T) {
+	manifest, err := ParseLinkManifest(writeTestManifest(t, "pin sceKernelUsleep libScePosix\n"+
+		"pin sceKernelNanosleep libScePosix\npin sceKernelSleep libkernel\npin sceKernelGetpid libkernel\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orbisElf := &OrbisElf{LinkManifest: manifest}
+	orbisElf.checkSymbolPins([]elf.Symbol{{Name: "sceKernelUsleep"}, {Name: "sceKernelGetpid"}})
+
+	wantWarnings := []string{
+		"link manifest pins 'sceKernelNanosleep' to libScePosix, but it isn't imported",
+		"link manifest pins 'sceKernelSleep' to libkernel, but it isn't imported",
+	}
+
+	if !reflect.DeepEqual(orbisElf.Warnings, wantWarnings) {
+		t.Errorf("got warnings %q, want %q", orbisElf.Warnings, wantWarnings)
+	}
+}
+
+func TestGenerateLibrarySymbolDictionaryResolvesDuplicates(t *testing.T) {
+	// libSceFirst and libSceSecond both define sceShared, libSceThird only defines sceOther
+	sdkPath := t.TempDir()
+	libDir := filepath.Join(sdkPath, "lib")
+	stubSymbols := map[string][]string{
+		"libkernel.so":    {"sceKernelUsleep"},
+		"libSceFirst.so":  {"sceShared"},
+		"libSceSecond.so": {"sceShared"},
+		"libSceThird.so":  {"sceOther"},
+	}
+
+	if err := os.MkdirAll(libDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for library, symbols := range stubSymbols {
+		if err := ioutil.WriteFile(filepath.Join(libDir, library), buildTestSymbolELF(elf.ET_DYN, symbols, true, nil),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	elfData := buildTestSymbolELF(elf.ET_DYN, []string{"sceKernelUsleep", "sceShared", "sceOther"}, false,
+		[]string{"libkernel.so", "libSceFirst.so", "libSceSecond.so", "libSceThird.so"})
+
+	tests := []struct {
+		name     string
+		manifest string
+		library  string
+		warnings []string
+		err      string
+	}{
+		{
+			"link order",
+			"",
+			"libSceFirst",
+			[]string{"libSceFirst, libSceSecond all define the same 1 import(s), they're imported from libSceFirst (pin " +
+				"them to a library in the link manifest to change it)"},
+			"",
+		},
+		{"pinned", "pin sceShared libSceSecond\n", "libSceSecond", nil, ""},
+		{
+			"pinned to a library that doesn't define it",
+			"pin sceShared libSceThird\n",
+			"",
+			nil,
+			"link manifest pins 'sceShared' to libSceThird, but libSceThird doesn't define it",
+		},
+	}
+
+	for _, test := range tests {
+		orbisElf := &OrbisElf{
+			ElfToConvert: parseTestELF(t, elfData),
+			output:       newOverlayFile(bytes.NewReader(elfData), int64(len(elfData))),
+		}
+
+		if test.manifest != "" {
+			manifest, err := ParseLinkManifest(writeTestManifest(t, test.manifest))
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err.Error())
+			}
+
+			orbisElf.LinkManifest = manifest
+		}
+
+		err := orbisElf.GenerateLibrarySymbolDictionary(sdkPath, "")
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		if library := orbisElf.ImportLibraries["sceShared"]; library != test.library {
+			t.Errorf("%s: sceShared is imported from %s, want %s", test.name, library, test.library)
+		}
+
+		if !reflect.DeepEqual(orbisElf.Warnings, test.warnings) {
+			t.Errorf("%s: got warnings %q, want %q", test.name, orbisElf.Warnings, test.warnings)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// LayoutLint holds the problems found in the program headers of an Orbis ELF. Errors would stop the module from loading
+// correctly, warnings are only suspicious.
+type LayoutLint struct {
+	Errors   []string
+	Warnings []string
+}
+
+// LintELF takes the given Orbis ELF data (ie. the -out file, or the ELF unpacked from an FSELF) and checks its program
+// headers against its sections and size. Returns the problems found, or an error if the ELF couldn't be parsed.
+func LintELF(elfData []byte) (*LayoutLint, error) {
+	inputElf, err := elf.NewFile(bytes.NewReader(elfData))
+	if err != nil {
+		return nil, err
+	}
+
+	lint := lintLayout(inputElf.Progs, inputElf.Sections, uint64(len(elfData)))
+
+	// The null section is always there, even without a section header table
+	if len(inputElf.Sections) <= 1 {
+		lint.Warnings = append(lint.Warnings, "no section headers (ie. an fself built without -keep-sections), section "+
+			"coverage wasn't checked")
+	}
+
+	return lint, nil
+}
+
+// validateLayout runs the lint checks on the generated program headers, for use at the end of GenerateProgramHeaders.
+// Warnings are added to the OrbisElf's warnings. Returns an error listing every problem found, nil otherwise.
+func (orbisElf *OrbisElf) validateLayout() error {
+	lint := lintLayout(orbisElf.ProgramHeaders, orbisElf.ElfToConvert.Sections, uint64(orbisElf.output.size))
+
+	for _, warning := range lint.Warnings {
+		orbisElf.warn("%s", warning)
+	}
+
+	if len(lint.Errors) > 0 {
+		return errors.New(strings.Join(lint.Errors, "; "))
+	}
+
+	return nil
+}
+
+// lintLayout takes the given program headers and checks that the load segments (PT_LOAD and PT_SCE_RELRO) don't
+// overlap and can be mapped page by page, that PT_SCE_RELRO runs up to the data segment in memory and in the file, that
+// no segment reaches past the end of the file or wraps around the address space, and that the given sections are each
+// mapped exactly once. The headers may come from any file, so sums are checked for overflow. Returns the problems found.
+func lintLayout(progHeaders []*elf.Prog, sections []*elf.Section, fileSize uint64) *LayoutLint {
+	lint := &LayoutLint{}
+	loadSegments := make([]*elf.Prog, 0)
+
+	var relroSegment, dataSegment *elf.Prog
+
+	for _, progHeader := range progHeaders {
+		if progHeader.Filesz > fileSize || progHeader.Off > fileSize-progHeader.Filesz {
+			lint.Errors = append(lint.Errors, fmt.Sprintf("%s reaches past the end of the file (0x%X bytes)",
+				describeSegment(progHeader), fileSize))
+		}
+
+		// The remaining checks compare segment ends, which are meaningless for a segment that wraps around
+		if progHeader.Vaddr > math.MaxUint64-progHeader.Memsz {
+			lint.Errors = append(lint.Errors, fmt.Sprintf("%s at 0x%X of 0x%X bytes wraps around the address space",
+				getProgramHeaderTypeName(progHeader.Type), progHeader.Vaddr, progHeader.Memsz))
+			continue
+		}
+
+		if progHeader.Type != elf.PT_LOAD && progHeader.Type != PT_SCE_RELRO {
+			continue
+		}
+
+		// Segments are mapped page by page straight from the file, so offsets and addresses have to agree on the page
+		if progHeader.Off%_layoutPageSize != progHeader.Vaddr%_layoutPageSize {
+			lint.Errors = append(lint.Errors, fmt.Sprintf("%s has a file offset and address that differ modulo 0x%X, it "+
+				"can't be mapped (try -relayout)", describeSegment(progHeader), _layoutPageSize))
+		}
+
+		for _, loadSegment := range loadSegments {
+			if segmentsOverlap(loadSegment, progHeader) {
+				lint.Errors = append(lint.Errors, fmt.Sprintf("%s overlaps %s", describeSegment(progHeader),
+					describeSegment(loadSegment)))
+			}
+		}
+
+		loadSegments = append(loadSegments, progHeader)
+
+		if progHeader.Type == PT_SCE_RELRO {
+			relroSegment = progHeader
+		} else if progHeader.Flags&elf.PF_W != 0 && dataSegment == nil {
+			dataSegment = progHeader
+		}
+	}
+
+	// A gap between relro and the data segment would leave an unmapped hole at runtime
+	if relroSegment != nil && dataSegment != nil {
+		if relroSegment.Vaddr > dataSegment.Vaddr || dataSegment.Vaddr-relroSegment.Vaddr != relroSegment.Memsz {
+			lint.Errors = append(lint.Errors, fmt.Sprintf("%s doesn't end where %s starts in memory",
+				describeSegment(relroSegment), describeSegment(dataSegment)))
+		}
+
+		if relroSegment.Off > dataSegment.Off || dataSegment.Off-relroSegment.Off != relroSegment.Filesz {
+			lint.Errors = append(lint.Errors, fmt.Sprintf("%s doesn't end where %s starts in the file",
+				describeSegment(relroSegment), describeSegment(dataSegment)))
+		}
+	}
+
+	lint.Errors = append(lint.Errors, lintSectionCoverage(progHeaders, sections)...)
+	return lint
+}
+
+// lintSectionCoverage makes sure every allocated section is mapped by exactly one of the given load segments (PT_LOAD
+// or PT_SCE_RELRO), so nothing falls into a hole or gets mapped twice. `.tbss` isn't loaded, so it's checked against
+// PT_TLS instead. The input's `.dynamic` is replaced by the generated dynamic table, so it doesn't need to be mapped.
+// Returns a problem for each section that isn't.
+func lintSectionCoverage(progHeaders []*elf.Prog, sections []*elf.Section) []string {
+	problems := make([]string, 0)
+
+	for _, section := range sections {
+		if section.Flags&elf.SHF_ALLOC == 0 || section.Size == 0 || section.Type == elf.SHT_DYNAMIC {
+			continue
+		}
+
+		isTLSTemplate := section.Type == elf.SHT_NOBITS && section.Flags&elf.SHF_TLS != 0
+		mappingSegments := make([]*elf.Prog, 0)
+
+		for _, progHeader := range progHeaders {
+			if isTLSTemplate {
+				if progHeader.Type != elf.PT_TLS {
+					continue
+				}
+			} else if progHeader.Type != elf.PT_LOAD && progHeader.Type != PT_SCE_RELRO {
+				continue
+			}
+
+			if segmentCoversSection(progHeader, section) {
+				mappingSegments = append(mappingSegments, progHeader)
+			}
+		}
+
+		sectionDescription := fmt.Sprintf("%s at 0x%X-0x%X", section.Name, section.Addr, section.Addr+section.Size)
+
+		if len(mappingSegments) == 0 && isTLSTemplate {
+			problems = append(problems, fmt.Sprintf("%s isn't covered by PT_TLS", sectionDescription))
+		} else if len(mappingSegments) == 0 {
+			problems = append(problems, fmt.Sprintf("%s isn't mapped by any load segment", sectionDescription))
+		} else if len(mappingSegments) > 1 {
+			problems = append(problems, fmt.Sprintf("%s is mapped by both %s and %s", sectionDescription,
+				describeSegment(mappingSegments[0]), describeSegment(mappingSegments[1])))
+		}
+	}
+
+	return problems
+}
+
+// segmentCoversSection returns true if the given program header maps all of the given section's memory. The file
+// offset of NOBITS sections isn't meaningful, so only PROGBITS sections need to be in step with the segment.
+func segmentCoversSection(progHeader *elf.Prog, section *elf.Section) bool {
+	// Compared as distances from the segment's start, so neither end can overflow
+	if section.Addr < progHeader.Vaddr || section.Size > progHeader.Memsz ||
+		section.Addr-progHeader.Vaddr > progHeader.Memsz-section.Size {
+		return false
+	}
+
+	return section.Type == elf.SHT_NOBITS || section.Addr-section.Offset == progHeader.Vaddr-progHeader.Off
+}
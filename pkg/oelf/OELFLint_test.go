@@ -0,0 +1,192 @@
+package oelf
+
+import (
+	"debug/elf"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestSegment returns a program header of the given type and flags, mapping filesz bytes at the given offset to
+// memsz bytes at the given address.
+func newTestSegment(progType elf.ProgType, flags elf.ProgFlag, off uint64, vaddr uint64, filesz uint64, memsz uint64) *elf.Prog {
+	return &elf.Prog{
+		ProgHeader: elf.ProgHeader{
+			Type:   progType,
+			Flags:  flags,
+			Off:    off,
+			Vaddr:  vaddr,
+			Filesz: filesz,
+			Memsz:  memsz,
+			Align:  0x4000,
+		},
+	}
+}
+
+// newTestSection returns an allocated section of the given type and flags, with size bytes at the given address and
+// offset.
+func newTestSection(name string, sectionType elf.SectionType, flags elf.SectionFlag, addr uint64, offset uint64, size uint64) *elf.Section {
+	return &elf.Section{
+		SectionHeader: elf.SectionHeader{
+			Name:   name,
+			Type:   sectionType,
+			Flags:  elf.SHF_ALLOC | flags,
+			Addr:   addr,
+			Offset: offset,
+			Size:   size,
+		},
+	}
+}
+
+func TestLintLayout(t *testing.T) {
+	const fileSize = 0x10000
+
+	code := newTestSegment(elf.PT_LOAD, elf.PF_R|elf.PF_X, 0x0, 0x0, 0x1000, 0x1000)
+	relro := newTestSegment(PT_SCE_RELRO, elf.PF_R, 0x4000, 0x4000, 0x4000, 0x4000)
+	data := newTestSegment(elf.PT_LOAD, elf.PF_R|elf.PF_W, 0x8000, 0x8000, 0x100, 0x200)
+
+	sections := []*elf.Section{
+		newTestSection(".text", elf.SHT_PROGBITS, elf.SHF_EXECINSTR, 0x100, 0x100, 0x100),
+		newTestSection(".data.rel.ro", elf.SHT_PROGBITS, elf.SHF_WRITE, 0x4000, 0x4000, 0x100),
+		newTestSection(".data", elf.SHT_PROGBITS, elf.SHF_WRITE, 0x8000, 0x8000, 0x100),
+		newTestSection(".bss", elf.SHT_NOBITS, elf.SHF_WRITE, 0x8100, 0x8100, 0x100),
+	}
+
+	tbss := newTestSection(".tbss", elf.SHT_NOBITS, elf.SHF_WRITE|elf.SHF_TLS, 0x8100, 0x8100, 0x40)
+
+	tests := []struct {
+		name          string
+		progHeaders   []*elf.Prog
+		extraSections []*elf.Section
+		errors        []string
+	}{
+		{"valid", []*elf.Prog{code, relro, data}, nil, nil},
+		{
+			"past the end",
+			[]*elf.Prog{code, relro, newTestSegment(elf.PT_LOAD, elf.PF_R|elf.PF_W, 0x8000, 0x8000, 0x9000, 0x9000)},
+			nil,
+			[]string{"PT_LOAD [R|W] 0x8000-0x11000 (offset 0x8000) reaches past the end of the file (0x10000 bytes)"},
+		},
+		{
+			"file end overflows",
+			[]*elf.Prog{code, relro, newTestSegment(elf.PT_LOAD, elf.PF_R|elf.PF_W, 0x8000, 0x8000, math.MaxUint64-0x7FFF, 0x200)},
+			nil,
+			[]string{"PT_LOAD [R|W] 0x8000-0x8200 (offset 0x8000) reaches past the end of the file (0x10000 bytes)"},
+		},
+		{
+			"address end overflows",
+			[]*elf.Prog{code, relro, data, newTestSegment(elf.PT_LOAD, elf.PF_R, 0x0, 0xFFFFFFFFFFFFC000, 0x0, 0x8000)},
+			nil,
+			[]string{"PT_LOAD at 0xFFFFFFFFFFFFC000 of 0x8000 bytes wraps around the address space"},
+		},
+		{
+			"offset and address out of step",
+			[]*elf.Prog{code, relro, data, newTestSegment(elf.PT_LOAD, elf.PF_R, 0x1000, 0xE800, 0x100, 0x100)},
+			nil,
+			[]string{"PT_LOAD [R] 0xE800-0xE900 (offset 0x1000) has a file offset and address that differ modulo 0x4000, it " +
+				"can't be mapped (try -relayout)"},
+		},
+		{
+			"overlapping segments",
+			[]*elf.Prog{code, relro, data, newTestSegment(elf.PT_LOAD, elf.PF_R, 0x800, 0x800, 0x1000, 0x1000)},
+			nil,
+			[]string{
+				"PT_LOAD [R] 0x800-0x1800 (offset 0x800) overlaps PT_LOAD [R|X] 0x0-0x1000 (offset 0x0)",
+			},
+		},
+		{
+			"relro ends before data in memory",
+			[]*elf.Prog{code, newTestSegment(PT_SCE_RELRO, elf.PF_R, 0x4000, 0x4000, 0x4000, 0x3000), data},
+			nil,
+			[]string{"PT_SCE_RELRO [R] 0x4000-0x7000 (offset 0x4000) doesn't end where PT_LOAD [R|W] 0x8000-0x8200 " +
+				"(offset 0x8000) starts in memory"},
+		},
+		{
+			"relro ends before data in the file",
+			[]*elf.Prog{code, newTestSegment(PT_SCE_RELRO, elf.PF_R, 0x4000, 0x4000, 0x3000, 0x4000), data},
+			nil,
+			[]string{"PT_SCE_RELRO [R] 0x4000-0x8000 (offset 0x4000) doesn't end where PT_LOAD [R|W] 0x8000-0x8200 " +
+				"(offset 0x8000) starts in the file"},
+		},
+		{
+			"unmapped section",
+			[]*elf.Prog{code, relro, data},
+			[]*elf.Section{newTestSection(".rodata", elf.SHT_PROGBITS, 0, 0x2000, 0x2000, 0x100)},
+			[]string{".rodata at 0x2000-0x2100 isn't mapped by any load segment"},
+		},
+		{
+			"section mapped twice",
+			[]*elf.Prog{code, relro, data, newTestSegment(elf.PT_LOAD, elf.PF_R, 0x0, 0x0, 0x400, 0x400)},
+			nil,
+			[]string{
+				"PT_LOAD [R] 0x0-0x400 (offset 0x0) overlaps PT_LOAD [R|X] 0x0-0x1000 (offset 0x0)",
+				".text at 0x100-0x200 is mapped by both PT_LOAD [R|X] 0x0-0x1000 (offset 0x0) and PT_LOAD [R] 0x0-0x400 " +
+					"(offset 0x0)",
+			},
+		},
+		{
+			".tbss without PT_TLS",
+			[]*elf.Prog{code, relro, data},
+			[]*elf.Section{tbss},
+			[]string{".tbss at 0x8100-0x8140 isn't covered by PT_TLS"},
+		},
+		{
+			".tbss with PT_TLS",
+			[]*elf.Prog{code, relro, data, newTestSegment(elf.PT_TLS, elf.PF_R, 0x8100, 0x8100, 0x0, 0x40)},
+			[]*elf.Section{tbss},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		lint := lintLayout(test.progHeaders, append(append([]*elf.Section(nil), sections...), test.extraSections...),
+			fileSize)
+
+		wantErrors := test.errors
+
+		if wantErrors == nil {
+			wantErrors = []string{}
+		}
+
+		if errors := append([]string{}, lint.Errors...); !reflect.DeepEqual(errors, wantErrors) {
+			t.Errorf("%s: got errors %q, want %q", test.name, errors, wantErrors)
+		}
+
+		if len(lint.Warnings) != 0 {
+			t.Errorf("%s: got warnings %q, want none", test.name, lint.Warnings)
+		}
+	}
+}
+
+func TestLintELFWithoutSectionHeaders(t *testing.T) {
+	progHeaders := []elf.Prog64{
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_X), Filesz: 0x1000, Memsz: 0x1000, Align: 0x4000},
+	}
+
+	for _, stripSections := range []bool{false, true} {
+		elfData := buildTestELF(elf.ET_DYN, progHeaders, []testSection{
+			{Name: ".text", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR, Addr: 0x100, Offset: 0x100,
+				Size: 0x100},
+		})
+
+		if stripSections {
+			stripTestSectionHeaders(elfData)
+		}
+
+		lint, err := LintELF(elfData)
+		if err != nil {
+			t.Fatalf("stripped sections %v: %s", stripSections, err.Error())
+		}
+
+		if len(lint.Errors) != 0 {
+			t.Errorf("stripped sections %v: got errors %q, want none", stripSections, lint.Errors)
+		}
+
+		warned := len(lint.Warnings) == 1 && strings.HasPrefix(lint.Warnings[0], "no section headers")
+
+		if warned != stripSections {
+			t.Errorf("stripped sections %v: got warnings %q", stripSections, lint.Warnings)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package oelf
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+// loadSegmentKind describes what a PT_LOAD segment of the input ELF maps, based on its permissions.
+type loadSegmentKind int
+
+const (
+	loadSegmentReadOnly loadSegmentKind = iota
+	loadSegmentCode
+	loadSegmentData
+)
+
+// getLoadSegmentKind takes a given PT_LOAD program header and classifies it as read-only, code, or data. Returns the
+// kind, or an error if the segment is both writable and executable, since the PS4 won't map those.
+func getLoadSegmentKind(progHeader *elf.Prog) (loadSegmentKind, error) {
+	isExecutable := progHeader.Flags&elf.PF_X != 0
+	isWritable := progHeader.Flags&elf.PF_W != 0
+
+	switch {
+	case isExecutable && isWritable:
+		return 0, fmt.Errorf("%s is both writable and executable, which isn't supported", describeSegment(progHeader))
+	case isExecutable:
+		return loadSegmentCode, nil
+	case isWritable:
+		return loadSegmentData, nil
+	default:
+		return loadSegmentReadOnly, nil
+	}
+}
+
+// mergeLoadSegments takes the given segments of one kind and merges them into a single PT_LOAD with the given flags,
+// covering all of them including any holes in between. This is only possible if each segment sits at the same distance
+// between its file offset and virtual address, since a single segment is mapped as one contiguous chunk of the file.
+// Returns the merged program header, or an error if the segments can't be merged.
+func mergeLoadSegments(kindName string, flags elf.ProgFlag, segments []*elf.Prog) (*elf.Prog, error) {
+	if len(segments) == 0 {
+		return nil, nil
+	}
+
+	first := segments[0]
+	merged := &elf.Prog{
+		ProgHeader: elf.ProgHeader{
+			Type:   elf.PT_LOAD,
+			Flags:  flags,
+			Off:    first.Off,
+			Vaddr:  first.Vaddr,
+			Paddr:  first.Vaddr,
+			Filesz: first.Filesz,
+			Memsz:  first.Memsz,
+			Align:  0x4000,
+		},
+	}
+
+	for _, segment := range segments[1:] {
+		if segment.Vaddr-segment.Off != first.Vaddr-first.Off {
+			return nil, fmt.Errorf("can't merge %s segments %s and %s, their file offsets and addresses aren't in step "+
+				"(use a linker script that keeps them contiguous in both)", kindName, describeSegment(first), describeSegment(segment))
+		}
+
+		fileEnd := maxUint64(merged.Off+merged.Filesz, segment.Off+segment.Filesz)
+		memEnd := maxUint64(merged.Vaddr+merged.Memsz, segment.Vaddr+segment.Memsz)
+
+		if segment.Vaddr < merged.Vaddr {
+			merged.Off = segment.Off
+			merged.Vaddr = segment.Vaddr
+			merged.Paddr = segment.Vaddr
+		}
+
+		merged.Filesz = fileEnd - merged.Off
+		merged.Memsz = memEnd - merged.Vaddr
+	}
+
+	return merged, nil
+}
+
+// clipDataSegment takes a given writable PT_LOAD and cuts off any part of it that's covered by the relro segment, which
+// ends where the first `.data` section at dataStart begins. Returns the clipped segment, or nil if the relro segment
+// covers all of it.
+func clipDataSegment(progHeader *elf.Prog, gnuRelroSegment *elf.Prog, dataStart uint64) *elf.Prog {
+	if gnuRelroSegment == nil || progHeader.Vaddr < gnuRelroSegment.Vaddr || progHeader.Vaddr >= dataStart {
+		return progHeader
+	}
+
+	if progHeader.Vaddr+progHeader.Memsz <= dataStart {
+		return nil
+	}
+
+	clipSize := dataStart - progHeader.Vaddr
+	clipped := *progHeader
+
+	clipped.Off += clipSize
+	clipped.Vaddr += clipSize
+	clipped.Memsz -= clipSize
+
+	if clipped.Filesz < clipSize {
+		clipped.Filesz = 0
+	} else {
+		clipped.Filesz -= clipSize
+	}
+
+	return &clipped
+}
+
+// checkSegmentsDisjoint takes the given merged code and data segments and makes sure merging didn't make one cover the
+// other, which happens when the input interleaves code and data segments. Returns an error if they overlap, nil
+// otherwise.
+func checkSegmentsDisjoint(codeSegment *elf.Prog, dataSegment *elf.Prog) error {
+	if codeSegment == nil || dataSegment == nil {
+		return nil
+	}
+
+	if segmentsOverlap(codeSegment, dataSegment) {
+		return fmt.Errorf("merged code segment %s overlaps merged data segment %s, code and data segments are interleaved "+
+			"in the input elf", describeSegment(codeSegment), describeSegment(dataSegment))
+	}
+
+	return nil
+}
+
+// mapReadOnlySegment takes a given read-only PT_LOAD that isn't covered by the code segment, and merges it into the code
+// segment if the file offsets and addresses are in step and the merged segment wouldn't overlap any of the other
+// mappedSegments. Otherwise, it's kept as its own page aligned read-only PT_LOAD. A read-only segment that directly
+// precedes the code segment (ie. the headers, .dynsym, and .rodata at offset 0) is expected, and merged into it silently
+// like the read-only data after the code is. Otherwise, a warning describes which was chosen. Returns the separate
+// segment (nil if it was merged), or an error if neither is possible.
+func (orbisElf *OrbisElf) mapReadOnlySegment(readOnlySegment *elf.Prog, codeSegment *elf.Prog, mappedSegments []*elf.Prog) (*elf.Prog, error) {
+	mergeProblem := ""
+
+	if mergedSegment, err := mergeLoadSegments("read-only", codeSegment.Flags, []*elf.Prog{codeSegment, readOnlySegment}); err != nil {
+		mergeProblem = "its file offset and address aren't in step with the code segment"
+	} else {
+		for _, mappedSegment := range mappedSegments {
+			if segmentsOverlap(mergedSegment, mappedSegment) {
+				mergeProblem = "the merged segment would overlap " + describeSegment(mappedSegment)
+				break
+			}
+		}
+
+		if mergeProblem == "" {
+			if !isSegmentBefore(readOnlySegment, codeSegment) {
+				orbisElf.warn("%s isn't covered by the code segment, merged it into %s (its data is now executable)",
+					describeSegment(readOnlySegment), describeSegment(mergedSegment))
+			}
+
+			*codeSegment = *mergedSegment
+			return nil, nil
+		}
+	}
+
+	// Mapping it on its own only works if it doesn't share a page with another segment
+	separateSegment := *readOnlySegment
+	separateSegment.Flags = elf.PF_R
+	separateSegment.Align = 0x4000
+
+	pages := separateSegment
+	pages.Vaddr = separateSegment.Vaddr &^ (0x4000 - 1)
+	pages.Memsz = align(separateSegment.Vaddr+separateSegment.Memsz, 0x4000) - pages.Vaddr
+
+	for _, mappedSegment := range append([]*elf.Prog{codeSegment}, mappedSegments...) {
+		if segmentsOverlap(&pages, mappedSegment) {
+			return nil, fmt.Errorf("%s isn't covered by the code segment and can't be mapped: it can't be merged since %s, "+
+				"and it shares a page with %s", describeSegment(readOnlySegment), mergeProblem, describeSegment(mappedSegment))
+		}
+	}
+
+	orbisElf.warn("%s isn't covered by the code segment, kept it as a separate read-only PT_LOAD since %s",
+		describeSegment(readOnlySegment), mergeProblem)
+
+	return &separateSegment, nil
+}
+
+// isSegmentBefore returns true if the before program header ends right before the after program header starts, with at
+// most page padding between them.
+func isSegmentBefore(before *elf.Prog, after *elf.Prog) bool {
+	beforeEnd := before.Vaddr + before.Memsz
+	return beforeEnd <= after.Vaddr && after.Vaddr-beforeEnd < 0x4000
+}
+
+// segmentCovers returns true if the outer program header maps all of the inner program header's memory, with the same
+// file data.
+func segmentCovers(outer *elf.Prog, inner *elf.Prog) bool {
+	return inner.Vaddr >= outer.Vaddr && inner.Vaddr+inner.Memsz <= outer.Vaddr+outer.Memsz &&
+		inner.Vaddr-inner.Off == outer.Vaddr-outer.Off
+}
+
+// segmentsOverlap returns true if the memory ranges of the two given program headers overlap.
+func segmentsOverlap(a *elf.Prog, b *elf.Prog) bool {
+	return a.Vaddr < b.Vaddr+b.Memsz && b.Vaddr < a.Vaddr+a.Memsz
+}
+
+// describeSegment formats the given program header for diagnostics, ie. `PT_LOAD [R|X] 0x4000-0x406B (offset 0x4000)`.
+func describeSegment(progHeader *elf.Prog) string {
+	flags := "R"
+
+	if progHeader.Flags&elf.PF_W != 0 {
+		flags += "|W"
+	}
+
+	if progHeader.Flags&elf.PF_X != 0 {
+		flags += "|X"
+	}
+
+	return fmt.Sprintf("%s [%s] 0x%X-0x%X (offset 0x%X)", getProgramHeaderTypeName(progHeader.Type), flags,
+		progHeader.Vaddr, progHeader.Vaddr+progHeader.Memsz, progHeader.Off)
+}
+
+// _programHeaderTypeNames maps the SCE and GNU program header types that debug/elf doesn't know to their names.
+var _programHeaderTypeNames = map[elf.ProgType]string{
+	PT_GNU_EH_FRAME:     "PT_GNU_EH_FRAME",
+	PT_SCE_DYNLIBDATA:   "PT_SCE_DYNLIBDATA",
+	PT_SCE_PROC_PARAM:   "PT_SCE_PROC_PARAM",
+	PT_SCE_MODULE_PARAM: "PT_SCE_MODULE_PARAM",
+	PT_SCE_RELRO:        "PT_SCE_RELRO",
+}
+
+// getProgramHeaderTypeName returns the name of the given program header type, including SCE-specific types.
+func getProgramHeaderTypeName(progType elf.ProgType) string {
+	if name, ok := _programHeaderTypeNames[progType]; ok {
+		return name
+	}
+
+	return progType.String()
+}
+
+// maxUint64 returns the larger of the two given values.
+func maxUint64(a uint64, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,86 @@
+package oelf
+
+import (
+	"debug/elf"
+	"testing"
+)
+
+func TestGenerateProgramHeadersMapsReadOnlySegments(t *testing.T) {
+	// 0x100 bytes of .rodata at the given address and offset, for the read-only segment to hold
+	rodata := func(addr uint64, offset uint64) []testSection {
+		return []testSection{
+			{Name: ".rodata", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC, Addr: addr, Offset: offset, Size: 0x100},
+		}
+	}
+
+	runProgramHeaderTests(t, []programHeaderTest{
+		{
+			name: "covered by the code segment",
+			progHeaders: []elf.Prog64{_testCodeSegment, newTestLoadSegment(elf.PF_R, 0x800, 0x800, 0x100, 0x100),
+				_testDataSegment},
+			sections: rodata(0x800, 0x800),
+			segments: []string{
+				"PT_LOAD [R|X] 0x0-0x1000 (offset 0x0) filesz 0x1000",
+				"PT_LOAD [R|W] 0x4000-0x4200 (offset 0x4000) filesz 0x100",
+			},
+		},
+		{
+			name: "directly before the code segment",
+			progHeaders: []elf.Prog64{newTestLoadSegment(elf.PF_R, 0x0, 0x0, 0x800, 0x800),
+				newTestLoadSegment(elf.PF_R|elf.PF_X, 0x1000, 0x1000, 0x1000, 0x1000), _testDataSegment},
+			sections: rodata(0x400, 0x400),
+			segments: []string{
+				"PT_LOAD [R|X] 0x0-0x2000 (offset 0x0) filesz 0x2000",
+				"PT_LOAD [R|W] 0x4000-0x4200 (offset 0x4000) filesz 0x100",
+			},
+		},
+		{
+			name: "after the code segment",
+			progHeaders: []elf.Prog64{_testCodeSegment, newTestLoadSegment(elf.PF_R, 0x2000, 0x2000, 0x100, 0x100),
+				_testDataSegment},
+			sections: rodata(0x2000, 0x2000),
+			segments: []string{
+				"PT_LOAD [R|X] 0x0-0x2100 (offset 0x0) filesz 0x2100",
+				"PT_LOAD [R|W] 0x4000-0x4200 (offset 0x4000) filesz 0x100",
+			},
+			warnings: []string{"PT_LOAD [R] 0x2000-0x2100 (offset 0x2000) isn't covered by the code segment, merged it " +
+				"into PT_LOAD [R|X] 0x0-0x2100 (offset 0x0) (its data is now executable)"},
+		},
+		{
+			name: "after the data segment",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment,
+				newTestLoadSegment(elf.PF_R, 0xC000, 0xC000, 0x100, 0x100)},
+			sections: rodata(0xC000, 0xC000),
+			segments: []string{
+				"PT_LOAD [R|X] 0x0-0x1000 (offset 0x0) filesz 0x1000",
+				"PT_LOAD [R] 0xC000-0xC100 (offset 0xC000) filesz 0x100",
+				"PT_LOAD [R|W] 0x4000-0x4200 (offset 0x4000) filesz 0x100",
+			},
+			warnings: []string{"PT_LOAD [R] 0xC000-0xC100 (offset 0xC000) isn't covered by the code segment, kept it as " +
+				"a separate read-only PT_LOAD since the merged segment would overlap PT_LOAD [R|W] 0x4000-0x4200 " +
+				"(offset 0x4000)"},
+		},
+		{
+			name: "out of step with the code segment",
+			progHeaders: []elf.Prog64{_testCodeSegment, newTestLoadSegment(elf.PF_R, 0x2000, 0xA000, 0x100, 0x100),
+				_testDataSegment},
+			sections: rodata(0xA000, 0x2000),
+			segments: []string{
+				"PT_LOAD [R|X] 0x0-0x1000 (offset 0x0) filesz 0x1000",
+				"PT_LOAD [R] 0xA000-0xA100 (offset 0x2000) filesz 0x100",
+				"PT_LOAD [R|W] 0x4000-0x4200 (offset 0x4000) filesz 0x100",
+			},
+			warnings: []string{"PT_LOAD [R] 0xA000-0xA100 (offset 0x2000) isn't covered by the code segment, kept it as " +
+				"a separate read-only PT_LOAD since its file offset and address aren't in step with the code segment"},
+		},
+		{
+			name: "sharing a page with the data segment",
+			progHeaders: []elf.Prog64{_testCodeSegment, _testDataSegment,
+				newTestLoadSegment(elf.PF_R, 0x2300, 0x4300, 0x100, 0x100)},
+			sections: rodata(0x4300, 0x2300),
+			err: "PT_LOAD [R] 0x4300-0x4400 (offset 0x2300) isn't covered by the code segment and can't be mapped: it " +
+				"can't be merged since its file offset and address aren't in step with the code segment, and it shares a " +
+				"page with PT_LOAD [R|W] 0x4000-0x4200 (offset 0x4000)",
+		},
+	})
+}
@@ -0,0 +1,174 @@
+package oelf
+
+import (
+	"errors"
+	"io"
+	"sort"
+)
+
+// overlayPatch is data written over an overlayFile at the given offset.
+type overlayPatch struct {
+	offset int64
+	data   []byte
+}
+
+// end returns the offset just past the patch's data.
+func (patch overlayPatch) end() int64 {
+	return patch.offset + int64(len(patch.data))
+}
+
+// overlayFile is an orbis ELF under construction. It reads through to the input ELF, with everything written so far
+// laid over it, so the input never has to be copied. Writes are kept in memory as patches sorted by offset, which
+// neither overlap nor touch each other. Anything past the end of the input that hasn't been written reads as zeros.
+type overlayFile struct {
+	base     io.ReaderAt
+	baseSize int64
+	size     int64
+	patches  []overlayPatch
+}
+
+// newOverlayFile takes the given reader and its size, and returns an overlayFile over it with nothing written yet.
+func newOverlayFile(base io.ReaderAt, baseSize int64) *overlayFile {
+	return &overlayFile{
+		base:     base,
+		baseSize: baseSize,
+		size:     baseSize,
+	}
+}
+
+// WriteAt lays the given data over the file at the given offset, growing the file if it reaches past the end. Returns
+// len(data) and nil, or an error if the offset is negative.
+func (file *overlayFile) WriteAt(data []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("overlay write at a negative offset")
+	}
+
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	end := offset + int64(len(data))
+
+	if end > file.size {
+		file.size = end
+	}
+
+	// Patches first up to (but not including) last overlap or touch the new data, and are merged with it
+	first := sort.Search(len(file.patches), func(i int) bool { return file.patches[i].end() >= offset })
+	last := first
+
+	for last < len(file.patches) && file.patches[last].offset <= end {
+		last++
+	}
+
+	// Most writes land in or extend a single patch (ie. neighbouring relocations), which can be done in place
+	if last == first+1 && file.patches[first].offset <= offset {
+		patch := &file.patches[first]
+
+		if end > patch.end() {
+			patch.data = append(patch.data, make([]byte, end-patch.end())...)
+		}
+
+		copy(patch.data[offset-patch.offset:], data)
+		return len(data), nil
+	}
+
+	merged := overlayPatch{offset: offset}
+	mergedEnd := end
+
+	if first < last {
+		if file.patches[first].offset < merged.offset {
+			merged.offset = file.patches[first].offset
+		}
+
+		if file.patches[last-1].end() > mergedEnd {
+			mergedEnd = file.patches[last-1].end()
+		}
+	}
+
+	merged.data = make([]byte, mergedEnd-merged.offset)
+
+	for _, patch := range file.patches[first:last] {
+		copy(merged.data[patch.offset-merged.offset:], patch.data)
+	}
+
+	copy(merged.data[offset-merged.offset:], data)
+
+	if first == last {
+		file.patches = append(file.patches, overlayPatch{})
+		copy(file.patches[first+1:], file.patches[first:])
+	} else {
+		file.patches = append(file.patches[:first+1], file.patches[last:]...)
+	}
+
+	file.patches[first] = merged
+	return len(data), nil
+}
+
+// ReadAt reads into the given buffer from the given offset, with the written data laid over the input. Returns the
+// number of bytes read, and io.EOF if the end of the file was reached before the buffer was filled. Returns an error if
+// the input couldn't be read.
+func (file *overlayFile) ReadAt(data []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.New("overlay read at a negative offset")
+	}
+
+	if offset >= file.size {
+		return 0, io.EOF
+	}
+
+	readSize := int64(len(data))
+
+	if readSize > file.size-offset {
+		readSize = file.size - offset
+	}
+
+	buffer := data[:readSize]
+	end := offset + readSize
+
+	// Read the input, and zero whatever lies past it
+	baseReadSize := int64(0)
+
+	if offset < file.baseSize {
+		baseReadSize = readSize
+
+		if baseReadSize > file.baseSize-offset {
+			baseReadSize = file.baseSize - offset
+		}
+
+		if n, err := file.base.ReadAt(buffer[:baseReadSize], offset); int64(n) < baseReadSize {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return n, err
+		}
+	}
+
+	for i := baseReadSize; i < readSize; i++ {
+		buffer[i] = 0
+	}
+
+	// Lay the patches in range over it
+	first := sort.Search(len(file.patches), func(i int) bool { return file.patches[i].end() > offset })
+
+	for _, patch := range file.patches[first:] {
+		if patch.offset >= end {
+			break
+		}
+
+		copyStart := patch.offset
+
+		if copyStart < offset {
+			copyStart = offset
+		}
+
+		copy(buffer[copyStart-offset:], patch.data[copyStart-patch.offset:])
+	}
+
+	if readSize < int64(len(data)) {
+		return int(readSize), io.EOF
+	}
+
+	return int(readSize), nil
+}
@@ -0,0 +1,78 @@
+package oelf
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// overlayWrite is a write made to an overlayFile by TestOverlayFile.
+type overlayWrite struct {
+	offset int64
+	data   string
+}
+
+func TestOverlayFile(t *testing.T) {
+	const base = "0123456789"
+
+	tests := []struct {
+		name       string
+		writes     []overlayWrite
+		contents   string
+		patchCount int
+	}{
+		{"nothing written", nil, base, 0},
+		{"inside", []overlayWrite{{2, "ab"}}, "01ab456789", 1},
+		{"past the end", []overlayWrite{{12, "ab"}}, base + "\x00\x00ab", 1},
+		{"extends", []overlayWrite{{8, "abcd"}}, "01234567abcd", 1},
+		{"disjoint", []overlayWrite{{6, "b"}, {2, "a"}}, "01a345b789", 2},
+		{"touching", []overlayWrite{{2, "ab"}, {4, "cd"}, {0, "xy"}}, "xyabcd6789", 1},
+		{"overwrites", []overlayWrite{{2, "abcd"}, {3, "x"}}, "01axcd6789", 1},
+		{"spans patches", []overlayWrite{{1, "a"}, {4, "b"}, {7, "c"}, {0, "wxyzwxyz"}}, "wxyzwxyz89", 1},
+		{"starts inside a patch", []overlayWrite{{2, "abc"}, {7, "d"}, {4, "xyz"}}, "01abxyzd89", 1},
+	}
+
+	for _, test := range tests {
+		file := newOverlayFile(bytes.NewReader([]byte(base)), int64(len(base)))
+
+		for _, write := range test.writes {
+			if n, err := file.WriteAt([]byte(write.data), write.offset); n != len(write.data) || err != nil {
+				t.Fatalf("%s: WriteAt(%q, %d) = %d, %v", test.name, write.data, write.offset, n, err)
+			}
+		}
+
+		contents, err := ioutil.ReadAll(io.NewSectionReader(file, 0, file.size))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+
+		if string(contents) != test.contents {
+			t.Errorf("%s: contents are %q, want %q", test.name, contents, test.contents)
+		}
+
+		if len(file.patches) != test.patchCount {
+			t.Errorf("%s: %d patches, want %d", test.name, len(file.patches), test.patchCount)
+		}
+
+		// Every read in range has to agree with the whole
+		for offset := 0; offset < len(test.contents); offset++ {
+			for size := 1; offset+size <= len(test.contents); size++ {
+				data := make([]byte, size)
+
+				if n, err := file.ReadAt(data, int64(offset)); n != size || err != nil {
+					t.Fatalf("%s: ReadAt at %d of %d bytes = %d, %v", test.name, offset, size, n, err)
+				}
+
+				if string(data) != test.contents[offset:offset+size] {
+					t.Errorf("%s: ReadAt at %d of %d bytes read %q, want %q", test.name, offset, size, data,
+						test.contents[offset:offset+size])
+				}
+			}
+		}
+
+		if n, err := file.ReadAt(make([]byte, 4), file.size-2); n != 2 || err != io.EOF {
+			t.Errorf("%s: ReadAt across the end = %d, %v, want 2, EOF", test.name, n, err)
+		}
+	}
+}
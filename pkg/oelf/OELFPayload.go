@@ -0,0 +1,327 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// PayloadFormat is the kind of file a payload is written as.
+type PayloadFormat int
+
+const (
+	// PayloadFormatBinary is a flat memory image, loaded at the payload base and usually jumped to at its start.
+	PayloadFormatBinary PayloadFormat = iota
+
+	// PayloadFormatELF is a minimal static ELF (ET_EXEC) with one PT_LOAD per input segment and no sections.
+	PayloadFormatELF
+)
+
+// _payloadFormatNames maps the -payload-format argument names to their format.
+var _payloadFormatNames = map[string]PayloadFormat{
+	"bin": PayloadFormatBinary,
+	"elf": PayloadFormatELF,
+}
+
+// ParsePayloadFormat takes a given payload format name and returns the matching PayloadFormat. An empty name is treated
+// as "bin". Returns an error if the name is unknown, nil otherwise.
+func ParsePayloadFormat(name string) (PayloadFormat, error) {
+	if name == "" {
+		return PayloadFormatBinary, nil
+	}
+
+	if format, ok := _payloadFormatNames[name]; ok {
+		return format, nil
+	}
+
+	return 0, fmt.Errorf("unknown payload format '%s' (expected one of: bin, elf)", name)
+}
+
+// _maxPayloadSize is the largest memory image a payload can have. Segment sizes come straight from the input, so this
+// keeps a malformed one from allocating all of memory.
+const _maxPayloadSize = 0x10000000
+
+// Payload describes a payload built from an input ELF, which is loaded by an exploit or ELF loader instead of the system
+// loader. All of its relocations are resolved against Base.
+type Payload struct {
+	Base  uint64
+	Entry uint64
+	Size  uint64
+
+	// UnresolvedImports holds the symbols the payload imports but doesn't define, which the loader has to resolve
+	UnresolvedImports []string
+	Warnings          []string
+
+	inputElf   *elf.File
+	orbisElf   *OrbisElf
+	loads      []*elf.Prog
+	imageData  []byte
+	imageStart uint64
+	bias       uint64
+}
+
+// CreatePayload takes the ELF at the given input path and writes it to the given output path as a payload in the given
+// format, with its relocations resolved as if it was loaded at base, which must be page aligned. Position-dependent
+// (ET_EXEC) inputs can only be loaded at their link address, so base must be 0 or the link address for them. Imports that the input doesn't
+// define are left unresolved and reported. Returns the payload, or an error if it couldn't be built.
+func CreatePayload(inputPath string, outputPath string, base uint64, format PayloadFormat) (*Payload, error) {
+	inputElf, err := elf.Open(inputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer inputElf.Close()
+
+	// Position-dependent inputs are held to the same checks as fixed-address eboots
+	orbisElf := OrbisElf{
+		ElfToConvertName: inputPath,
+		ElfToConvert:     inputElf,
+		IsFixedAddress:   inputElf.Type == elf.ET_EXEC,
+	}
+
+	if err := orbisElf.validateInputELF(); err != nil {
+		return nil, err
+	}
+
+	payload := &Payload{
+		Warnings: orbisElf.Warnings,
+		inputElf: inputElf,
+		orbisElf: &orbisElf,
+	}
+
+	if err := payload.loadImage(base); err != nil {
+		return nil, err
+	}
+
+	if err := payload.applyRelocations(); err != nil {
+		return nil, err
+	}
+
+	outputData := payload.imageData
+
+	if format == PayloadFormatELF {
+		outputData = payload.buildELF()
+	} else if payload.Entry != payload.Base {
+		payload.warn("entry point is at offset 0x%X of the binary, the loader has to jump there instead of the start",
+			payload.Entry-payload.Base)
+	}
+
+	return payload, ioutil.WriteFile(outputPath, outputData, 0644)
+}
+
+// loadImage lays out the PT_LOAD segments of the input ELF in memory, starting at the page of the lowest segment, and
+// calculates the bias between input addresses and payload addresses for the given base. Returns an error if the base
+// isn't page aligned, the input has no loadable segments or a malformed one, the image would be larger than
+// _maxPayloadSize, or the input is position-dependent and linked at a different base.
+func (payload *Payload) loadImage(base uint64) error {
+	// Output segments keep their offset within the page, which only lines up with their address at a page aligned base
+	if base%_layoutPageSize != 0 {
+		return fmt.Errorf("payload base 0x%X isn't aligned to the 0x%X byte page size", base, _layoutPageSize)
+	}
+
+	for _, progHeader := range payload.inputElf.Progs {
+		if progHeader.Type != elf.PT_LOAD {
+			continue
+		}
+
+		if progHeader.Filesz > progHeader.Memsz {
+			return fmt.Errorf("PT_LOAD at 0x%X has more file data (0x%X bytes) than memory (0x%X bytes)",
+				progHeader.Vaddr, progHeader.Filesz, progHeader.Memsz)
+		}
+
+		if progHeader.Memsz > _maxPayloadSize || progHeader.Vaddr > math.MaxUint64-progHeader.Memsz {
+			return fmt.Errorf("PT_LOAD at 0x%X is too large (0x%X bytes)", progHeader.Vaddr, progHeader.Memsz)
+		}
+
+		payload.loads = append(payload.loads, progHeader)
+	}
+
+	if len(payload.loads) == 0 {
+		return errors.New("input elf has no PT_LOAD segments")
+	}
+
+	sort.Slice(payload.loads, func(i int, j int) bool {
+		return payload.loads[i].Vaddr < payload.loads[j].Vaddr
+	})
+
+	imageStart := payload.loads[0].Vaddr &^ (_layoutPageSize - 1)
+	imageEnd := imageStart
+
+	for _, progHeader := range payload.loads {
+		imageEnd = maxUint64(imageEnd, progHeader.Vaddr+progHeader.Memsz)
+	}
+
+	if payload.inputElf.Type == elf.ET_EXEC {
+		if base != 0 && base != imageStart {
+			return fmt.Errorf("position-dependent input elf is linked at 0x%X, it can't be loaded at 0x%X", imageStart, base)
+		}
+
+		base = imageStart
+	}
+
+	if imageEnd-imageStart > _maxPayloadSize {
+		return fmt.Errorf("payload image would be 0x%X bytes, at most 0x%X are supported", imageEnd-imageStart,
+			_maxPayloadSize)
+	}
+
+	payload.Base = base
+	payload.imageStart = imageStart
+	payload.bias = base - imageStart
+	payload.Entry = payload.inputElf.Entry + payload.bias
+	payload.Size = imageEnd - imageStart
+
+	// .bss is part of the image, so the loader doesn't need to clear it
+	payload.imageData = make([]byte, payload.Size)
+
+	for _, progHeader := range payload.loads {
+		if _, err := progHeader.ReadAt(payload.imageData[progHeader.Vaddr-imageStart:][:progHeader.Filesz], 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyRelocations resolves the dynamic relocations of the input ELF (DT_JMPREL and DT_RELA, or .rela.plt and .rela.dyn
+// if there's no dynamic table) in the payload image. Relocations against symbols the input doesn't define are left
+// as-is, and the symbols are added to UnresolvedImports. Returns an error if a relocation can't be resolved statically
+// (ie. TLS or IFUNC), nil otherwise.
+func (payload *Payload) applyRelocations() error {
+	dynamicSymbols, err := payload.orbisElf.getDynamicSymbols()
+	if err != nil {
+		return err
+	}
+
+	relocationTables, err := payload.orbisElf.getRelocationTables()
+	if err != nil {
+		return err
+	}
+
+	unresolvedSymbols := make(map[string]bool)
+
+	for _, relocationTable := range relocationTables {
+		relocations, err := payload.orbisElf.readRelocations(relocationTable)
+		if err != nil {
+			return err
+		}
+
+		for _, relocation := range relocations {
+			symbol, err := getRelocationSymbol(relocation, dynamicSymbols)
+			if err != nil {
+				return err
+			}
+
+			switch relocation.Type {
+			case elf.R_X86_64_NONE:
+				continue
+			case elf.R_X86_64_RELATIVE:
+				if err := payload.writeUint64(relocation.Offset, uint64(relocation.Addend)+payload.bias); err != nil {
+					return err
+				}
+			case elf.R_X86_64_64, elf.R_X86_64_GLOB_DAT, elf.R_X86_64_JMP_SLOT:
+				if symbol == nil {
+					return fmt.Errorf("%s needs a symbol", describeRelocation(relocation, symbol))
+				}
+
+				if symbol.Section == elf.SHN_UNDEF {
+					// Weak imports are allowed to be missing, and read as null
+					if elf.ST_BIND(symbol.Info) == elf.STB_WEAK {
+						if err := payload.writeUint64(relocation.Offset, 0); err != nil {
+							return err
+						}
+					} else if !unresolvedSymbols[symbol.Name] {
+						unresolvedSymbols[symbol.Name] = true
+						payload.UnresolvedImports = append(payload.UnresolvedImports, symbol.Name)
+					}
+
+					continue
+				}
+
+				// Jump slots and GOT entries hold the plain symbol address, only R_X86_64_64 has an addend
+				value := symbol.Value + payload.bias
+
+				if relocation.Type == elf.R_X86_64_64 {
+					value += uint64(relocation.Addend)
+				}
+
+				if err := payload.writeUint64(relocation.Offset, value); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("%s can't be resolved in a payload", describeRelocation(relocation, symbol))
+			}
+		}
+	}
+
+	sort.Strings(payload.UnresolvedImports)
+	return nil
+}
+
+// buildELF wraps the payload image in a minimal static ELF, with a PT_LOAD for each input segment at its payload
+// address. The image is placed at the first page after the headers, so file offsets stay in step with addresses.
+// Returns the ELF data.
+func (payload *Payload) buildELF() []byte {
+	headersSize := uint64(0x40 + len(payload.loads)*0x38)
+	imageOffset := align(headersSize, _layoutPageSize)
+
+	header := elf.Header64{
+		Ident: [0x10]byte{
+			0x7F, 0x45, 0x4C, 0x46,
+			0x02,
+			0x01,
+			0x01,
+			0x09,
+		},
+
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   1,
+		Entry:     payload.Entry,
+		Phoff:     0x40,
+		Ehsize:    0x40,
+		Phentsize: 0x38,
+		Phnum:     uint16(len(payload.loads)),
+	}
+
+	elfBuff := new(bytes.Buffer)
+	_ = binary.Write(elfBuff, binary.LittleEndian, header)
+
+	for _, progHeader := range payload.loads {
+		_ = binary.Write(elfBuff, binary.LittleEndian, elf.Prog64{
+			Type:   uint32(elf.PT_LOAD),
+			Flags:  uint32(progHeader.Flags),
+			Off:    imageOffset + (progHeader.Vaddr - payload.imageStart),
+			Vaddr:  progHeader.Vaddr + payload.bias,
+			Paddr:  progHeader.Vaddr + payload.bias,
+			Filesz: progHeader.Filesz,
+			Memsz:  progHeader.Memsz,
+			Align:  _layoutPageSize,
+		})
+	}
+
+	elfBuff.Write(make([]byte, imageOffset-headersSize))
+	elfBuff.Write(payload.imageData)
+
+	return elfBuff.Bytes()
+}
+
+// warn records a warning about the payload, formatted with the given parameters.
+func (payload *Payload) warn(format string, params ...interface{}) {
+	payload.Warnings = append(payload.Warnings, fmt.Sprintf(format, params...))
+}
+
+// writeUint64 takes a given input address and writes the given value to the payload image there. Returns an error if
+// the address isn't in the image, nil otherwise.
+func (payload *Payload) writeUint64(addr uint64, value uint64) error {
+	if addr < payload.imageStart || addr+8 > payload.imageStart+payload.Size {
+		return fmt.Errorf("relocation at 0x%X is outside of the loaded segments", addr)
+	}
+
+	binary.LittleEndian.PutUint64(payload.imageData[addr-payload.imageStart:], value)
+	return nil
+}
@@ -0,0 +1,194 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildTestPayloadELF builds a position-independent ELF with a dynamic table, a local symbol at 0x900 and an import,
+// and relocations at 0xA00 (relative to 0x900), 0xA08 (GLOB_DAT of the local symbol), and 0xA10 (GLOB_DAT of the
+// import). If stripSections is set, the section headers are left out, so everything has to be found through PT_DYNAMIC.
+// Returns the ELF data.
+func buildTestPayloadELF(stripSections bool) []byte {
+	stringTable := []byte("\x00local\x00import\x00")
+
+	symbolTable := encodeSymbols([]elf.Sym64{
+		{Name: 1, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Shndx: 1, Value: 0x900},
+		{Name: 7, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT)},
+	})
+
+	// One bucket, and a chain for each symbol
+	hashTable := make([]byte, 0x8+0x4+3*0x4)
+	putUint32(hashTable, 0x0, 1)
+	putUint32(hashTable, 0x4, 3)
+
+	relocations := encodeRelocations([]elf.Rela64{
+		newRelocation(0xA00, 0, elf.R_X86_64_RELATIVE, 0x900),
+		newRelocation(0xA08, 1, elf.R_X86_64_GLOB_DAT, 0),
+		newRelocation(0xA10, 2, elf.R_X86_64_GLOB_DAT, 0),
+	})
+
+	dynamicTable := encodeDynamicTable([]elf.Dyn64{
+		{Tag: int64(elf.DT_HASH), Val: 0x500},
+		{Tag: int64(elf.DT_SYMTAB), Val: 0x600},
+		{Tag: int64(elf.DT_STRTAB), Val: 0x700},
+		{Tag: int64(elf.DT_STRSZ), Val: uint64(len(stringTable))},
+		{Tag: int64(elf.DT_RELA), Val: 0x800},
+		{Tag: int64(elf.DT_RELASZ), Val: uint64(len(relocations))},
+		{Tag: int64(elf.DT_RELAENT), Val: 0x18},
+	})
+
+	progHeaders := []elf.Prog64{
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_W), Filesz: 0x1000, Memsz: 0x1000, Align: 0x4000},
+		{Type: uint32(elf.PT_DYNAMIC), Flags: uint32(elf.PF_R | elf.PF_W), Off: 0x400, Vaddr: 0x400,
+			Filesz: uint64(len(dynamicTable)), Memsz: uint64(len(dynamicTable)), Align: 0x8},
+	}
+
+	elfData := buildTestELF(elf.ET_DYN, progHeaders, []testSection{
+		{Name: ".dynamic", Type: elf.SHT_DYNAMIC, Flags: elf.SHF_ALLOC | elf.SHF_WRITE, Addr: 0x400, Offset: 0x400,
+			Data: dynamicTable, Link: 4, Entsize: 0x10},
+		{Name: ".hash", Type: elf.SHT_HASH, Flags: elf.SHF_ALLOC, Addr: 0x500, Offset: 0x500, Data: hashTable,
+			Link: 3, Entsize: 0x4},
+		{Name: ".dynsym", Type: elf.SHT_DYNSYM, Flags: elf.SHF_ALLOC, Addr: 0x600, Offset: 0x600, Data: symbolTable,
+			Link: 4, Info: 1, Entsize: 0x18},
+		{Name: ".dynstr", Type: elf.SHT_STRTAB, Flags: elf.SHF_ALLOC, Addr: 0x700, Offset: 0x700, Data: stringTable},
+		{Name: ".rela.dyn", Type: elf.SHT_RELA, Flags: elf.SHF_ALLOC, Addr: 0x800, Offset: 0x800, Data: relocations,
+			Link: 3, Entsize: 0x18},
+	})
+
+	if stripSections {
+		stripTestSectionHeaders(elfData)
+	}
+
+	return elfData
+}
+
+func TestCreatePayloadAppliesRelocations(t *testing.T) {
+	const base = 0x10000
+
+	for _, stripSections := range []bool{false, true} {
+		inputPath := filepath.Join(t.TempDir(), "payload.elf")
+		outputPath := filepath.Join(t.TempDir(), "payload.bin")
+
+		if err := ioutil.WriteFile(inputPath, buildTestPayloadELF(stripSections), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := CreatePayload(inputPath, outputPath, base, PayloadFormatBinary)
+		if err != nil {
+			t.Errorf("stripped sections %v: %s", stripSections, err.Error())
+			continue
+		}
+
+		if !reflect.DeepEqual(payload.UnresolvedImports, []string{"import"}) {
+			t.Errorf("stripped sections %v: unresolved imports are %v, want [import]", stripSections,
+				payload.UnresolvedImports)
+		}
+
+		outputData, err := ioutil.ReadFile(outputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range []struct {
+			offset uint64
+			value  uint64
+		}{
+			{0xA00, base + 0x900},
+			{0xA08, base + 0x900},
+			{0xA10, 0},
+		} {
+			if value := binary.LittleEndian.Uint64(outputData[want.offset:]); value != want.value {
+				t.Errorf("stripped sections %v: value at 0x%X is 0x%X, want 0x%X", stripSections, want.offset, value,
+					want.value)
+			}
+		}
+	}
+}
+
+// _testStaticPayloadCode is the code of the payload built by buildTestStaticPayloadELF.
+var _testStaticPayloadCode = []byte{0x90, 0x90, 0xC3}
+
+// buildTestStaticPayloadELF builds a static, position-dependent ELF like `gcc -static -nostdlib -no-pie` does, which
+// has sections but neither .dynsym nor a dynamic table. Its code is at 0x401000, in a PT_LOAD of the given file and
+// memory sizes. Returns the path of the ELF, in a new temporary directory.
+func buildTestStaticPayloadELF(t *testing.T, filesz uint64, memsz uint64) string {
+	t.Helper()
+
+	progHeaders := []elf.Prog64{
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_X), Off: 0x1000, Vaddr: 0x401000, Paddr: 0x401000,
+			Filesz: filesz, Memsz: memsz, Align: 0x1000},
+	}
+
+	elfData := buildTestELF(elf.ET_EXEC, progHeaders, []testSection{
+		{Name: ".text", Type: elf.SHT_PROGBITS, Flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR, Addr: 0x401000, Offset: 0x1000,
+			Data: _testStaticPayloadCode},
+	})
+
+	// e_entry
+	putUint64(elfData, 0x18, 0x401000)
+
+	inputPath := filepath.Join(t.TempDir(), "payload.elf")
+
+	if err := ioutil.WriteFile(inputPath, elfData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return inputPath
+}
+
+func TestCreatePayloadWithoutDynamicTable(t *testing.T) {
+	inputPath := buildTestStaticPayloadELF(t, uint64(len(_testStaticPayloadCode)), 0x2000)
+	outputPath := filepath.Join(t.TempDir(), "payload.bin")
+
+	payload, err := CreatePayload(inputPath, outputPath, 0, PayloadFormatBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Base != 0x400000 || payload.Entry != 0x401000 || payload.Size != 0x3000 {
+		t.Errorf("payload has base 0x%X, entry 0x%X, and size 0x%X, want 0x400000, 0x401000, and 0x3000", payload.Base,
+			payload.Entry, payload.Size)
+	}
+
+	outputData, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uint64(len(outputData)) != payload.Size || !bytes.Equal(outputData[0x1000:0x1003], _testStaticPayloadCode) {
+		t.Errorf("payload is 0x%X bytes with % X at 0x1000, want 0x%X bytes with % X", len(outputData),
+			outputData[0x1000:0x1003], payload.Size, _testStaticPayloadCode)
+	}
+}
+
+func TestCreatePayloadRejectsMalformedInputs(t *testing.T) {
+	tests := []struct {
+		name   string
+		filesz uint64
+		memsz  uint64
+		base   uint64
+		err    string
+	}{
+		{"more file data than memory", 0x3, 0x2, 0, "more file data"},
+		{"huge segment", 0x3, 0x100000000, 0, "too large"},
+		{"wrapping segment", 0x3, math.MaxUint64 - 0x1000, 0, "too large"},
+		{"unaligned base", 0x3, 0x2000, 0x401000, "isn't aligned"},
+	}
+
+	for _, test := range tests {
+		inputPath := buildTestStaticPayloadELF(t, test.filesz, test.memsz)
+
+		_, err := CreatePayload(inputPath, filepath.Join(t.TempDir(), "payload.bin"), test.base, PayloadFormatBinary)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one about %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package oelf
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+// inputRelocation is a dynamic relocation entry of the input ELF, decoded so it can be translated for the SCE loader.
+// SectionName is the name of the table it's from, and InJumpTable is set if that's the jump table (DT_JMPREL).
+type inputRelocation struct {
+	SectionName string
+	InJumpTable bool
+	Offset      uint64
+	Type        elf.R_X86_64
+	SymbolIndex uint32
+	Addend      int64
+}
+
+// relocationTable is a table of relocations in the input ELF's memory. Name is the section it's in, or the dynamic tag
+// it was found by if there's no such section. IsJumpTable is set for the jump table (DT_JMPREL), whose entries are
+// indexed by the PLT stubs.
+type relocationTable struct {
+	Name        string
+	Addr        uint64
+	Size        uint64
+	IsJumpTable bool
+}
+
+// getRelocationTable finds the relocation table given by the addrTag and sizeTag dynamic tags, falling back to the
+// section with the given name if the dynamic table doesn't have them. Returns the table (nil if there's none), or an
+// error if the dynamic table and the section disagree.
+func (orbisElf *OrbisElf) getRelocationTable(addrTag elf.DynTag, sizeTag elf.DynTag, sectionName string) (*relocationTable, error) {
+	addr, err := orbisElf.getDynamicTag(addrTag)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := orbisElf.getDynamicTag(sizeTag)
+	if err != nil {
+		return nil, err
+	}
+
+	section := orbisElf.ElfToConvert.Section(sectionName)
+
+	if addr == 0 {
+		if section == nil || section.Size == 0 {
+			return nil, nil
+		}
+
+		return &relocationTable{Name: sectionName, Addr: section.Addr, Size: section.Size}, nil
+	}
+
+	if section == nil {
+		return &relocationTable{Name: addrTag.String(), Addr: addr, Size: size}, nil
+	}
+
+	if section.Addr != addr || section.Size != size {
+		return nil, fmt.Errorf("%s and %s point to relocations at 0x%X-0x%X, but %s is at 0x%X-0x%X", addrTag, sizeTag,
+			addr, addr+size, sectionName, section.Addr, section.Addr+section.Size)
+	}
+
+	return &relocationTable{Name: sectionName, Addr: addr, Size: size}, nil
+}
+
+// getRelocationTables finds the jump table (DT_JMPREL) and the relocation table (DT_RELA) of the input ELF through the
+// dynamic table, or .rela.plt and .rela.dyn if the dynamic table doesn't have them. Returns the tables that exist, or
+// an error if they can't be found reliably.
+func (orbisElf *OrbisElf) getRelocationTables() ([]*relocationTable, error) {
+	if pltRel, err := orbisElf.getDynamicTag(elf.DT_PLTREL); err != nil {
+		return nil, err
+	} else if pltRel != 0 && elf.DynTag(pltRel) != elf.DT_RELA {
+		return nil, fmt.Errorf("DT_PLTREL is %s, only DT_RELA relocations are supported", elf.DynTag(pltRel))
+	}
+
+	if relaEnt, err := orbisElf.getDynamicTag(elf.DT_RELAENT); err != nil {
+		return nil, err
+	} else if relaEnt != 0 && relaEnt != 0x18 {
+		return nil, fmt.Errorf("DT_RELAENT is 0x%X, expected 0x18", relaEnt)
+	}
+
+	tables := make([]*relocationTable, 0, 2)
+
+	// Jump slots / PLT entries come first, followed by the relative entries of the dynamic table
+	for _, tableTags := range [][2]elf.DynTag{{elf.DT_JMPREL, elf.DT_PLTRELSZ}, {elf.DT_RELA, elf.DT_RELASZ}} {
+		sectionName := ".rela.dyn"
+
+		if tableTags[0] == elf.DT_JMPREL {
+			sectionName = ".rela.plt"
+		}
+
+		table, err := orbisElf.getRelocationTable(tableTags[0], tableTags[1], sectionName)
+		if err != nil {
+			return nil, err
+		}
+
+		if table != nil {
+			table.IsJumpTable = tableTags[0] == elf.DT_JMPREL
+			tables = append(tables, table)
+		}
+	}
+
+	return tables, nil
+}
+
+// readRelocations takes the given relocation table and decodes its entries. Returns the entries, or an error if the
+// table isn't mapped by the input ELF.
+func (orbisElf *OrbisElf) readRelocations(table *relocationTable) ([]inputRelocation, error) {
+	relaData, err := orbisElf.readInputData(table.Addr, table.Size)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read relocations from %s: %s", table.Name, err.Error())
+	}
+
+	relocations := make([]inputRelocation, 0, len(relaData)/0x18)
+
+	for i := 0; i+0x18 <= len(relaData); i += 0x18 {
+		rInfo := orbisElf.ElfToConvert.ByteOrder.Uint64(relaData[i+0x8 : i+0x10])
+
+		relocations = append(relocations, inputRelocation{
+			SectionName: table.Name,
+			InJumpTable: table.IsJumpTable,
+			Offset:      orbisElf.ElfToConvert.ByteOrder.Uint64(relaData[i : i+0x8]),
+			Type:        elf.R_X86_64(elf.R_TYPE64(rInfo)),
+			SymbolIndex: elf.R_SYM64(rInfo),
+			Addend:      int64(orbisElf.ElfToConvert.ByteOrder.Uint64(relaData[i+0x10 : i+0x18])),
+		})
+	}
+
+	return relocations, nil
+}
+
+// describeRelocation formats the given relocation for errors, ie. `R_X86_64_COPY at 0x4020 against 'stdout' (.rela.dyn)`.
+func describeRelocation(relocation inputRelocation, symbol *elf.Symbol) string {
+	symbolName := "no symbol"
+
+	if symbol != nil {
+		symbolName = fmt.Sprintf("'%s'", symbol.Name)
+	}
+
+	return fmt.Sprintf("%s at 0x%X against %s (%s)", relocation.Type, relocation.Offset, symbolName,
+		relocation.SectionName)
+}
+
+// getRelocationSymbol takes the given relocation and the input's dynamic symbols, and finds the symbol it's against.
+// Returns the symbol (nil for symbol index 0), or an error if the symbol index is out of range.
+func getRelocationSymbol(relocation inputRelocation, symbols []elf.Symbol) (*elf.Symbol, error) {
+	if relocation.SymbolIndex == 0 {
+		return nil, nil
+	}
+
+	// debug/elf leaves out the null symbol, so symbol indices are off by one
+	if int(relocation.SymbolIndex) > len(symbols) {
+		return nil, fmt.Errorf("%s has an invalid symbol index %d", describeRelocation(relocation, nil),
+			relocation.SymbolIndex)
+	}
+
+	return &symbols[relocation.SymbolIndex-1], nil
+}
+
+// translateRelocation takes the given relocation of the input ELF and the input's dynamic symbols, and translates it for
+// the SCE loader. Relocations against imports are kept as-is. Relocations against symbols the input defines can't be
+// resolved by NID, so they're rewritten to be relative to the module. R_X86_64_NONE is dropped, and relative
+// relocations of fixed-address executables are resolved in place, except in the jump table, where every entry is kept
+// so the PLT stubs' indices stay valid. Returns the relocation to write (nil if it's not needed), or an error naming the
+// relocation and symbol if the SCE loader can't handle it.
+func (orbisElf *OrbisElf) translateRelocation(relocation inputRelocation, symbols []elf.Symbol) (*elf.Rela64, error) {
+	symbol, err := getRelocationSymbol(relocation, symbols)
+	if err != nil {
+		return nil, err
+	}
+
+	isImport := symbol != nil && symbol.Section == elf.SHN_UNDEF
+	translated := relocation
+
+	switch relocation.Type {
+	case elf.R_X86_64_NONE:
+		if !relocation.InJumpTable {
+			return nil, nil
+		}
+	case elf.R_X86_64_RELATIVE:
+	case elf.R_X86_64_64, elf.R_X86_64_GLOB_DAT, elf.R_X86_64_JMP_SLOT:
+		if symbol == nil {
+			return nil, fmt.Errorf("%s needs a symbol", describeRelocation(relocation, symbol))
+		}
+
+		// Only imports are in the SCE symbol table, a locally defined symbol's address is known relative to the module
+		if !isImport {
+			translated.Type = elf.R_X86_64_RELATIVE
+			translated.SymbolIndex = 0
+			translated.Addend = int64(symbol.Value)
+
+			if relocation.Type == elf.R_X86_64_64 {
+				translated.Addend += relocation.Addend
+			}
+		}
+	case elf.R_X86_64_DTPMOD64, elf.R_X86_64_DTPOFF64, elf.R_X86_64_TPOFF64:
+		// Local TLS is addressed through the section symbol, which stands for the module itself
+		if symbol != nil && !isImport {
+			translated.SymbolIndex = 0
+
+			if relocation.Type != elf.R_X86_64_DTPMOD64 {
+				translated.Addend += int64(symbol.Value)
+			}
+		}
+	case elf.R_X86_64_COPY:
+		return nil, fmt.Errorf("%s isn't supported by the SCE loader, build with -fPIC or don't access library "+
+			"variables directly", describeRelocation(relocation, symbol))
+	case elf.R_X86_64_IRELATIVE:
+		return nil, fmt.Errorf("%s isn't supported by the SCE loader, IFUNCs can't be used",
+			describeRelocation(relocation, symbol))
+	case elf.R_X86_64_PC32, elf.R_X86_64_32, elf.R_X86_64_32S:
+		return nil, fmt.Errorf("%s is a text relocation, which the SCE loader can't apply to read-only code, build "+
+			"with -fPIC", describeRelocation(relocation, symbol))
+	default:
+		return nil, fmt.Errorf("%s isn't supported by the SCE loader", describeRelocation(relocation, symbol))
+	}
+
+	// Fixed-address executables aren't rebased, so relative relocations can be resolved in place instead
+	if orbisElf.IsFixedAddress && translated.Type == elf.R_X86_64_RELATIVE && !relocation.InJumpTable &&
+		orbisElf.applyRelocationInPlace(translated.Offset, uint64(translated.Addend)) {
+		return nil, nil
+	}
+
+	outputIndex, err := mapRelocationSymbol(translated, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	return &elf.Rela64{
+		Off:    translated.Offset,
+		Info:   elf.R_INFO(outputIndex, uint32(translated.Type)),
+		Addend: translated.Addend,
+	}, nil
+}
+
+// mapRelocationSymbol takes the given translated relocation and its input symbol, and finds the index of the symbol in
+// the SCE symbol table written by writeSymbolTable. Symbol 0 maps to the STT_SECTION entry, which stands for the module
+// itself. Returns the index, or an error if the symbol isn't in the SCE symbol table or the entry there is for a
+// different symbol.
+func mapRelocationSymbol(relocation inputRelocation, symbol *elf.Symbol) (uint32, error) {
+	if relocation.SymbolIndex == 0 {
+		return 1, nil
+	}
+
+	outputIndex, ok := _symbolIndexMap[relocation.SymbolIndex]
+	if !ok {
+		return 0, fmt.Errorf("%s refers to a symbol that isn't in the SCE symbol table",
+			describeRelocation(relocation, symbol))
+	}
+
+	if int(outputIndex) >= len(_symbolTableNames) || _symbolTableNames[outputIndex] != symbol.Name {
+		return 0, fmt.Errorf("%s was mapped to SCE symbol %d, which is for a different symbol",
+			describeRelocation(relocation, symbol), outputIndex)
+	}
+
+	return outputIndex, nil
+}
@@ -0,0 +1,212 @@
+package oelf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// buildTestImportELF builds a position-independent ELF that needs libkernel.so and libSceBench1.so (see
+// writeTestStubLibraries). Its .dynsym holds a function it defines at 0x900, followed by the imports
+// sceBench0Function0 and sceBench1Function1. It has jump slots at 0xA00 (first import), 0xA08 (the defined function),
+// and 0xA10 (second import), a GLOB_DAT of the second import at 0xA18, and a relative relocation at 0xA20. If
+// stripSections is set, the section headers are left out. Returns the ELF data.
+func buildTestImportELF(stripSections bool) []byte {
+	stringTable, nameOffsets := encodeStringTable([]string{"libkernel.so", "libSceBench1.so", "local",
+		"sceBench0Function0", "sceBench1Function1"})
+
+	symbolTable := encodeSymbols([]elf.Sym64{
+		{Name: nameOffsets[2], Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Shndx: 1, Value: 0x900},
+		{Name: nameOffsets[3], Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)},
+		{Name: nameOffsets[4], Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)},
+	})
+
+	// One bucket, and a chain for each symbol
+	hashTable := make([]byte, 0x8+0x4+4*0x4)
+	putUint32(hashTable, 0x0, 1)
+	putUint32(hashTable, 0x4, 4)
+
+	jumpTable := encodeRelocations([]elf.Rela64{
+		newRelocation(0xA00, 2, elf.R_X86_64_JMP_SLOT, 0),
+		newRelocation(0xA08, 1, elf.R_X86_64_JMP_SLOT, 0),
+		newRelocation(0xA10, 3, elf.R_X86_64_JMP_SLOT, 0),
+	})
+
+	relocations := encodeRelocations([]elf.Rela64{
+		newRelocation(0xA18, 3, elf.R_X86_64_GLOB_DAT, 0),
+		newRelocation(0xA20, 0, elf.R_X86_64_RELATIVE, 0x900),
+	})
+
+	dynamicTable := encodeDynamicTable([]elf.Dyn64{
+		{Tag: int64(elf.DT_NEEDED), Val: uint64(nameOffsets[0])},
+		{Tag: int64(elf.DT_NEEDED), Val: uint64(nameOffsets[1])},
+		{Tag: int64(elf.DT_HASH), Val: 0x500},
+		{Tag: int64(elf.DT_SYMTAB), Val: 0x600},
+		{Tag: int64(elf.DT_STRTAB), Val: 0x700},
+		{Tag: int64(elf.DT_STRSZ), Val: uint64(len(stringTable))},
+		{Tag: int64(elf.DT_JMPREL), Val: 0x800},
+		{Tag: int64(elf.DT_PLTRELSZ), Val: uint64(len(jumpTable))},
+		{Tag: int64(elf.DT_PLTREL), Val: uint64(elf.DT_RELA)},
+		{Tag: int64(elf.DT_RELA), Val: 0x880},
+		{Tag: int64(elf.DT_RELASZ), Val: uint64(len(relocations))},
+		{Tag: int64(elf.DT_RELAENT), Val: 0x18},
+	})
+
+	progHeaders := []elf.Prog64{
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_W), Filesz: 0x1000, Memsz: 0x1000, Align: 0x4000},
+		{Type: uint32(elf.PT_DYNAMIC), Flags: uint32(elf.PF_R | elf.PF_W), Off: 0x400, Vaddr: 0x400,
+			Filesz: uint64(len(dynamicTable)), Memsz: uint64(len(dynamicTable)), Align: 0x8},
+	}
+
+	elfData := buildTestELF(elf.ET_DYN, progHeaders, []testSection{
+		{Name: ".dynamic", Type: elf.SHT_DYNAMIC, Flags: elf.SHF_ALLOC | elf.SHF_WRITE, Addr: 0x400, Offset: 0x400,
+			Data: dynamicTable, Link: 4, Entsize: 0x10},
+		{Name: ".hash", Type: elf.SHT_HASH, Flags: elf.SHF_ALLOC, Addr: 0x500, Offset: 0x500, Data: hashTable,
+			Link: 3, Entsize: 0x4},
+		{Name: ".dynsym", Type: elf.SHT_DYNSYM, Flags: elf.SHF_ALLOC, Addr: 0x600, Offset: 0x600, Data: symbolTable,
+			Link: 4, Info: 1, Entsize: 0x18},
+		{Name: ".dynstr", Type: elf.SHT_STRTAB, Flags: elf.SHF_ALLOC, Addr: 0x700, Offset: 0x700, Data: stringTable},
+		{Name: ".rela.plt", Type: elf.SHT_RELA, Flags: elf.SHF_ALLOC, Addr: 0x800, Offset: 0x800, Data: jumpTable,
+			Link: 3, Entsize: 0x18},
+		{Name: ".rela.dyn", Type: elf.SHT_RELA, Flags: elf.SHF_ALLOC, Addr: 0x880, Offset: 0x880, Data: relocations,
+			Link: 3, Entsize: 0x18},
+	})
+
+	if stripSections {
+		stripTestSectionHeaders(elfData)
+	}
+
+	return elfData
+}
+
+// writeTestImportTables resolves the imports of the given input ELF against the stubs of writeTestStubLibraries, and
+// writes its SCE string, symbol, and relocation tables as GenerateDynlibData would. Returns the jump table and the rest
+// of the relocation table.
+func writeTestImportTables(t *testing.T, elfData []byte, isFixedAddress bool) ([]elf.Rela64, []elf.Rela64) {
+	t.Helper()
+
+	sdkPath, _ := writeTestStubLibraries(t, 2, 2)
+
+	orbisElf := &OrbisElf{
+		ElfToConvert:   parseTestELF(t, elfData),
+		IsFixedAddress: isFixedAddress,
+		output:         newOverlayFile(bytes.NewReader(elfData), int64(len(elfData))),
+	}
+
+	if err := orbisElf.GenerateLibrarySymbolDictionary(sdkPath, ""); err != nil {
+		t.Fatalf("GenerateLibrarySymbolDictionary: %s", err.Error())
+	}
+
+	if err := orbisElf.resolveOptionalModules(); err != nil {
+		t.Fatalf("resolveOptionalModules: %s", err.Error())
+	}
+
+	var segmentData []byte
+
+	if _, err := writeStringTable(orbisElf, "test", "", orbisElf.ModuleList, orbisElf.LibrarySymbolDictionary,
+		&segmentData); err != nil {
+		t.Fatalf("writeStringTable: %s", err.Error())
+	}
+
+	segmentData = nil
+	writeSymbolTable(orbisElf, &segmentData)
+
+	segmentData = nil
+
+	jumpTableSize, relocationTableSize, err := writeRelocationTable(orbisElf, &segmentData)
+	if err != nil {
+		t.Fatalf("writeRelocationTable: %s", err.Error())
+	}
+
+	relocations := make([]elf.Rela64, relocationTableSize/0x18)
+	_ = binary.Read(bytes.NewReader(segmentData), binary.LittleEndian, relocations)
+
+	return relocations[:jumpTableSize/0x18], relocations[jumpTableSize/0x18:]
+}
+
+func TestWriteRelocationTableWithoutSectionHeaders(t *testing.T) {
+	for _, stripSections := range []bool{false, true} {
+		jumpTable, relocations := writeTestImportTables(t, buildTestImportELF(stripSections), false)
+
+		if len(_symbolTableNames) != 4 || _symbolTableNames[2] != "sceBench0Function0" ||
+			_symbolTableNames[3] != "sceBench1Function1" {
+			t.Fatalf("stripped sections %v: SCE symbol table holds %v, want the two imports", stripSections,
+				_symbolTableNames)
+		}
+
+		wantJumpTable := []elf.Rela64{
+			newRelocation(0xA00, 2, elf.R_X86_64_JMP_SLOT, 0),
+			newRelocation(0xA08, 1, elf.R_X86_64_RELATIVE, 0x900),
+			newRelocation(0xA10, 3, elf.R_X86_64_JMP_SLOT, 0),
+		}
+
+		wantRelocations := []elf.Rela64{
+			newRelocation(0xA18, 3, elf.R_X86_64_GLOB_DAT, 0),
+			newRelocation(0xA20, 1, elf.R_X86_64_RELATIVE, 0x900),
+		}
+
+		if !reflect.DeepEqual(jumpTable, wantJumpTable) {
+			t.Errorf("stripped sections %v: jump table is %+v, want %+v", stripSections, jumpTable, wantJumpTable)
+		}
+
+		if !reflect.DeepEqual(relocations, wantRelocations) {
+			t.Errorf("stripped sections %v: relocation table is %+v, want %+v", stripSections, relocations,
+				wantRelocations)
+		}
+	}
+}
+
+func TestWriteRelocationTableKeepsJumpTableIndices(t *testing.T) {
+	for _, isFixedAddress := range []bool{false, true} {
+		jumpTable, relocations := writeTestImportTables(t, buildTestImportELF(false), isFixedAddress)
+
+		// PLT stubs refer to their slot by index, so each entry has to stay at its position
+		wantJumpTable := []elf.Rela64{
+			newRelocation(0xA00, 2, elf.R_X86_64_JMP_SLOT, 0),
+			newRelocation(0xA08, 1, elf.R_X86_64_RELATIVE, 0x900),
+			newRelocation(0xA10, 3, elf.R_X86_64_JMP_SLOT, 0),
+		}
+
+		// The relative entry of .rela.dyn is resolved in place for fixed-address executables
+		wantRelocations := []elf.Rela64{
+			newRelocation(0xA18, 3, elf.R_X86_64_GLOB_DAT, 0),
+		}
+
+		if !isFixedAddress {
+			wantRelocations = append(wantRelocations, newRelocation(0xA20, 1, elf.R_X86_64_RELATIVE, 0x900))
+		}
+
+		if !reflect.DeepEqual(jumpTable, wantJumpTable) {
+			t.Errorf("fixed address %v: jump table is %+v, want %+v", isFixedAddress, jumpTable, wantJumpTable)
+		}
+
+		if !reflect.DeepEqual(relocations, wantRelocations) {
+			t.Errorf("fixed address %v: relocation table is %+v, want %+v", isFixedAddress, relocations,
+				wantRelocations)
+		}
+
+		// The defined function precedes the imports in .dynsym, so the SCE indices of the imports differ from their
+		// input ones, and each relocation has to name its import through the SCE symbol table
+		wantSymbols := map[uint64]string{
+			0xA00: "sceBench0Function0",
+			0xA10: "sceBench1Function1",
+			0xA18: "sceBench1Function1",
+		}
+
+		for _, relocation := range append(jumpTable, relocations...) {
+			wantSymbol, ok := wantSymbols[relocation.Off]
+			if !ok {
+				continue
+			}
+
+			symbolIndex := elf.R_SYM64(relocation.Info)
+
+			if int(symbolIndex) >= len(_symbolTableNames) || _symbolTableNames[symbolIndex] != wantSymbol {
+				t.Errorf("fixed address %v: relocation at 0x%X refers to SCE symbol %d of %v, want %s", isFixedAddress,
+					relocation.Off, symbolIndex, _symbolTableNames, wantSymbol)
+			}
+		}
+	}
+}
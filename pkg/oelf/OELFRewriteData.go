@@ -9,8 +9,8 @@ import (
 )
 
 // RewriteELFHeader will overwrite the existing ELF header to be compatible with the PS4's expectations. This includes
-// an adjusted program header count, an ET_SCE_EXEC_ASLR type, and an updated identifier. Returns an error if the write
-// failed, nil otherwise.
+// an adjusted program header count, an ET_SCE_EXEC_ASLR type (ET_SCE_EXEC for fixed-address executables), and an
+// updated identifier. Returns an error if the write failed, nil otherwise.
 func (orbisElf *OrbisElf) RewriteELFHeader() error {
 	var (
 		inputFile *os.File
@@ -26,6 +26,8 @@ func (orbisElf *OrbisElf) RewriteELFHeader() error {
 	if orbisElf.IsLibrary {
 		elfType = ET_SCE_DYNAMIC
 		elfEntry = 0
+	} else if orbisElf.IsFixedAddress {
+		elfType = ET_SCE_EXEC
 	}
 
 	// Get the section header offset info from the original file
@@ -73,7 +75,7 @@ func (orbisElf *OrbisElf) RewriteELFHeader() error {
 		return err
 	}
 
-	if _, err := orbisElf.FinalFile.WriteAt(elfHeaderBuff.Bytes(), 0); err != nil {
+	if _, err := orbisElf.output.WriteAt(elfHeaderBuff.Bytes(), 0); err != nil {
 		return err
 	}
 
@@ -101,7 +103,7 @@ func (orbisElf *OrbisElf) RewriteSDKVersion(sdkVer int) error {
 	rewriteOffset += 0x10
 
 	// Commit the write
-	_, err = orbisElf.FinalFile.WriteAt(sdkVersion, rewriteOffset)
+	_, err = orbisElf.output.WriteAt(sdkVersion, rewriteOffset)
 	return err
 }
 
@@ -119,7 +121,7 @@ func (orbisElf *OrbisElf) RewriteInterpreter(interpreter string) error {
 	}
 
 	// Commit the write
-	_, err = orbisElf.FinalFile.WriteAt(interpreterBuff, rewriteOffset)
+	_, err = orbisElf.output.WriteAt(interpreterBuff, rewriteOffset)
 	return err
 }
 
@@ -174,7 +176,7 @@ func (orbisElf *OrbisElf) RewriteDynamicSectionHeader() error {
 				return err
 			}
 
-			if _, err := orbisElf.FinalFile.WriteAt(sectionHeaderBuff.Bytes(), sectionHeaderOffset); err != nil {
+			if _, err := orbisElf.output.WriteAt(sectionHeaderBuff.Bytes(), sectionHeaderOffset); err != nil {
 				return err
 			}
 
@@ -0,0 +1,289 @@
+package oelf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stubLibrary holds what's needed from a stub library to resolve imports: its name, the module it's in, and the symbols
+// it defines indexed by name.
+type stubLibrary struct {
+	Name    string
+	Module  string
+	Symbols map[string]elf.Symbol
+}
+
+// StubCache is an on-disk cache of parsed stub libraries, so they don't need to be parsed again on each conversion.
+// Entries are keyed by the stub's path, and are used as long as the stub's size and modification time match. If they
+// changed, the stub is hashed, and the entry is still used (with the new size and time) if the contents didn't change.
+type StubCache struct {
+	Dir string
+}
+
+// _stubCacheVersion is stored in each cache entry, and has to be bumped when the entry format or the library to module
+// mapping changes so older entries aren't used.
+const _stubCacheVersion = 2
+
+// _stubCacheTempMaxAge is how old a temporary file has to be before Clear removes it. Younger ones may belong to a
+// concurrent conversion that's about to rename them into place.
+const _stubCacheTempMaxAge = time.Hour
+
+// stubCacheEntry is the on-disk form of a cached stub library. It's gob encoded, which is quick enough to decode that a
+// cache hit is cheaper than parsing the stub.
+type stubCacheEntry struct {
+	Version int
+	Path    string
+	Size    int64
+	ModTime int64
+	Hash    string
+	Library string
+	Module  string
+	Symbols []stubCacheSymbol
+}
+
+// stubCacheSymbol is the on-disk form of a symbol defined by a cached stub library.
+type stubCacheSymbol struct {
+	Name    string
+	Info    uint8
+	Other   uint8
+	Section uint16
+	Value   uint64
+	Size    uint64
+}
+
+// OpenStubCache takes the given cache directory and creates it if it doesn't exist. If dir is empty, the user's cache
+// directory is used. Returns the cache, or an error if the directory couldn't be created.
+func OpenStubCache(dir string) (*StubCache, error) {
+	if dir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+
+		dir = filepath.Join(userCacheDir, "create-fself", "stubs")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &StubCache{Dir: dir}, nil
+}
+
+// Clear removes every entry from the cache, as well as temporary files left by interrupted writes. Returns an error if
+// an entry couldn't be removed, nil otherwise.
+func (stubCache *StubCache) Clear() error {
+	entries, err := ioutil.ReadDir(stubCache.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// Entries from before version 2 were JSON
+		isEntry := strings.HasSuffix(entry.Name(), ".gob") || strings.HasSuffix(entry.Name(), ".json")
+		isStaleTemp := strings.HasSuffix(entry.Name(), ".tmp") && time.Since(entry.ModTime()) > _stubCacheTempMaxAge
+
+		if !isEntry && !isStaleTemp {
+			continue
+		}
+
+		// A concurrent conversion may have replaced or removed the file since it was listed
+		if err := os.Remove(filepath.Join(stubCache.Dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findLibrary searches the toolchain's lib directory and the given library path for the library with the given file
+// name. Returns the path of the first match, or an error if the library isn't in any of the directories.
+func findLibrary(name string, sdkPath string, libPath string) (string, error) {
+	libraryPath := ""
+	var err error
+
+	for _, libDir := range getLibraryDirs(sdkPath, libPath) {
+		libraryPath = libDir + "/" + name
+
+		if _, err = os.Stat(libraryPath); err == nil {
+			return libraryPath, nil
+		}
+	}
+
+	return "", err
+}
+
+// getLibraryModule takes a given library name and returns the name of the module it's in.
+func getLibraryModule(libraryName string) string {
+	// Check if it is a weird library hidden inside a module
+	if moduleName, ok := _extraLibraryToModule[libraryName]; ok {
+		return moduleName
+	}
+
+	// Assume module name is the library name
+	return libraryName
+}
+
+// loadStubLibrary takes the stub library with the given file name, found in the toolchain's lib directory or the given
+// library path, and loads the symbols it defines. The stub cache is used if there is one. Returns the stub library, or
+// an error if it couldn't be found or parsed.
+func (orbisElf *OrbisElf) loadStubLibrary(name string, sdkPath string, libPath string) (*stubLibrary, error) {
+	libraryPath, err := findLibrary(name, sdkPath, libPath)
+	if err != nil {
+		return nil, err
+	}
+
+	libraryName := strings.Replace(name, ".so", "", 1)
+
+	if orbisElf.StubCache == nil {
+		libraryObj, err := elf.Open(libraryPath)
+		if err != nil {
+			return nil, err
+		}
+
+		defer libraryObj.Close()
+		symbols, _ := libraryObj.Symbols()
+
+		return &stubLibrary{
+			Name:    libraryName,
+			Module:  getLibraryModule(libraryName),
+			Symbols: indexLibrarySymbols(symbols),
+		}, nil
+	}
+
+	return orbisElf.StubCache.load(libraryPath, libraryName)
+}
+
+// load takes the stub library at the given path and loads it from the cache, or parses it and adds it to the cache if
+// the cached entry is missing or out of date. Failing to write the cache isn't an error, the stub is just parsed again
+// next time. Returns the stub library, or an error if it couldn't be read or parsed.
+func (stubCache *StubCache) load(libraryPath string, libraryName string) (*stubLibrary, error) {
+	absolutePath, err := filepath.Abs(libraryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(absolutePath)
+	if err != nil {
+		return nil, err
+	}
+
+	pathHash := sha256.Sum256([]byte(absolutePath))
+	entryPath := filepath.Join(stubCache.Dir, hex.EncodeToString(pathHash[:16])+".gob")
+
+	entry := stubCacheEntry{}
+	entryData, err := ioutil.ReadFile(entryPath)
+
+	isEntryValid := err == nil && gob.NewDecoder(bytes.NewReader(entryData)).Decode(&entry) == nil &&
+		entry.Version == _stubCacheVersion &&
+		entry.Path == absolutePath && entry.Library == libraryName
+
+	// An unchanged size and modification time is trusted, so cache hits don't read the stub at all
+	if isEntryValid && entry.Size == fileInfo.Size() && entry.ModTime == fileInfo.ModTime().UnixNano() {
+		return entry.toStubLibrary(), nil
+	}
+
+	libraryData, err := ioutil.ReadFile(absolutePath)
+	if err != nil {
+		return nil, err
+	}
+
+	libraryHash := sha256.Sum256(libraryData)
+
+	// The stub was touched (ie. by reinstalling the toolchain) but its contents are the same
+	if isEntryValid && entry.Hash == hex.EncodeToString(libraryHash[:]) {
+		entry.Size = fileInfo.Size()
+		entry.ModTime = fileInfo.ModTime().UnixNano()
+		stubCache.writeEntry(entryPath, entry)
+
+		return entry.toStubLibrary(), nil
+	}
+
+	libraryObj, err := elf.NewFile(bytes.NewReader(libraryData))
+	if err != nil {
+		return nil, err
+	}
+
+	symbols, _ := libraryObj.Symbols()
+	library := &stubLibrary{
+		Name:    libraryName,
+		Module:  getLibraryModule(libraryName),
+		Symbols: indexLibrarySymbols(symbols),
+	}
+
+	entry = stubCacheEntry{
+		Version: _stubCacheVersion,
+		Path:    absolutePath,
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime().UnixNano(),
+		Hash:    hex.EncodeToString(libraryHash[:]),
+		Library: library.Name,
+		Module:  library.Module,
+	}
+
+	// Write symbols in the stub's order, so entries don't change between runs
+	for _, symbol := range symbols {
+		if indexed, ok := library.Symbols[symbol.Name]; ok && indexed == symbol {
+			entry.Symbols = append(entry.Symbols, stubCacheSymbol{
+				Name:    symbol.Name,
+				Info:    symbol.Info,
+				Other:   symbol.Other,
+				Section: uint16(symbol.Section),
+				Value:   symbol.Value,
+				Size:    symbol.Size,
+			})
+		}
+	}
+
+	stubCache.writeEntry(entryPath, entry)
+	return library, nil
+}
+
+// writeEntry writes the given entry to the given entry path. Errors are ignored, the stub is just parsed again next
+// time.
+func (stubCache *StubCache) writeEntry(entryPath string, entry stubCacheEntry) {
+	entryBuff := new(bytes.Buffer)
+	if err := gob.NewEncoder(entryBuff).Encode(entry); err != nil {
+		return
+	}
+
+	// Write to a temporary file first, so concurrent conversions never read a partial entry
+	if tempFile, err := ioutil.TempFile(stubCache.Dir, "*.tmp"); err == nil {
+		_, writeErr := tempFile.Write(entryBuff.Bytes())
+		closeErr := tempFile.Close()
+
+		if writeErr != nil || closeErr != nil || os.Rename(tempFile.Name(), entryPath) != nil {
+			_ = os.Remove(tempFile.Name())
+		}
+	}
+}
+
+// toStubLibrary returns the stub library the entry was cached from.
+func (entry *stubCacheEntry) toStubLibrary() *stubLibrary {
+	library := &stubLibrary{
+		Name:    entry.Library,
+		Module:  entry.Module,
+		Symbols: make(map[string]elf.Symbol, len(entry.Symbols)),
+	}
+
+	for _, symbol := range entry.Symbols {
+		library.Symbols[symbol.Name] = elf.Symbol{
+			Name:    symbol.Name,
+			Info:    symbol.Info,
+			Other:   symbol.Other,
+			Section: elf.SectionIndex(symbol.Section),
+			Value:   symbol.Value,
+			Size:    symbol.Size,
+		}
+	}
+
+	return library
+}
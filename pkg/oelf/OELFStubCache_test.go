@@ -0,0 +1,153 @@
+package oelf
+
+import (
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestStub writes a stub library defining the given functions to the given path, and sets its modification time
+// to modTime. The contents only depend on the function names, so stubs with names of the same length have the same size.
+func writeTestStub(t *testing.T, stubPath string, functions []string, modTime time.Time) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(stubPath, buildTestSymbolELF(elf.ET_DYN, functions, true, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(stubPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadTestStub loads the stub at the given path through the given cache, and returns the names of the symbols it
+// defines in sorted order.
+func loadTestStub(t *testing.T, stubCache *StubCache, stubPath string) []string {
+	t.Helper()
+
+	library, err := stubCache.load(stubPath, "libSceTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if library.Name != "libSceTest" || library.Module != "libSceTest" {
+		t.Errorf("library is %s in module %s, want libSceTest in module libSceTest", library.Name, library.Module)
+	}
+
+	var names []string
+
+	for name := range library.Symbols {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// getTestCacheEntries returns the names of the entries in the given cache's directory.
+func getTestCacheEntries(t *testing.T, stubCache *StubCache) []string {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(stubCache.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
+
+func TestStubCache(t *testing.T) {
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	stubPath := filepath.Join(t.TempDir(), "libSceTest.so")
+
+	stubCache, err := OpenStubCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Miss: there's no entry, so the stub is parsed and an entry is written
+	writeTestStub(t, stubPath, []string{"sceTestA", "sceTestB"}, modTime)
+
+	if names := loadTestStub(t, stubCache, stubPath); strings.Join(names, ",") != "sceTestA,sceTestB" {
+		t.Errorf("miss: got symbols %v, want [sceTestA sceTestB]", names)
+	}
+
+	entries := getTestCacheEntries(t, stubCache)
+
+	if len(entries) != 1 || !strings.HasSuffix(entries[0], ".gob") {
+		t.Fatalf("miss: cache has entries %v, want one .gob entry", entries)
+	}
+
+	// Hit: the size and modification time match, so the entry is trusted without reading the stub. The stub is
+	// changed behind the cache's back to show it isn't read.
+	writeTestStub(t, stubPath, []string{"sceTestC", "sceTestD"}, modTime)
+
+	if names := loadTestStub(t, stubCache, stubPath); strings.Join(names, ",") != "sceTestA,sceTestB" {
+		t.Errorf("hit: got symbols %v, want the cached [sceTestA sceTestB]", names)
+	}
+
+	// Stale modification time, same contents: the stub is hashed, and the entry is kept with the new time
+	writeTestStub(t, stubPath, []string{"sceTestA", "sceTestB"}, modTime.Add(time.Hour))
+
+	if names := loadTestStub(t, stubCache, stubPath); strings.Join(names, ",") != "sceTestA,sceTestB" {
+		t.Errorf("touched: got symbols %v, want [sceTestA sceTestB]", names)
+	}
+
+	// The entry has the new time now, so it's a hit again
+	writeTestStub(t, stubPath, []string{"sceTestC", "sceTestD"}, modTime.Add(time.Hour))
+
+	if names := loadTestStub(t, stubCache, stubPath); strings.Join(names, ",") != "sceTestA,sceTestB" {
+		t.Errorf("hit after touch: got symbols %v, want the cached [sceTestA sceTestB]", names)
+	}
+
+	// Stale modification time, new contents: the hash doesn't match, so the stub is parsed again
+	writeTestStub(t, stubPath, []string{"sceTestC", "sceTestD", "sceTestE"}, modTime.Add(2*time.Hour))
+
+	if names := loadTestStub(t, stubCache, stubPath); strings.Join(names, ",") != "sceTestC,sceTestD,sceTestE" {
+		t.Errorf("changed: got symbols %v, want [sceTestC sceTestD sceTestE]", names)
+	}
+
+	// The new entry is used from now on
+	writeTestStub(t, stubPath, []string{"sceTestF", "sceTestG", "sceTestH"}, modTime.Add(2*time.Hour))
+
+	if names := loadTestStub(t, stubCache, stubPath); strings.Join(names, ",") != "sceTestC,sceTestD,sceTestE" {
+		t.Errorf("hit after change: got symbols %v, want the cached [sceTestC sceTestD sceTestE]", names)
+	}
+
+	// Clear: entries (and leftovers of older versions and interrupted writes) are removed, anything else is kept. A
+	// recent temporary file may be an entry that's being written, so it's kept too.
+	for _, name := range []string{"old.json", "partial.tmp", "writing.tmp", "unrelated.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(stubCache.Dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	staleTime := time.Now().Add(-2 * _stubCacheTempMaxAge)
+
+	if err := os.Chtimes(filepath.Join(stubCache.Dir, "partial.tmp"), staleTime, staleTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stubCache.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := getTestCacheEntries(t, stubCache); strings.Join(entries, ",") != "unrelated.txt,writing.tmp" {
+		t.Errorf("clear: cache has entries %v, want [unrelated.txt writing.tmp]", entries)
+	}
+
+	if names := loadTestStub(t, stubCache, stubPath); strings.Join(names, ",") != "sceTestF,sceTestG,sceTestH" {
+		t.Errorf("cleared: got symbols %v, want [sceTestF sceTestG sceTestH]", names)
+	}
+}
@@ -0,0 +1,180 @@
+package oelf
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"sort"
+)
+
+// SymbolicatedAddress holds everything that could be found out about a module-relative address.
+type SymbolicatedAddress struct {
+	Address       uint64
+	Segment       string
+	SegmentOffset uint64
+	Symbol        string
+	SymbolOffset  uint64
+	File          string
+	Line          int
+}
+
+// Symbolicator maps module-relative addresses of a converted module to segments, symbols, and source lines.
+type Symbolicator struct {
+	segments  []*elf.Prog
+	symbols   []elf.Symbol
+	dwarfData []*dwarf.Data
+}
+
+// String formats the symbolicated address on one line, ie. `0x4010 text+0x10 main+0x4 main.c:12`.
+func (address SymbolicatedAddress) String() string {
+	str := fmt.Sprintf("0x%X", address.Address)
+
+	if address.Segment == "" {
+		return str + " (outside of module)"
+	}
+
+	str += fmt.Sprintf(" %s+0x%X", address.Segment, address.SegmentOffset)
+
+	if address.Symbol != "" {
+		str += fmt.Sprintf(" %s+0x%X", address.Symbol, address.SymbolOffset)
+	} else {
+		str += " ??"
+	}
+
+	if address.File != "" {
+		str += fmt.Sprintf(" %s:%d", address.File, address.Line)
+	}
+
+	return str
+}
+
+// NewSymbolicator creates a symbolicator for a module. The module ELF provides the segment layout (ie. the ELF embedded
+// in the fself, or a debug ELF written by WriteDebugELF). Symbols and DWARF line info are taken from the module ELF
+// as well as any given debug ELFs, in that order. Returns the symbolicator, or an error if no symbols were found.
+func NewSymbolicator(moduleElf *elf.File, debugElfs ...*elf.File) (*Symbolicator, error) {
+	symbolicator := Symbolicator{}
+
+	for _, progHeader := range moduleElf.Progs {
+		if getSegmentName(progHeader) != "" {
+			symbolicator.segments = append(symbolicator.segments, progHeader)
+		}
+	}
+
+	for _, symbolElf := range append([]*elf.File{moduleElf}, debugElfs...) {
+		// Stripped files won't have either table, which is fine as long as one of the ELFs has symbols
+		symbols, _ := symbolElf.Symbols()
+		dynamicSymbols, _ := symbolElf.DynamicSymbols()
+
+		for _, symbol := range append(symbols, dynamicSymbols...) {
+			symbolType := elf.ST_TYPE(symbol.Info)
+
+			if symbol.Section == elf.SHN_UNDEF || symbol.Name == "" {
+				continue
+			}
+
+			if symbolType == elf.STT_FUNC || symbolType == elf.STT_OBJECT {
+				symbolicator.symbols = append(symbolicator.symbols, symbol)
+			}
+		}
+
+		if dwarfData, err := symbolElf.DWARF(); err == nil {
+			symbolicator.dwarfData = append(symbolicator.dwarfData, dwarfData)
+		}
+	}
+
+	if len(symbolicator.symbols) == 0 {
+		return nil, fmt.Errorf("no symbols found, a debug ELF (-debug-out) or the original input ELF is needed")
+	}
+
+	// Symbols are searched by address, earlier sources win on ties since the sort is stable
+	sort.SliceStable(symbolicator.symbols, func(i int, j int) bool {
+		return symbolicator.symbols[i].Value < symbolicator.symbols[j].Value
+	})
+
+	return &symbolicator, nil
+}
+
+// Symbolicate takes a given module-relative address and looks up its segment, the symbol containing it, and the
+// source line if DWARF line info is available. Returns the symbolicated address.
+func (symbolicator *Symbolicator) Symbolicate(address uint64) SymbolicatedAddress {
+	result := SymbolicatedAddress{Address: address}
+
+	for _, segment := range symbolicator.segments {
+		if address >= segment.Vaddr && address < segment.Vaddr+segment.Memsz {
+			result.Segment = getSegmentName(segment)
+			result.SegmentOffset = address - segment.Vaddr
+			break
+		}
+	}
+
+	if result.Segment == "" {
+		return result
+	}
+
+	// Find the last symbol that starts at or before the address
+	symbolIndex := sort.Search(len(symbolicator.symbols), func(i int) bool {
+		return symbolicator.symbols[i].Value > address
+	}) - 1
+
+	for ; symbolIndex >= 0; symbolIndex-- {
+		symbol := symbolicator.symbols[symbolIndex]
+
+		// Sized symbols must contain the address, unsized ones are taken as the closest match
+		if symbol.Size == 0 || address < symbol.Value+symbol.Size {
+			result.Symbol = symbol.Name
+			result.SymbolOffset = address - symbol.Value
+			break
+		}
+	}
+
+	for _, dwarfData := range symbolicator.dwarfData {
+		if file, line, ok := lookupLine(dwarfData, address); ok {
+			result.File = file
+			result.Line = line
+			break
+		}
+	}
+
+	return result
+}
+
+// lookupLine takes the given DWARF data and address, and finds the source file and line for it. Returns the file and
+// line, and true if they were found.
+func lookupLine(dwarfData *dwarf.Data, address uint64) (string, int, bool) {
+	reader := dwarfData.Reader()
+
+	compileUnit, err := reader.SeekPC(address)
+	if err != nil {
+		return "", 0, false
+	}
+
+	lineReader, err := dwarfData.LineReader(compileUnit)
+	if err != nil || lineReader == nil {
+		return "", 0, false
+	}
+
+	lineEntry := dwarf.LineEntry{}
+
+	if err := lineReader.SeekPC(address, &lineEntry); err != nil {
+		return "", 0, false
+	}
+
+	return lineEntry.File.Name, lineEntry.Line, true
+}
+
+// getSegmentName returns the name of the module segment the given program header maps, as laid out by
+// GenerateProgramHeaders. Returns an empty string for program headers that don't map module memory.
+func getSegmentName(progHeader *elf.Prog) string {
+	switch {
+	case progHeader.Type == PT_SCE_RELRO:
+		return "relro"
+	case progHeader.Type != elf.PT_LOAD:
+		return ""
+	case progHeader.Flags&elf.PF_X != 0:
+		return "text"
+	case progHeader.Flags&elf.PF_W != 0:
+		return "data"
+	default:
+		return "rodata"
+	}
+}
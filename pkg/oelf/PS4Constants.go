@@ -7,6 +7,7 @@ package oelf
 // SCE-specific ELF types
 ///
 
+const ET_SCE_EXEC = 0xFE00
 const ET_SCE_EXEC_ASLR = 0xFE10
 const ET_SCE_DYNAMIC = 0xFE18
 
@@ -47,6 +48,11 @@ const DT_SCE_SYMENT = 0x6100003b   // Total size of SCE dynamic symbol table ent
 const DT_SCE_HASHSZ = 0x6100003d   // Total size of SCE symbol hash table (NID's?)
 const DT_SCE_SYMTABSZ = 0x6100003f // Total size of SCE dynamic symbol table
 
+// SCE-specific library and module attributes
+const SCE_LIB_ATTR_IMPORT = 0x9         // Attributes of imported libraries
+const SCE_LIB_ATTR_WEAK_IMPORT = 0x2    // Optional library, its symbols may be left unresolved
+const SCE_MODULE_ATTR_WEAK_IMPORT = 0x2 // Optional module, allowed to fail to load
+
 const R_AMD64_64 = 0x00000001
 
 type SceHashTable struct {